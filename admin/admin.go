@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Admin is the http interface to inspect the running state
+type Admin struct {
+	lock   sync.Mutex
+	log    *zerolog.Logger
+	mux    *http.ServeMux
+	paths  []string
+	server *http.Server
+}
+
+func NewAdmin(zlog *zerolog.Logger) *Admin {
+	a := &Admin{
+		log: zlog,
+		mux: http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/", a.index)
+	return a
+}
+
+// Handle registers a handler, the index lists all registered paths
+func (a *Admin) Handle(path string, handler http.Handler) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.mux.Handle(path, handler)
+	a.paths = append(a.paths, path)
+	sort.Strings(a.paths)
+}
+
+func (a *Admin) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, path := range a.paths {
+		fmt.Fprintln(w, path)
+	}
+}
+
+// Start listens on addr and serves in the background
+func (a *Admin) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	a.server = &http.Server{
+		Handler:           a.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := a.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			a.log.Error().Err(err).Msg("admin server stopped")
+		}
+	}()
+	a.log.Info().Str("listen", listener.Addr().String()).Msg("admin server started")
+	return nil
+}
+
+func (a *Admin) Stop() error {
+	if a.server == nil {
+		return nil
+	}
+	return a.server.Close()
+}
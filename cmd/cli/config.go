@@ -1,15 +1,22 @@
 package cli
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"math"
 	"net"
+	"net/netip"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	des "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/mabels/steinstuecken/dns_forwarder"
+	"github.com/mabels/steinstuecken/resolvers/local"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog"
 	"github.com/spf13/pflag"
@@ -20,21 +27,119 @@ type Port struct {
 	Proto string
 }
 
+const (
+	ActionAccept = "accept"
+	ActionDrop   = "drop"
+	ActionReject = "reject"
+
+	// deny targets are evaluated before accept targets by default
+	DefaultDenyPriority   = 100
+	DefaultAcceptPriority = 1000
+)
+
 type Target struct {
-	Subjects    []des.Subject
-	Ports       []Port
-	NonStateful bool
-	Interface   struct {
+	ID            string  // hash of the target url in the rule comments
+	Action        string  // accept, drop or reject
+	RejectWith    *string // --reject-with of reject targets
+	Priority      int     // lower priorities are evaluated first
+	Sources       []des.AddressSource
+	Wildcard      *Wildcard           // instead of Sources for *.example.com
+	From          []des.AddressSource // empty means any source
+	Ports         []Port
+	NonStateful   bool
+	Authoritative bool         // resolve with the authoritative nameservers of the names
+	Aggregate     bool         // install the covering prefixes of the addresses
+	MaxWiden      int          // ipv4 prefix length neighbouring addresses may be widened to, 0 never widens
+	MaxWiden6     int          // likewise for ipv6
+	Families      []des.Family // the installed address families, empty means all
+	Interface     struct {
 		Input  *string
 		Output *string
 	}
 	Protos  []string
+	Log     *string // empty means Config.Log.Target, nflog or log
 	Snat4   *string
 	Snat6   *string
 	Masq    *string
 	Forward *string
 }
 
+// HasFamily is true if the addresses of family are installed
+func (t *Target) HasFamily(family des.Family) bool {
+	return len(t.Families) == 0 || hasFamily(t.Families, family)
+}
+
+// Wildcard targets instantiate a subject per observed matching name
+type Wildcard struct {
+	Pattern string // like *.example.com, matches the subdomains only
+	Types   []uint16
+	Idle    time.Duration // a name is removed after idle without answers
+}
+
+func (w *Wildcard) Matches(name string) bool {
+	name = strings.ToLower(strings.TrimRight(name, "."))
+	return strings.HasSuffix(name, w.Pattern[1:]) && len(name) > len(w.Pattern)-1
+}
+
+func (w *Wildcard) HasType(qtype uint16) bool {
+	for _, typ := range w.Types {
+		if typ == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// setAuthority resolves the dns names of the target and its sources with
+// the authoritative nameservers
+func (t *Target) setAuthority(authority *local.Authority) {
+	for _, sources := range [][]des.AddressSource{t.Sources, t.From} {
+		for _, source := range sources {
+			if sys, ok := DnsSubject(source); ok {
+				sys.Authority = authority
+			}
+		}
+	}
+}
+
+// DnsNames returns the resolved dns names with the expansions of the search
+// domains and the wildcard pattern of the destinations
+func (t *Target) DnsNames() []string {
+	names := []string{}
+	for _, source := range t.Sources {
+		if sys, ok := DnsSubject(source); ok {
+			names = append(names, sys.Names()...)
+		}
+	}
+	if t.Wildcard != nil {
+		names = append(names, t.Wildcard.Pattern)
+	}
+	return names
+}
+
+type LogOptions struct {
+	Drops      bool   // log before the final DROP
+	Target     string // nflog or log
+	NflogGroup int
+	Rate       string // like 10/minute
+	Burst      int
+}
+
+type DnsForwardOptions struct {
+	Listen    string   // empty disables the forwarder
+	Upstreams []string // ip[:port]
+	MinTTL    time.Duration
+	Filter    string   // empty forwards every name, refused or nxdomain
+	Allow     []string // names or *.wildcards allowed besides the targets
+}
+
+type DnsSnoopOptions struct {
+	Mode   string // empty disables the snooping, nflog, nfqueue or afpacket
+	Queue  int    // NFQUEUE number of the nfqueue mode
+	Iface  string // interface of the afpacket mode
+	MinTTL time.Duration
+}
+
 type Config struct {
 	// ForwardMode bool
 	// MasqMode    bool
@@ -45,11 +150,26 @@ type Config struct {
 	AlternatePath  string
 	AlternateForce bool // default false override AlternatePath
 	SrcPath        string
-	IpTablesType   string   // empty means system -- nft or legacy default nft
-	DisableIPv4    bool     // default false
-	DisableIPv6    bool     // default false
-	targetsStr     []string // sken://target[:port]/?type=A&nameserver=IP&snat=IP&masq[=oif]&forward
+	IpTablesType   string // empty means system -- nft or legacy default nft
+	DisableIPv4    bool   // default false
+	DisableIPv6    bool   // default false
+	Log            LogOptions
+	ReportDrops    bool          // nflog the drops and dns answers to report the denied names
+	ReportInterval time.Duration // 0 disables the periodic log of the report
+	AdminListen    string        // empty disables the admin http server
+	Learn          bool          // log and accept instead of the final DROP
+	LearnWindow    time.Duration // interval to write the proposed targets
+	LearnOutput    string        // file of the proposed targets, - is stdout
+	DnsForward     DnsForwardOptions
+	DnsSnoop       DnsSnoopOptions
+	WildcardIdle   time.Duration // default idle of wildcard targets
+	AuthorityHints []string      // nameservers to find the authoritative ones, default the root servers
+	InstanceID     string        // owner of the chains in the rule comments, default random per process
+	Adopt          bool          // keep the rules of the previous generation instead of flushing
+	AdoptGrace     time.Duration // time after the adopted rules are removed
+	targetsStr     []string      // sken://target[:port]/?type=A&nameserver=IP&snat=IP&masq[=oif]&forward
 	Targets        []Target
+	Command        string // empty means run, validate only checks the targets
 }
 
 type Cidr struct {
@@ -74,176 +194,516 @@ func (c *Cidr) Header() *dns.RR_Header {
 var rePorts = regexp.MustCompile("[|,]+")
 var rePrefixUrl = regexp.MustCompile(`/\d+$`)
 
-func getSubjects(targetUrl *url.URL, log *zerolog.Logger) ([]des.Subject, error) {
-	var subjects []des.Subject
-	if net.ParseIP(targetUrl.Hostname()) != nil {
-		ip := net.ParseIP(targetUrl.Hostname())
-		rrType := dns.TypeA
-		if ip.To4() == nil {
-			rrType = dns.TypeAAAA
-		}
-		rrHeader := dns.RR_Header{
-			Name:     targetUrl.Hostname(),
-			Rrtype:   rrType,
-			Ttl:      math.MaxInt32,
-			Class:    dns.ClassINET,
-			Rdlength: uint16(len(ip)),
-		}
-		txt := ip.String()
+// DnsSubject returns the resolved subject of a dns source
+func DnsSubject(source des.AddressSource) (*des.SysResolverSubject, bool) {
+	dnsSource, ok := source.(*des.DnsSource)
+	if !ok {
+		return nil, false
+	}
+	sys, ok := dnsSource.Subject.(*des.SysResolverSubject)
+	return sys, ok
+}
+
+func literalSource(prefix netip.Prefix) des.AddressSource {
+	return &des.LiteralSource{Prefixes: []netip.Prefix{prefix}}
+}
+
+// urlSource returns the file or http source of a file:// or http(s):// url
+func urlSource(sourceUrl *url.URL) (des.AddressSource, error) {
+	switch sourceUrl.Scheme {
+	case "file":
+		if sourceUrl.Host != "" || !strings.HasPrefix(sourceUrl.Path, "/") {
+			return nil, fmt.Errorf("%s is not an absolute path like file:///etc/cidrs", sourceUrl)
+		}
+		return &des.FileSource{Path: sourceUrl.Path}, nil
+	case "http", "https":
+		if sourceUrl.Host == "" {
+			return nil, fmt.Errorf("%s has no host", sourceUrl)
+		}
+		return &des.HttpSource{URL: sourceUrl.String()}, nil
+	}
+	return nil, fmt.Errorf("unknown source scheme %q, use file, http or https", sourceUrl.Scheme)
+}
+
+// getSources parses from= entries, cidrs and addresses are fix, dns names
+// are resolved for A and AAAA of the families of the target, file:// and
+// http(s):// urls are watched
+func getSources(targetUrl *url.URL, log *zerolog.Logger, families []des.Family, tes *targetErrors) []des.AddressSource {
+	sources := []des.AddressSource{}
+	for _, fromStr := range targetUrl.Query()["from"] {
+		for _, from := range rePorts.Split(fromStr, -1) {
+			if from == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(from)
+			if err != nil {
+				if addr, aerr := netip.ParseAddr(from); aerr == nil {
+					addr = addr.Unmap()
+					prefix, err = netip.PrefixFrom(addr, addr.BitLen()), nil
+				}
+			}
+			if err == nil {
+				if validatePrefixFamily("from", prefix, families, tes) {
+					sources = append(sources, literalSource(prefix))
+				}
+				continue
+			}
+			if strings.Contains(from, "://") {
+				sourceUrl, err := url.Parse(from)
+				if err == nil {
+					var source des.AddressSource
+					source, err = urlSource(sourceUrl)
+					if err == nil {
+						sources = append(sources, source)
+						continue
+					}
+				}
+				tes.add("from", from, "%v", err)
+				continue
+			}
+			if _, ok := dns.IsDomainName(from); !ok || strings.Contains(from, "/") {
+				tes.add("from", from, "is neither an address, a cidr nor a dns name")
+				continue
+			}
+			// only single labels like db are expanded with the search domains,
+			// api.example.com is absolute like the keys of the dns forwarder
+			search := !strings.Contains(from, ".")
+			hostname := dns.Fqdn(from)
+			for _, typ := range validateTypeFamilies(nil, false, families, tes) {
+				sources = append(sources, &des.DnsSource{Subject: &des.SysResolverSubject{
+					Log:         log,
+					Search:      search,
+					NameServers: targetUrl.Query()["nameserver"],
+					Question: dns.Question{
+						Name:   hostname,
+						Qclass: dns.ClassINET,
+						Qtype:  typ,
+					},
+				}})
+			}
+		}
+	}
+	return sources
+}
+
+// getWildcard parses *.example.com targets, the names are observed by
+// the dns forwarder or the passive dns snooping
+func getWildcard(targetUrl *url.URL, families []des.Family, tes *targetErrors) *Wildcard {
+	pattern := strings.ToLower(strings.TrimRight(targetUrl.Hostname(), "."))
+	if err := dns_forwarder.ValidPattern(pattern); err != nil || !strings.HasPrefix(pattern, "*.") {
+		tes.add("", "", "%q is not a wildcard like *.example.com", targetUrl.Hostname())
+		return nil
+	}
+	if _, found := targetUrl.Query()["nameserver"]; found {
+		tes.add("nameserver", targetUrl.Query().Get("nameserver"), "wildcard targets are not resolved, their names are observed")
+	}
+	if _, found := targetUrl.Query()["authoritative"]; found {
+		tes.add("authoritative", targetUrl.Query().Get("authoritative"), "wildcard targets are not resolved, their names are observed")
+	}
+	strTypes, found := targetUrl.Query()["type"]
+	wildcard := &Wildcard{
+		Pattern: pattern,
+		Types:   validateTypeFamilies(strTypes, found, families, tes),
+	}
+	if idleStr, found := targetUrl.Query()["idle"]; found {
+		idle, err := time.ParseDuration(idleStr[0])
+		if err != nil || idle <= 0 {
+			tes.add("idle", idleStr[0], "not a positive duration like 10m")
+		}
+		wildcard.Idle = idle
+	}
+	return wildcard
+}
+
+// getFeedDestination returns the source of sken-feed://aws?service=S3,
+// service and region are repeatable or comma separated
+func getFeedDestination(targetUrl *url.URL, tes *targetErrors) []des.AddressSource {
+	for _, key := range []string{"type", "nameserver", "authoritative"} {
+		if _, found := targetUrl.Query()[key]; found {
+			tes.add(key, targetUrl.Query().Get(key), "only valid for dns names")
+		}
+	}
+	provider := strings.ToLower(targetUrl.Hostname())
+	feed, found := des.Feeds[provider]
+	if !found {
+		providers := make([]string, 0, len(des.Feeds))
+		for name := range des.Feeds {
+			providers = append(providers, name)
+		}
+		sort.Strings(providers)
+		tes.add("", "", "unknown feed %q, known feeds are %s", provider, strings.Join(providers, ","))
+		return nil
+	}
+	if targetUrl.Path != "" && targetUrl.Path != "/" {
+		tes.add("", "", "feeds have no path %s", targetUrl.Path)
+	}
+	filter := des.FeedFilter{}
+	for key, values := range map[string]*[]string{"service": &filter.Services, "region": &filter.Regions} {
+		for _, valueStr := range targetUrl.Query()[key] {
+			for _, value := range rePorts.Split(valueStr, -1) {
+				if value != "" {
+					*values = append(*values, value)
+				}
+			}
+		}
+	}
+	if len(filter.Regions) > 0 && !feed.Regions {
+		tes.add("region", strings.Join(filter.Regions, ","), "the %s feed has no regions", provider)
+	}
+	return []des.AddressSource{&des.FeedSource{Provider: provider, Filter: filter}}
+}
+
+// getUrlDestination returns the source of a sken-file:// or sken-http(s)://
+// target, the query are the options of the target
+func getUrlDestination(targetUrl *url.URL, sourceScheme string, tes *targetErrors) []des.AddressSource {
+	for _, key := range []string{"type", "nameserver", "authoritative"} {
+		if _, found := targetUrl.Query()[key]; found {
+			tes.add(key, targetUrl.Query().Get(key), "only valid for dns names")
+		}
+	}
+	sourceUrl := &url.URL{Scheme: sourceScheme, Host: targetUrl.Host, Path: targetUrl.Path}
+	source, err := urlSource(sourceUrl)
+	if err != nil {
+		tes.add("", "", "%v", err)
+		return nil
+	}
+	return []des.AddressSource{source}
+}
+
+func getDestinations(targetUrl *url.URL, log *zerolog.Logger, families []des.Family, tes *targetErrors) []des.AddressSource {
+	var sources []des.AddressSource
+	if addr, err := netip.ParseAddr(targetUrl.Hostname()); err == nil {
+		addr = addr.Unmap()
+		for _, key := range []string{"type", "nameserver", "authoritative"} {
+			if _, found := targetUrl.Query()[key]; found {
+				tes.add(key, targetUrl.Query().Get(key), "only valid for dns names, %s is an address", targetUrl.Hostname())
+			}
+		}
+		bits := addr.BitLen()
 		prefixStr := targetUrl.Path
 		if rePrefixUrl.MatchString(prefixStr) {
+			maxPrefix := addr.BitLen()
 			prefix, err := strconv.Atoi(strings.TrimLeft(prefixStr, "/"))
-			if !(err == nil && ((ip.To4() == nil && prefix >= 0 && prefix <= 128) ||
-				(ip.To4() != nil && prefix >= 0 && prefix <= 32))) {
-				prefix = 32
-				if ip.To4() == nil {
-					prefix = 128
-				}
+			if err != nil || prefix < 0 || prefix > maxPrefix {
+				tes.add("", "", "prefix %s out of range /0-/%d", prefixStr, maxPrefix)
+				return nil
 			}
-			txt = fmt.Sprintf("%s/%d", txt, prefix)
-		}
-		rr := &dns.TXT{
-			Hdr: rrHeader,
-			Txt: []string{txt},
-		}
-		subjects = append(subjects, &des.FixResolverSubject{
-			Question: dns.Question{
-				Name:   targetUrl.Hostname(),
-				Qtype:  dns.TypeTXT,
-				Qclass: dns.ClassINET,
-			},
-			Result: []dns.RR{rr},
-		})
+			bits = prefix
+		} else if !(prefixStr == "" || prefixStr == "/") {
+			tes.add("", "", "path %s is not a prefix like /24", prefixStr)
+			return nil
+		}
+		prefix := netip.PrefixFrom(addr, bits)
+		if !validatePrefixFamily("", prefix, families, tes) {
+			return nil
+		}
+		sources = append(sources, literalSource(prefix))
 	} else {
 		hostname := targetUrl.Hostname()
-		if !strings.HasSuffix(hostname, ".") {
-			hostname += "." // dns package requires trailing dot
+		if _, ok := dns.IsDomainName(hostname); !ok || hostname == "" {
+			tes.add("", "", "%q is neither an address nor a dns name", hostname)
+			return nil
 		}
+		// only single labels like db are expanded with the search domains,
+		// api.example.com is absolute like the keys of the dns forwarder
+		search := !strings.Contains(hostname, ".")
+		hostname = dns.Fqdn(hostname) // dns package requires trailing dot
 		strTypes, found := targetUrl.Query()["type"]
-		if !found {
-			strTypes = []string{"A"}
-		}
-		types := []uint16{}
-		for _, strType := range strTypes {
-			typ, found := dns.StringToType[strType]
-			if !found {
-				continue
+		types := validateTypeFamilies(strTypes, found, families, tes)
+		nameServers := targetUrl.Query()["nameserver"]
+		for _, ns := range nameServers {
+			if err := validNameserver(ns); err != nil {
+				tes.add("nameserver", ns, "%v", err)
 			}
-			types = append(types, typ)
 		}
 		for _, typ := range types {
 			sysresolver := des.SysResolverSubject{
 				Log:         log,
-				NameServers: targetUrl.Query()["nameserver"],
+				Search:      search,
+				NameServers: nameServers,
 				Question: dns.Question{
 					Name:   hostname,
 					Qclass: dns.ClassINET,
 					Qtype:  typ,
 				},
 			}
-			subjects = append(subjects, &sysresolver)
+			sources = append(sources, &des.DnsSource{Subject: &sysresolver})
 		}
 	}
-	return subjects, nil
+	return sources
 }
 
-func GetConfig(log *zerolog.Logger) (Config, []error) {
-	conf := Config{}
-	pflag.StringVar(&conf.ChainName, "chain-name", "STEINSTUECKEN", "iptables chain name")
-	pflag.BoolVar(&conf.NoFinalDrop, "no-final-drop", false, "do not drop packets that do not match any rule")
-	pflag.BoolVar(&conf.FirstRule, "first-rule", false, "insert rule as first rule in chain")
-	pflag.StringVar(&conf.AlternatePath, "alternate-path", "/alternate", "if iptable-path to alternate iptables")
-	pflag.BoolVar(&conf.AlternateForce, "alternate-force", false, "override alternate-path")
-	pflag.StringVar(&conf.SrcPath, "src-path", "/sbin", "if iptable-path to src iptables")
-	pflag.StringVar(&conf.IpTablesType, "iptable-type", "", "empty means use system -- iptables type (nft or legacy)")
-	pflag.BoolVar(&conf.DisableIPv4, "disable-ipv4", false, "do not generate ipv4 rules")
-	pflag.BoolVar(&conf.DisableIPv6, "disable-ipv6", false, "do not generate ipv6 rules")
-	pflag.StringArrayVar(&conf.targetsStr, "target", []string{}, "target to connect to")
-	pflag.Parse()
-	errs := []error{}
-	for _, targetStr := range conf.targetsStr {
-		targetUrl, err := url.Parse(targetStr)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("target %s is not a valid url: %v", targetStr, err))
-			continue
+// targetID is stable as long as the target url is unchanged
+func targetID(targetStr string) string {
+	sum := sha256.Sum256([]byte(targetStr))
+	return hex.EncodeToString(sum[:4])
+}
+
+// randomInstanceID differs per process, a restart is a new instance
+func randomInstanceID() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return "sken-" + hex.EncodeToString(buf)
+}
+
+// parseMaxWiden parses a prefix length like /24, 0 if key is not given
+func parseMaxWiden(query url.Values, key string, maxPrefix int, tes *targetErrors) int {
+	widenStr, found := query[key]
+	if !found {
+		return 0
+	}
+	bits, err := strconv.Atoi(strings.TrimPrefix(widenStr[0], "/"))
+	if err != nil || bits < 1 || bits > maxPrefix {
+		tes.add(key, widenStr[0], "not a prefix length like /24 between /1 and /%d", maxPrefix)
+		return 0
+	}
+	return bits
+}
+
+// parseTarget parses a target url, enabled are the address families which
+// are not disabled
+func parseTarget(targetStr string, log *zerolog.Logger, enabled []des.Family) (*Target, []error) {
+	tes := &targetErrors{target: targetStr}
+	targetUrl, err := url.Parse(targetStr)
+	if err != nil {
+		tes.add("", "", "not a valid url: %v", err)
+		return nil, tes.errs
+	}
+	// sken-file:///path and sken-https://host/path are watched address lists
+	scheme, sourceScheme, _ := strings.Cut(targetUrl.Scheme, "-")
+	if scheme != "sken" && scheme != "skendeny" {
+		tes.add("", "", "invalid scheme %q, use sken:// or skendeny://", targetUrl.Scheme)
+		return nil, tes.errs
+	}
+	targetUrl.Scheme = scheme
+	query := targetUrl.Query()
+	validateQueryKeys(query, tes)
+	action, rejectWith, priority := parseAction(targetUrl, tes)
+	families := validateFamilies(query, enabled, tes)
+	var sources []des.AddressSource
+	var wildcard *Wildcard
+	switch {
+	case sourceScheme == "feed":
+		sources = getFeedDestination(targetUrl, tes)
+	case sourceScheme != "":
+		sources = getUrlDestination(targetUrl, sourceScheme, tes)
+	case strings.Contains(targetUrl.Hostname(), "*"):
+		wildcard = getWildcard(targetUrl, families, tes)
+	default:
+		sources = getDestinations(targetUrl, log, families, tes)
+	}
+	if _, found := query["idle"]; found && wildcard == nil {
+		tes.add("idle", query.Get("idle"), "only valid for wildcard targets")
+	}
+	for _, key := range []string{"service", "region"} {
+		if _, found := query[key]; found && sourceScheme != "feed" {
+			tes.add(key, query.Get(key), "only valid for sken-feed:// targets")
 		}
-		if targetUrl.Scheme != "sken" {
-			errs = append(errs, fmt.Errorf("target %s has invalid scheme: %v", targetStr, err))
-			continue
+	}
+	from := getSources(targetUrl, log, families, tes)
+	ports := []Port{}
+	portsStrs, found := query["port"]
+	if !found {
+		ports = append(ports, Port{Port: []string{"443"}, Proto: "tcp"})
+	} else {
+		for _, portsStr := range portsStrs {
+			port, ok := parsePortSpec(portsStr, tes)
+			if ok {
+				ports = append(ports, port)
+			}
 		}
-		subjects, err := getSubjects(targetUrl, log)
-		if err != nil {
-			errs = append(errs, err)
+	}
+	iface := struct {
+		Input  *string
+		Output *string
+	}{}
+	for _, key := range []string{"inIface", "outIface"} {
+		ifaceStr, found := query[key]
+		if !found {
 			continue
 		}
-		ports := []Port{}
-		portsStrs, found := targetUrl.Query()["port"]
-		if !found {
-			ports = append(ports, Port{Port: []string{"443"}, Proto: "tcp"})
-		} else {
-			for _, portsStr := range portsStrs {
-				splittedPorts := strings.Split(portsStr, "/")
-				if len(splittedPorts) >= 1 {
-					// port, err := strconv.Atoi(splittedPorts[0])
-					// if err != nil {
-					// 	errs = append(errs, fmt.Errorf("target %s has invalid port: %v", targetStr, err))
-					// 	continue
-					// }
-					proto := "tcp"
-					if len(splittedPorts) >= 2 {
-						proto = splittedPorts[1]
-					}
-					ports = append(ports, Port{Port: rePorts.Split(splittedPorts[0], -1), Proto: proto})
-				} else {
-					errs = append(errs, fmt.Errorf("target %s has invalid port: %v", targetStr, err))
-					continue
-				}
-			}
+		if len(ifaceStr) > 1 {
+			tes.add(key, strings.Join(ifaceStr, ","), "only one interface is allowed")
 		}
-		iface := struct {
-			Input  *string
-			Output *string
-		}{}
-		inIfaceStr, found := targetUrl.Query()["inIface"]
-		if found {
-			iface.Input = &inIfaceStr[0]
+		if err := validIfaceName(ifaceStr[0]); err != nil {
+			tes.add(key, ifaceStr[0], "%v", err)
+			continue
 		}
-		outIfaceStr, found := targetUrl.Query()["outIface"]
-		if found {
-			iface.Output = &outIfaceStr[0]
+		if key == "inIface" {
+			iface.Input = &ifaceStr[0]
+		} else {
+			iface.Output = &ifaceStr[0]
 		}
+	}
 
-		_, nonStateful := targetUrl.Query()["nonStateful"]
+	_, nonStateful := query["nonStateful"]
+	_, aggregate := query["aggregate"]
+	maxWiden := parseMaxWiden(query, "maxWiden", 32, tes)
+	maxWiden6 := parseMaxWiden(query, "maxWiden6", 128, tes)
+	_, authoritative := query["authoritative"]
+	if _, found := query["nameserver"]; found && authoritative {
+		tes.add("authoritative", query.Get("authoritative"), "asks the authoritative nameservers, use --authoritative-hint instead of nameserver")
+	}
 
-		target := Target{
-			Ports:       ports,
-			Subjects:    subjects,
-			Interface:   iface,
-			NonStateful: nonStateful,
+	var logTarget *string
+	if logStr, found := query["log"]; found {
+		switch logStr[0] {
+		case "", "nflog", "log":
+			logTarget = &logStr[0]
+		default:
+			tes.add("log", logStr[0], "unknown log target, use nflog or log")
 		}
+	}
 
-		target.Forward = &targetUrl.Host
+	target := Target{
+		ID:            targetID(targetStr),
+		Action:        action,
+		RejectWith:    rejectWith,
+		Priority:      priority,
+		Ports:         ports,
+		Sources:       sources,
+		Wildcard:      wildcard,
+		From:          from,
+		Interface:     iface,
+		NonStateful:   nonStateful,
+		Aggregate:     aggregate || maxWiden > 0 || maxWiden6 > 0,
+		MaxWiden:      maxWiden,
+		MaxWiden6:     maxWiden6,
+		Families:      families,
+		Authoritative: authoritative,
+		Log:           logTarget,
+	}
 
-		snat4, snat4found := targetUrl.Query()["snat4"]
-		snat6, snat6found := targetUrl.Query()["snat6"]
-		_, masqfound := targetUrl.Query()["masq"]
+	target.Forward = &targetUrl.Host
 
-		if (snat4found || snat6found) && !masqfound {
-			if len(snat4) > 0 {
-				target.Snat4 = &snat4[0]
-			}
-			if len(snat6) > 0 {
-				target.Snat6 = &snat6[0]
+	snat4, snat4found := query["snat4"]
+	snat6, snat6found := query["snat6"]
+	_, masqfound := query["masq"]
+
+	if (snat4found || snat6found) && !masqfound {
+		if len(snat4) > 0 {
+			validateSnat("snat4", snat4[0], true, tes)
+			target.Snat4 = &snat4[0]
+		}
+		if len(snat6) > 0 {
+			validateSnat("snat6", snat6[0], false, tes)
+			target.Snat6 = &snat6[0]
+		}
+	} else if !(snat4found || snat6found) && masqfound {
+		target.Masq = &targetUrl.Host
+	} else if (snat4found || snat6found) && masqfound {
+		tes.add("masq", query.Get("masq"), "only one mode is allowed snat/masq")
+	}
+	if action != ActionAccept && (snat4found || snat6found || masqfound) {
+		tes.add("action", action, "snat/masq is only possible for accept targets")
+	}
+	if rejectWith != nil && *rejectWith == "tcp-reset" {
+		for _, port := range ports {
+			if port.Proto != "tcp" {
+				tes.add("reject", *rejectWith, "tcp-reset needs only tcp ports but found %s", port.Proto)
 			}
-		} else if !(snat4found || snat6found) && masqfound {
-			target.Masq = &targetUrl.Host
-		} else if (snat4found || snat6found) && masqfound {
-			errs = append(errs, fmt.Errorf("target %s only one mode is allowed snat/masq", targetStr))
-			continue
 		}
+	}
+	if len(tes.errs) > 0 {
+		return nil, tes.errs
+	}
+	return &target, nil
+}
 
-		conf.Targets = append(conf.Targets, target)
+// HasWildcards is true if names have to be observed for wildcard targets
+func (c *Config) HasWildcards() bool {
+	for i := range c.Targets {
+		if c.Targets[i].Wildcard != nil {
+			return true
+		}
+	}
+	return false
+}
 
+func GetConfig(log *zerolog.Logger) (Config, []error) {
+	conf := Config{}
+	pflag.StringVar(&conf.ChainName, "chain-name", "STEINSTUECKEN", "iptables chain name")
+	pflag.BoolVar(&conf.NoFinalDrop, "no-final-drop", false, "do not drop packets that do not match any rule")
+	pflag.BoolVar(&conf.FirstRule, "first-rule", false, "insert rule as first rule in chain")
+	pflag.StringVar(&conf.AlternatePath, "alternate-path", "/alternate", "if iptable-path to alternate iptables")
+	pflag.BoolVar(&conf.AlternateForce, "alternate-force", false, "override alternate-path")
+	pflag.StringVar(&conf.SrcPath, "src-path", "/sbin", "if iptable-path to src iptables")
+	pflag.StringVar(&conf.IpTablesType, "iptable-type", "", "empty means use system -- iptables type (nft or legacy)")
+	pflag.BoolVar(&conf.DisableIPv4, "disable-ipv4", false, "do not resolve ipv4 or generate ipv4 rules")
+	pflag.BoolVar(&conf.DisableIPv6, "disable-ipv6", false, "do not resolve ipv6 or generate ipv6 rules")
+	pflag.StringArrayVar(&conf.targetsStr, "target", []string{}, "target to connect to")
+	pflag.BoolVar(&conf.Log.Drops, "log-drops", false, "log packets before the final drop")
+	pflag.StringVar(&conf.Log.Target, "log-target", "nflog", "log with nflog or log")
+	pflag.IntVar(&conf.Log.NflogGroup, "nflog-group", 100, "nflog group of log rules")
+	pflag.StringVar(&conf.Log.Rate, "log-rate", "10/minute", "rate limit of log rules")
+	pflag.IntVar(&conf.Log.Burst, "log-burst", 5, "burst limit of log rules")
+	pflag.BoolVar(&conf.ReportDrops, "report-drops", false, "report dropped destinations with the dns names they were resolved from")
+	pflag.DurationVar(&conf.ReportInterval, "report-interval", time.Minute, "interval to log the dropped destinations, 0 disables")
+	pflag.StringVar(&conf.AdminListen, "admin-listen", "", "address of the admin http server like 127.0.0.1:8080")
+	pflag.BoolVar(&conf.Learn, "learn", false, "log and accept new connections instead of the final drop to propose targets")
+	pflag.DurationVar(&conf.LearnWindow, "learn-window", time.Hour, "interval to write the proposed targets of --learn")
+	pflag.StringVar(&conf.LearnOutput, "learn-output", "steinstuecken-learned.targets", "file of the proposed targets, - for stdout")
+	pflag.StringVar(&conf.DnsForward.Listen, "dns-forward-listen", "", "address of the dns forwarder which authorizes the answers of targets before the reply like :53")
+	pflag.StringArrayVar(&conf.DnsForward.Upstreams, "dns-forward-upstream", []string{}, "upstream nameserver of the dns forwarder")
+	pflag.DurationVar(&conf.DnsForward.MinTTL, "dns-forward-min-ttl", 30*time.Second, "minimum time the forwarded addresses are allowed")
+	pflag.StringVar(&conf.DnsForward.Filter, "dns-filter", "", "answer names which are not covered by a target with refused or nxdomain")
+	pflag.StringArrayVar(&conf.DnsForward.Allow, "dns-filter-allow", []string{}, "name or wildcard like *.example.com which passes the dns filter")
+	pflag.StringVar(&conf.DnsSnoop.Mode, "dns-snoop", "", "authorize the dns answers to the clients seen with nflog, nfqueue or afpacket")
+	pflag.IntVar(&conf.DnsSnoop.Queue, "dns-snoop-queue", 53, "NFQUEUE number of --dns-snoop=nfqueue")
+	pflag.StringVar(&conf.DnsSnoop.Iface, "dns-snoop-iface", "", "interface to the clients of --dns-snoop=afpacket")
+	pflag.DurationVar(&conf.DnsSnoop.MinTTL, "dns-snoop-min-ttl", 30*time.Second, "minimum time the snooped addresses are allowed")
+	pflag.StringArrayVar(&conf.AuthorityHints, "authoritative-hint", []string{}, "nameserver ip[:port] to find the nameservers of authoritative targets instead of the root servers")
+	pflag.StringVar(&conf.InstanceID, "instance-id", "", "owner of the chains in the rule comments, default random per process, --adopt needs a fixed one")
+	pflag.BoolVar(&conf.Adopt, "adopt", false, "keep the rules of the previous generation of this instance instead of flushing the chains")
+	pflag.DurationVar(&conf.AdoptGrace, "adopt-grace", time.Minute, "time after the adopted rules of the previous generation are removed")
+	pflag.DurationVar(&conf.WildcardIdle, "wildcard-idle", 10*time.Minute, "time after the rules of an observed name of a wildcard target are removed")
+	pflag.Parse()
+	conf.Command = pflag.Arg(0)
+
+	if conf.ReportDrops {
+		// the reporter reads the drops from nflog
+		conf.Log.Drops = true
+	}
+	errs := validateLogOptions(&conf.Log)
+	errs = append(errs, validateInstance(&conf)...)
+	if conf.InstanceID == "" {
+		conf.InstanceID = randomInstanceID()
+	}
+	errs = append(errs, validateDnsForward(&conf.DnsForward)...)
+	errs = append(errs, validateDnsSnoop(&conf.DnsSnoop)...)
+	if conf.WildcardIdle <= 0 {
+		errs = append(errs, fmt.Errorf("--wildcard-idle %s: must be positive", conf.WildcardIdle))
+	}
+	for _, hint := range conf.AuthorityHints {
+		if err := validNameserver(hint); err != nil {
+			errs = append(errs, fmt.Errorf("--authoritative-hint %s: %v", hint, err))
+		}
+	}
+	// one authority for all targets shares the cached nameservers of the zones
+	authority := &local.Authority{Hints: conf.AuthorityHints}
+	if conf.Learn && conf.LearnWindow <= 0 {
+		errs = append(errs, fmt.Errorf("--learn-window %s: must be positive", conf.LearnWindow))
+	}
+	enabled := []des.Family{}
+	if !conf.DisableIPv4 {
+		enabled = append(enabled, des.IPv4)
+	}
+	if !conf.DisableIPv6 {
+		enabled = append(enabled, des.IPv6)
+	}
+	for _, targetStr := range conf.targetsStr {
+		target, terrs := parseTarget(targetStr, log, enabled)
+		if len(terrs) > 0 {
+			errs = append(errs, terrs...)
+			continue
+		}
+		if target.Wildcard != nil && target.Wildcard.Idle == 0 {
+			target.Wildcard.Idle = conf.WildcardIdle
+		}
+		if target.Authoritative {
+			target.setAuthority(authority)
+		}
+		conf.Targets = append(conf.Targets, *target)
 	}
 	return conf, errs
 }
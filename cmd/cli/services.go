@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"bufio"
+	_ "embed"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//go:embed services
+var servicesFile string
+
+var services struct {
+	once   sync.Once
+	byName map[string]int // name/proto -> port
+}
+
+func parseServices(content string) map[string]int {
+	byName := map[string]int{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) < 2 {
+			continue
+		}
+		portProto := strings.Split(tokens[1], "/")
+		if len(portProto) != 2 {
+			continue
+		}
+		port, err := strconv.Atoi(portProto[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range append([]string{tokens[0]}, tokens[2:]...) {
+			byName[name+"/"+portProto[1]] = port
+		}
+	}
+	return byName
+}
+
+// lookupService resolves a service name like https for proto,
+// udplite uses the udp and sctp/dccp the tcp entries as fallback
+func lookupService(name, proto string) (int, bool) {
+	services.once.Do(func() {
+		services.byName = parseServices(servicesFile)
+	})
+	port, found := services.byName[strings.ToLower(name)+"/"+proto]
+	if found {
+		return port, true
+	}
+	switch proto {
+	case "udplite":
+		port, found = services.byName[strings.ToLower(name)+"/udp"]
+	case "sctp", "dccp":
+		port, found = services.byName[strings.ToLower(name)+"/tcp"]
+	}
+	return port, found
+}
@@ -0,0 +1,660 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	des "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/mabels/steinstuecken/dns_forwarder"
+	"github.com/miekg/dns"
+)
+
+type TargetError struct {
+	Target string
+	Key    string
+	Value  string
+	Msg    string
+}
+
+func (te *TargetError) Error() string {
+	if te.Key == "" {
+		return fmt.Sprintf("target %s: %s", te.Target, te.Msg)
+	}
+	return fmt.Sprintf("target %s: %s=%s: %s", te.Target, te.Key, te.Value, te.Msg)
+}
+
+type targetErrors struct {
+	target string
+	errs   []error
+}
+
+func (tes *targetErrors) add(key, value, format string, args ...interface{}) {
+	tes.errs = append(tes.errs, &TargetError{
+		Target: tes.target,
+		Key:    key,
+		Value:  value,
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+var knownQueryKeys = map[string]string{
+	"type":          "dns record type A or AAAA",
+	"nameserver":    "nameserver ip[:port]",
+	"port":          "port spec like 22,80,443/tcp",
+	"inIface":       "input interface",
+	"outIface":      "output interface",
+	"nonStateful":   "ignore conntrack",
+	"snat4":         "ipv4 SNAT source",
+	"snat6":         "ipv6 SNAT source",
+	"masq":          "masquerade",
+	"from":          "source cidrs, dns names or address list urls",
+	"action":        "accept, drop or reject",
+	"reject":        "reject-with type like icmp-port-unreachable or tcp-reset",
+	"priority":      "evaluation order lower first",
+	"log":           "log matching packets with nflog or log",
+	"idle":          "idle time of the observed names of wildcard targets",
+	"authoritative": "resolve with the authoritative nameservers of the name",
+	"service":       "service of a feed like S3 or actions",
+	"region":        "region of a feed like eu-central-1",
+	"aggregate":     "install the covering prefixes of the addresses",
+	"maxWiden":      "ipv4 prefix length like /24 neighbouring addresses may be widened to",
+	"maxWiden6":     "ipv6 prefix length like /56 neighbouring addresses may be widened to",
+	"family":        "address families 4 or 6 of the target",
+}
+
+func sortedKnownQueryKeys() []string {
+	keys := make([]string, 0, len(knownQueryKeys))
+	for key := range knownQueryKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var portProtos = map[string]bool{
+	"tcp":     true,
+	"udp":     true,
+	"udplite": true,
+	"sctp":    true,
+	"dccp":    true,
+}
+
+var icmpProtos = map[string]bool{
+	"icmp":   true,
+	"icmpv6": true,
+}
+
+var icmpTypes = map[string]bool{
+	"any":                        true,
+	"echo-reply":                 true,
+	"pong":                       true,
+	"destination-unreachable":    true,
+	"network-unreachable":        true,
+	"host-unreachable":           true,
+	"protocol-unreachable":       true,
+	"port-unreachable":           true,
+	"fragmentation-needed":       true,
+	"source-route-failed":        true,
+	"network-unknown":            true,
+	"host-unknown":               true,
+	"network-prohibited":         true,
+	"host-prohibited":            true,
+	"TOS-network-unreachable":    true,
+	"TOS-host-unreachable":       true,
+	"communication-prohibited":   true,
+	"host-precedence-violation":  true,
+	"precedence-cutoff":          true,
+	"source-quench":              true,
+	"redirect":                   true,
+	"network-redirect":           true,
+	"host-redirect":              true,
+	"TOS-network-redirect":       true,
+	"TOS-host-redirect":          true,
+	"echo-request":               true,
+	"ping":                       true,
+	"router-advertisement":       true,
+	"router-solicitation":        true,
+	"time-exceeded":              true,
+	"ttl-exceeded":               true,
+	"ttl-zero-during-transit":    true,
+	"ttl-zero-during-reassembly": true,
+	"parameter-problem":          true,
+	"ip-header-bad":              true,
+	"required-option-missing":    true,
+	"timestamp-request":          true,
+	"timestamp-reply":            true,
+	"address-mask-request":       true,
+	"address-mask-reply":         true,
+}
+
+var icmpv6Types = map[string]bool{
+	"destination-unreachable":    true,
+	"no-route":                   true,
+	"communication-prohibited":   true,
+	"beyond-scope":               true,
+	"address-unreachable":        true,
+	"port-unreachable":           true,
+	"failed-policy":              true,
+	"reject-route":               true,
+	"packet-too-big":             true,
+	"time-exceeded":              true,
+	"ttl-exceeded":               true,
+	"ttl-zero-during-transit":    true,
+	"ttl-zero-during-reassembly": true,
+	"parameter-problem":          true,
+	"bad-header":                 true,
+	"unknown-header-type":        true,
+	"unknown-option":             true,
+	"echo-request":               true,
+	"ping":                       true,
+	"echo-reply":                 true,
+	"pong":                       true,
+	"router-solicitation":        true,
+	"router-advertisement":       true,
+	"neighbour-solicitation":     true,
+	"neighbor-solicitation":      true,
+	"neighbour-advertisement":    true,
+	"neighbor-advertisement":     true,
+	"redirect":                   true,
+}
+
+var reIcmpNumeric = regexp.MustCompile(`^(\d+)(/(\d+))?$`)
+
+func validIcmpType(proto, typ string) bool {
+	match := reIcmpNumeric.FindStringSubmatch(typ)
+	if match != nil {
+		t, err := strconv.Atoi(match[1])
+		if err != nil || t < 0 || t > 255 {
+			return false
+		}
+		if match[3] != "" {
+			c, err := strconv.Atoi(match[3])
+			if err != nil || c < 0 || c > 255 {
+				return false
+			}
+		}
+		return true
+	}
+	if proto == "icmpv6" {
+		return icmpv6Types[typ]
+	}
+	return icmpTypes[typ]
+}
+
+func parsePortNumber(str, proto string) (int, error) {
+	port, err := strconv.Atoi(str)
+	if err != nil {
+		var found bool
+		port, found = lookupService(str, proto)
+		if !found {
+			return 0, fmt.Errorf("%q is neither a port number nor a known %s service", str, proto)
+		}
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range 1-65535", port)
+	}
+	return port, nil
+}
+
+func parsePortRange(from, to, str, proto string) (string, error) {
+	fromPort, err := parsePortNumber(from, proto)
+	if err != nil {
+		return "", err
+	}
+	toPort, err := parsePortNumber(to, proto)
+	if err != nil {
+		return "", err
+	}
+	if fromPort > toPort {
+		return "", fmt.Errorf("port range %s is reversed, use %s-%s", str, to, from)
+	}
+	if fromPort == toPort {
+		return strconv.Itoa(fromPort), nil
+	}
+	return fmt.Sprintf("%d:%d", fromPort, toPort), nil
+}
+
+// parsePort returns the port or port range in iptables notation (from:to),
+// service names could contain - so ranges of names should be written with :
+func parsePort(str, proto string) (string, error) {
+	port, err := parsePortNumber(str, proto)
+	if err == nil {
+		return strconv.Itoa(port), nil
+	}
+	if idx := strings.Index(str, ":"); idx >= 0 {
+		return parsePortRange(str[:idx], str[idx+1:], str, proto)
+	}
+	dashes := []int{}
+	for idx, c := range str {
+		if c == '-' {
+			dashes = append(dashes, idx)
+		}
+	}
+	for _, idx := range dashes {
+		if _, ferr := parsePortNumber(str[:idx], proto); ferr != nil {
+			continue
+		}
+		if _, terr := parsePortNumber(str[idx+1:], proto); terr != nil {
+			continue
+		}
+		return parsePortRange(str[:idx], str[idx+1:], str, proto)
+	}
+	if len(dashes) == 1 {
+		_, ferr := strconv.Atoi(str[:dashes[0]])
+		_, terr := strconv.Atoi(str[dashes[0]+1:])
+		if ferr == nil || terr == nil {
+			return parsePortRange(str[:dashes[0]], str[dashes[0]+1:], str, proto)
+		}
+	}
+	return "", err
+}
+
+// parsePortSpec parses (\d+[,|]*)+[/{tcp,udp,icmp,...}]
+func parsePortSpec(portsStr string, tes *targetErrors) (Port, bool) {
+	// the last / separates the protocol, icmp types could contain type/code
+	portsPart := portsStr
+	proto := "tcp"
+	if idx := strings.LastIndex(portsStr, "/"); idx >= 0 {
+		portsPart = portsStr[:idx]
+		proto = strings.ToLower(portsStr[idx+1:])
+	}
+	if proto == "ipv6-icmp" {
+		proto = "icmpv6"
+	}
+	if !(portProtos[proto] || icmpProtos[proto] || proto == "all") {
+		tes.add("port", portsStr, "unknown protocol %q, use one of all,dccp,icmp,icmpv6,sctp,tcp,udp,udplite", proto)
+		return Port{}, false
+	}
+	ok := true
+	port := Port{Proto: proto, Port: []string{}}
+	for _, item := range rePorts.Split(portsPart, -1) {
+		if item == "" {
+			continue
+		}
+		switch {
+		case proto == "all":
+			tes.add("port", portsStr, "protocol all does not take ports, use port=/all")
+			ok = false
+		case icmpProtos[proto]:
+			if !validIcmpType(proto, item) {
+				tes.add("port", portsStr, "unknown %s type %q", proto, item)
+				ok = false
+				continue
+			}
+			port.Port = append(port.Port, item)
+		default:
+			normalized, err := parsePort(item, proto)
+			if err != nil {
+				tes.add("port", portsStr, "%v", err)
+				ok = false
+				continue
+			}
+			port.Port = append(port.Port, normalized)
+		}
+	}
+	return port, ok
+}
+
+var reIfaceName = regexp.MustCompile(`^[^/\s:]+$`)
+
+// validIfaceName follows the linux rules for interface names,
+// the iptables wildcard suffix + is allowed
+func validIfaceName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("interface name is empty")
+	}
+	if len(name) > 15 {
+		return fmt.Errorf("interface name longer than 15 characters")
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("interface name %q is reserved", name)
+	}
+	if !reIfaceName.MatchString(name) {
+		return fmt.Errorf("interface name must not contain '/', ':' or whitespace")
+	}
+	if idx := strings.Index(name, "+"); idx >= 0 && idx != len(name)-1 {
+		return fmt.Errorf("wildcard + is only allowed at the end of an interface name")
+	}
+	return nil
+}
+
+func validNameserver(ns string) error {
+	host, port, err := net.SplitHostPort(ns)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(ns, "["), "]")
+		port = ""
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not an ip address", host)
+	}
+	if port != "" {
+		_, err := parsePortNumber(port, "udp")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateQueryKeys(query url.Values, tes *targetErrors) {
+	unknown := []string{}
+	for key := range query {
+		if _, found := knownQueryKeys[key]; !found {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		tes.add(key, query.Get(key), "unknown option, known options are %s", strings.Join(sortedKnownQueryKeys(), ","))
+	}
+}
+
+func validateTypes(strTypes []string, tes *targetErrors) []uint16 {
+	types := []uint16{}
+	for _, strType := range strTypes {
+		typ, found := dns.StringToType[strings.ToUpper(strType)]
+		if !found || !(typ == dns.TypeA || typ == dns.TypeAAAA) {
+			tes.add("type", strType, "unsupported record type, use A or AAAA")
+			continue
+		}
+		types = append(types, typ)
+	}
+	return types
+}
+
+// typeFamily is the address family of the answers of an A or AAAA question
+func typeFamily(typ uint16) des.Family {
+	if typ == dns.TypeAAAA {
+		return des.IPv6
+	}
+	return des.IPv4
+}
+
+func hasFamily(families []des.Family, family des.Family) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFamilies parses family=4,6 (or ipv4, ipv6), default are the
+// enabled families
+func validateFamilies(query url.Values, enabled []des.Family, tes *targetErrors) []des.Family {
+	strFamilies, found := query["family"]
+	if !found {
+		if len(enabled) == 0 {
+			tes.add("", "", "ipv4 and ipv6 are disabled")
+		}
+		return enabled
+	}
+	families := []des.Family{}
+	for _, familiesStr := range strFamilies {
+		for _, strFamily := range rePorts.Split(familiesStr, -1) {
+			var family des.Family
+			switch strings.ToLower(strFamily) {
+			case "4", "ipv4", "inet":
+				family = des.IPv4
+			case "6", "ipv6", "inet6":
+				family = des.IPv6
+			default:
+				tes.add("family", strFamily, "unknown address family, use 4 or 6")
+				continue
+			}
+			if !hasFamily(enabled, family) {
+				tes.add("family", strFamily, "ipv%d is disabled", family)
+				continue
+			}
+			if !hasFamily(families, family) {
+				families = append(families, family)
+			}
+		}
+	}
+	return families
+}
+
+// validateTypeFamilies checks that the types are of the families of the
+// target, without types these are A and AAAA of its families
+func validateTypeFamilies(strTypes []string, found bool, families []des.Family, tes *targetErrors) []uint16 {
+	if !found {
+		types := []uint16{}
+		for _, family := range families {
+			if family == des.IPv4 {
+				types = append(types, dns.TypeA)
+			} else {
+				types = append(types, dns.TypeAAAA)
+			}
+		}
+		return types
+	}
+	types := []uint16{}
+	for _, typ := range validateTypes(strTypes, tes) {
+		if !hasFamily(families, typeFamily(typ)) {
+			tes.add("type", dns.TypeToString[typ], "ipv%d is not a family of the target", typeFamily(typ))
+			continue
+		}
+		types = append(types, typ)
+	}
+	return types
+}
+
+// validatePrefixFamily checks that an address target or source is of the
+// families of the target
+func validatePrefixFamily(key string, prefix netip.Prefix, families []des.Family, tes *targetErrors) bool {
+	family := des.IPv4
+	if !prefix.Addr().Is4() {
+		family = des.IPv6
+	}
+	if !hasFamily(families, family) {
+		tes.add(key, prefix.String(), "ipv%d is not a family of the target", family)
+		return false
+	}
+	return true
+}
+
+func validateSnat(key, snat string, v4 bool, tes *targetErrors) {
+	ip := net.ParseIP(snat)
+	if ip == nil {
+		tes.add(key, snat, "not an ip address")
+		return
+	}
+	if v4 && ip.To4() == nil {
+		tes.add(key, snat, "snat4 needs an ipv4 address, use snat6 for ipv6")
+	}
+	if !v4 && ip.To4() != nil {
+		tes.add(key, snat, "snat6 needs an ipv6 address, use snat4 for ipv4")
+	}
+}
+
+// rejectTypes are the ipv4 --reject-with types, ipv6 rules use the
+// icmp6 equivalent, the icmp6 names are accepted as well
+var rejectTypes = map[string]string{
+	"icmp-net-unreachable":   "icmp6-no-route",
+	"icmp-host-unreachable":  "icmp6-addr-unreachable",
+	"icmp-port-unreachable":  "icmp6-port-unreachable",
+	"icmp-proto-unreachable": "icmp6-port-unreachable",
+	"icmp-net-prohibited":    "icmp6-adm-prohibited",
+	"icmp-host-prohibited":   "icmp6-adm-prohibited",
+	"icmp-admin-prohibited":  "icmp6-adm-prohibited",
+	"tcp-reset":              "tcp-reset",
+}
+
+var reject6Types = map[string]string{
+	"icmp6-no-route":         "icmp-net-unreachable",
+	"no-route":               "icmp-net-unreachable",
+	"icmp6-adm-prohibited":   "icmp-admin-prohibited",
+	"adm-prohibited":         "icmp-admin-prohibited",
+	"icmp6-addr-unreachable": "icmp-host-unreachable",
+	"addr-unreach":           "icmp-host-unreachable",
+	"icmp6-port-unreachable": "icmp-port-unreachable",
+	"port-unreach":           "icmp-port-unreachable",
+}
+
+// RejectWith returns the --reject-with type of the address family
+func RejectWith(rejectWith string, ipv6 bool) string {
+	if v6, found := rejectTypes[rejectWith]; found {
+		if ipv6 {
+			return v6
+		}
+		return rejectWith
+	}
+	if v4, found := reject6Types[rejectWith]; found {
+		if ipv6 {
+			return rejectWith
+		}
+		return v4
+	}
+	return rejectWith
+}
+
+func parseAction(targetUrl *url.URL, tes *targetErrors) (string, *string, int) {
+	query := targetUrl.Query()
+	action := ActionAccept
+	if targetUrl.Scheme == "skendeny" {
+		action = ActionDrop
+	}
+	var rejectWith *string
+	if rejectStr, found := query["reject"]; found {
+		_, v4 := rejectTypes[rejectStr[0]]
+		_, v6 := reject6Types[rejectStr[0]]
+		if !(v4 || v6) {
+			tes.add("reject", rejectStr[0], "unknown reject type, use tcp-reset or one of icmp-{net,host,port,proto}-unreachable,icmp-{net,host,admin}-prohibited")
+		} else {
+			rejectWith = &rejectStr[0]
+		}
+		action = ActionReject
+	}
+	if actionStr, found := query["action"]; found {
+		switch actionStr[0] {
+		case ActionAccept, ActionDrop, ActionReject:
+			if rejectWith != nil && actionStr[0] != ActionReject {
+				tes.add("action", actionStr[0], "reject= is only possible with action=reject")
+			}
+			action = actionStr[0]
+		default:
+			tes.add("action", actionStr[0], "unknown action, use accept, drop or reject")
+		}
+	}
+	if targetUrl.Scheme == "skendeny" && action == ActionAccept {
+		tes.add("action", action, "skendeny:// could not accept, use sken://")
+	}
+	priority := DefaultAcceptPriority
+	if action != ActionAccept {
+		priority = DefaultDenyPriority
+	}
+	if priorityStr, found := query["priority"]; found {
+		my, err := strconv.Atoi(priorityStr[0])
+		if err != nil || my < 0 || my > 9999 {
+			tes.add("priority", priorityStr[0], "priority must be a number between 0 and 9999")
+		} else {
+			priority = my
+		}
+	}
+	return action, rejectWith, priority
+}
+
+var reLogRate = regexp.MustCompile(`^\d+/(s|sec|second|m|min|minute|h|hour|d|day)$`)
+
+func validateLogOptions(log *LogOptions) []error {
+	errs := []error{}
+	if log.Target != "nflog" && log.Target != "log" {
+		errs = append(errs, fmt.Errorf("--log-target %s: use nflog or log", log.Target))
+	}
+	if log.NflogGroup < 0 || log.NflogGroup > 65535 {
+		errs = append(errs, fmt.Errorf("--nflog-group %d: out of range 0-65535", log.NflogGroup))
+	}
+	if !reLogRate.MatchString(log.Rate) {
+		errs = append(errs, fmt.Errorf("--log-rate %s: use a rate like 10/minute", log.Rate))
+	}
+	if log.Burst < 1 {
+		errs = append(errs, fmt.Errorf("--log-burst %d: must be at least 1", log.Burst))
+	}
+	return errs
+}
+
+// validateDnsForward checks the upstreams and adds the default port 53
+func validateDnsForward(opts *DnsForwardOptions) []error {
+	errs := []error{}
+	if opts.Listen == "" {
+		if opts.Filter != "" {
+			errs = append(errs, fmt.Errorf("--dns-filter %s: needs --dns-forward-listen", opts.Filter))
+		}
+		return errs
+	}
+	if len(opts.Upstreams) == 0 {
+		errs = append(errs, fmt.Errorf("--dns-forward-listen %s: needs at least one --dns-forward-upstream", opts.Listen))
+	}
+	for i, upstream := range opts.Upstreams {
+		if err := validNameserver(upstream); err != nil {
+			errs = append(errs, fmt.Errorf("--dns-forward-upstream %s: %v", upstream, err))
+			continue
+		}
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			host := strings.TrimSuffix(strings.TrimPrefix(upstream, "["), "]")
+			opts.Upstreams[i] = net.JoinHostPort(host, "53")
+		}
+	}
+	if opts.MinTTL < 0 {
+		errs = append(errs, fmt.Errorf("--dns-forward-min-ttl %s: must not be negative", opts.MinTTL))
+	}
+	switch opts.Filter {
+	case "", "refused", "nxdomain":
+	default:
+		errs = append(errs, fmt.Errorf("--dns-filter %s: use refused or nxdomain", opts.Filter))
+	}
+	for _, pattern := range opts.Allow {
+		if err := dns_forwarder.ValidPattern(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("--dns-filter-allow %v", err))
+		}
+	}
+	return errs
+}
+
+var reInstanceID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// validateInstance checks the owner of the chains, it is a field of the
+// rule comments
+func validateInstance(conf *Config) []error {
+	errs := []error{}
+	if conf.InstanceID == "" {
+		// the random default differs after a restart
+		if conf.Adopt {
+			errs = append(errs, fmt.Errorf("--adopt: needs --instance-id"))
+		}
+	} else if !reInstanceID.MatchString(conf.InstanceID) {
+		errs = append(errs, fmt.Errorf("--instance-id %q: needs 1 to 64 letters, digits, '.', '_' or '-'", conf.InstanceID))
+	}
+	if conf.Adopt && conf.AdoptGrace <= 0 {
+		errs = append(errs, fmt.Errorf("--adopt-grace %s: must be positive", conf.AdoptGrace))
+	}
+	return errs
+}
+
+// validateDnsSnoop checks the options of the snooping mode
+func validateDnsSnoop(opts *DnsSnoopOptions) []error {
+	errs := []error{}
+	switch opts.Mode {
+	case "", "nflog":
+	case "nfqueue":
+		if opts.Queue < 0 || opts.Queue > 65535 {
+			errs = append(errs, fmt.Errorf("--dns-snoop-queue %d: must be between 0 and 65535", opts.Queue))
+		}
+	case "afpacket":
+		if opts.Iface == "" {
+			errs = append(errs, fmt.Errorf("--dns-snoop afpacket: needs --dns-snoop-iface"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("--dns-snoop %s: use nflog, nfqueue or afpacket", opts.Mode))
+	}
+	if opts.MinTTL < 0 {
+		errs = append(errs, fmt.Errorf("--dns-snoop-min-ttl %s: must not be negative", opts.MinTTL))
+	}
+	return errs
+}
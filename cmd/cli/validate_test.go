@@ -0,0 +1,565 @@
+package cli
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dnsEvents "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/mabels/steinstuecken/resolvers/local"
+)
+
+var bothFamilies = []dnsEvents.Family{dnsEvents.IPv4, dnsEvents.IPv6}
+
+func TestParseTargetValid(t *testing.T) {
+	for _, targetStr := range []string{
+		"sken://www.google.de./?nameserver=192.168.128.2&port=443,80&snat4=192.168.44.3&type=A&type=AAAA",
+		"sken://vercel.com.:443/?nonStateful&inIface=eno1&outIface=eno1&nameserver=8.8.8.8&nameserver=8.8.4.4:5353",
+		"sken://dl-cdn.alpinelinux.org./",
+		"sken://192.168.128.0/24?port=53/udp&port=255/icmp&port=22,443,80/tcp&nonStateful",
+		"sken://[fe80::1]/64?port=53/udp&port=22,443,80/tcp&port=echo-request/icmpv6&nonStateful",
+		"sken://10.0.0.1?port=/all&inIface=veth%2B&masq",
+	} {
+		target, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 0 {
+			t.Errorf("%s: %v", targetStr, errs)
+		}
+		if target == nil {
+			t.Errorf("%s: target is nil", targetStr)
+		}
+	}
+}
+
+func TestParseTargetPorts(t *testing.T) {
+	target, errs := parseTarget("sken://www.google.de/?port=80,30000-30100|443:443/udp&port=ping,3/4/icmp", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if !reflect.DeepEqual(target.Ports, []Port{
+		{Port: []string{"80", "30000:30100", "443"}, Proto: "udp"},
+		{Port: []string{"ping", "3/4"}, Proto: "icmp"},
+	}) {
+		t.Errorf("ports: %v", target.Ports)
+	}
+}
+
+func TestParseTargetServices(t *testing.T) {
+	target, errs := parseTarget("sken://www.google.de/?port=https,ssh,ftp-data,http-alt:https-alt&port=domain,ntp/udp&port=domain/udplite", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if !reflect.DeepEqual(target.Ports, []Port{
+		{Port: []string{"443", "22", "20", "8080:8443"}, Proto: "tcp"},
+		{Port: []string{"53", "123"}, Proto: "udp"},
+		{Port: []string{"53"}, Proto: "udplite"},
+	}) {
+		t.Errorf("ports: %v", target.Ports)
+	}
+	_, errs = parseTarget("sken://www.google.de/?port=ssh-https", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Errorf("ssh-https is a range: %v", errs)
+	}
+	_, errs = parseTarget("sken://www.google.de/?port=http-alt/udplite", nil, bothFamilies)
+	if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), "\"http-alt\" is neither a port number nor a known udplite service") {
+		t.Errorf("http-alt is tcp only: %v", errs)
+	}
+	_, errs = parseTarget("sken://www.google.de/?port=ssh-70000", nil, bothFamilies)
+	if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), "port 70000 out of range 1-65535") {
+		t.Errorf("range end out of range: %v", errs)
+	}
+	_, errs = parseTarget("sken://www.google.de/?port=bootps/tcp", nil, bothFamilies)
+	if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), "\"bootps\" is neither a port number nor a known tcp service") {
+		t.Errorf("bootps is udp only: %v", errs)
+	}
+}
+
+func TestParseTargetFrom(t *testing.T) {
+	target, errs := parseTarget("sken://registry.npmjs.org/?from=10.1.0.0/16,build.example.com&from=10.2.0.1&from=fd00::/8", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	keys := []string{}
+	for _, source := range target.From {
+		keys = append(keys, source.Key())
+	}
+	if !reflect.DeepEqual(keys, []string{
+		"10.1.0.0/16",
+		"build.example.com:IN:A",
+		"build.example.com:IN:AAAA",
+		"10.2.0.1/32",
+		"fd00::/8",
+	}) {
+		t.Errorf("from: %v", keys)
+	}
+	_, errs = parseTarget("sken://registry.npmjs.org/?from=10.1.0.0/33", nil, bothFamilies)
+	if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), "from=10.1.0.0/33: is neither an address, a cidr nor a dns name") {
+		t.Errorf("invalid from: %v", errs)
+	}
+}
+
+func TestParseTargetUrlSources(t *testing.T) {
+	target, errs := parseTarget("sken-https://ip-ranges.example.com/ranges.json?port=443&from=file:///etc/clients", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if feed, ok := target.Sources[0].(*dnsEvents.HttpSource); !ok || feed.URL != "https://ip-ranges.example.com/ranges.json" {
+		t.Errorf("feed: %+v", target.Sources)
+	}
+	if file, ok := target.From[0].(*dnsEvents.FileSource); !ok || file.Path != "/etc/clients" {
+		t.Errorf("file: %+v", target.From)
+	}
+	target, errs = parseTarget("skendeny-file:///etc/blocked?from=http://10.0.0.1:8080/clients.json", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if target.Action != ActionDrop || target.Sources[0].Key() != "file:///etc/blocked" || target.From[0].Key() != "http://10.0.0.1:8080/clients.json" {
+		t.Errorf("deny file: %+v", target)
+	}
+	for _, targetStr := range []string{
+		"sken-ftp://example.com/list",
+		"sken-file://relative/list",
+		"sken-file:///etc/list?type=A",
+		"sken://www.example.com/?from=ftp://example.com/list",
+	} {
+		_, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 1 {
+			t.Errorf("%s: %v", targetStr, errs)
+		}
+	}
+}
+
+func TestParseTargetFeed(t *testing.T) {
+	target, errs := parseTarget("sken-feed://aws?service=S3&region=eu-central-1,eu-west-1", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	feed, ok := target.Sources[0].(*dnsEvents.FeedSource)
+	if !ok || feed.Provider != "aws" || !reflect.DeepEqual(feed.Filter, dnsEvents.FeedFilter{
+		Services: []string{"S3"},
+		Regions:  []string{"eu-central-1", "eu-west-1"},
+	}) {
+		t.Errorf("feed: %+v", target.Sources)
+	}
+	for targetStr, expected := range map[string]string{
+		"sken-feed://azure?service=x":            "unknown feed \"azure\", known feeds are aws,gcp,github",
+		"sken-feed://github?region=eu-central-1": "the github feed has no regions",
+		"sken://www.example.com/?service=S3":     "only valid for sken-feed:// targets",
+		"sken-feed://gcp/list":                   "feeds have no path /list",
+	} {
+		_, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), expected) {
+			t.Errorf("%s: %v", targetStr, errs)
+		}
+	}
+}
+
+func TestParseTargetAggregate(t *testing.T) {
+	for targetStr, expected := range map[string][3]int{
+		"sken://www.example.com/?aggregate":                 {1, 0, 0},
+		"sken://www.example.com/?maxWiden=/24":              {1, 24, 0},
+		"sken-feed://aws?maxWiden=24&maxWiden6=/56":         {1, 24, 56},
+		"sken://www.example.com/?nonStateful&maxWiden6=/48": {1, 0, 48},
+		"sken://www.example.com/":                           {0, 0, 0},
+	} {
+		target, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		aggregate := 0
+		if target.Aggregate {
+			aggregate = 1
+		}
+		if got := [3]int{aggregate, target.MaxWiden, target.MaxWiden6}; got != expected {
+			t.Errorf("%s: %v", targetStr, got)
+		}
+	}
+	for _, targetStr := range []string{
+		"sken://www.example.com/?maxWiden=/33",
+		"sken://www.example.com/?maxWiden6=/0",
+		"sken://www.example.com/?maxWiden=x",
+	} {
+		if _, errs := parseTarget(targetStr, nil, bothFamilies); len(errs) != 1 {
+			t.Errorf("%s: %v", targetStr, errs)
+		}
+	}
+}
+
+func TestParseTargetAction(t *testing.T) {
+	for targetStr, expected := range map[string]Target{
+		"sken://www.google.de":                             {Action: ActionAccept, Priority: DefaultAcceptPriority},
+		"sken://www.google.de?priority=10":                 {Action: ActionAccept, Priority: 10},
+		"skendeny://www.google.de":                         {Action: ActionDrop, Priority: DefaultDenyPriority},
+		"skendeny://10.0.0.5?action=reject":                {Action: ActionReject, Priority: DefaultDenyPriority},
+		"sken://www.google.de?action=drop&priority=2000":   {Action: ActionDrop, Priority: 2000},
+		"skendeny://www.google.de?reject=tcp-reset":        {Action: ActionReject, Priority: DefaultDenyPriority},
+		"sken://www.google.de?reject=icmp6-adm-prohibited": {Action: ActionReject, Priority: DefaultDenyPriority},
+	} {
+		target, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 0 {
+			t.Errorf("%s: %v", targetStr, errs)
+			continue
+		}
+		if target.Action != expected.Action || target.Priority != expected.Priority {
+			t.Errorf("%s: %s/%d", targetStr, target.Action, target.Priority)
+		}
+	}
+	for targetStr, msg := range map[string]string{
+		"skendeny://www.google.de?action=accept":                "action=accept: skendeny:// could not accept",
+		"sken://www.google.de?action=allow":                     "action=allow: unknown action",
+		"sken://www.google.de?reject=tcp-reset&action=drop":     "action=drop: reject= is only possible with action=reject",
+		"sken://www.google.de?reject=bla":                       "reject=bla: unknown reject type",
+		"skendeny://www.google.de?reject=tcp-reset&port=53/udp": "reject=tcp-reset: tcp-reset needs only tcp ports but found udp",
+		"skendeny://www.google.de?masq":                         "action=drop: snat/masq is only possible for accept targets",
+		"sken://www.google.de?priority=-1":                      "priority=-1: priority must be a number between 0 and 9999",
+	} {
+		_, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "target "+targetStr+": "+msg) {
+			t.Errorf("%s: %v", targetStr, errs)
+		}
+	}
+}
+
+func TestRejectWith(t *testing.T) {
+	for _, tc := range []struct {
+		rejectWith string
+		ipv6       bool
+		expected   string
+	}{
+		{"icmp-admin-prohibited", false, "icmp-admin-prohibited"},
+		{"icmp-admin-prohibited", true, "icmp6-adm-prohibited"},
+		{"icmp6-port-unreachable", false, "icmp-port-unreachable"},
+		{"icmp6-port-unreachable", true, "icmp6-port-unreachable"},
+		{"tcp-reset", true, "tcp-reset"},
+	} {
+		if RejectWith(tc.rejectWith, tc.ipv6) != tc.expected {
+			t.Errorf("%v: %s", tc, RejectWith(tc.rejectWith, tc.ipv6))
+		}
+	}
+}
+
+func TestParseTargetLog(t *testing.T) {
+	for targetStr, expected := range map[string]string{
+		"sken://www.google.de?log":         "",
+		"sken://www.google.de?log=nflog":   "nflog",
+		"skendeny://www.google.de?log=log": "log",
+	} {
+		target, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 0 {
+			t.Errorf("%s: %v", targetStr, errs)
+			continue
+		}
+		if target.Log == nil || *target.Log != expected {
+			t.Errorf("%s: %v", targetStr, target.Log)
+		}
+	}
+	target, _ := parseTarget("sken://www.google.de", nil, bothFamilies)
+	if target.Log != nil {
+		t.Errorf("log should be nil: %v", *target.Log)
+	}
+	_, errs := parseTarget("sken://www.google.de?log=syslog", nil, bothFamilies)
+	if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), "log=syslog: unknown log target, use nflog or log") {
+		t.Errorf("invalid log: %v", errs)
+	}
+}
+
+func TestValidateLogOptions(t *testing.T) {
+	errs := validateLogOptions(&LogOptions{Target: "nflog", NflogGroup: 100, Rate: "10/minute", Burst: 5})
+	if len(errs) != 0 {
+		t.Error(errs)
+	}
+	errs = validateLogOptions(&LogOptions{Target: "ulog", NflogGroup: 70000, Rate: "10", Burst: 0})
+	if len(errs) != 4 {
+		t.Error(errs)
+	}
+}
+
+func TestParseTargetOutIface(t *testing.T) {
+	target, errs := parseTarget("sken://www.google.de/?outIface=eth0", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if target.Interface.Input != nil {
+		t.Errorf("input: %v", *target.Interface.Input)
+	}
+	if target.Interface.Output == nil || *target.Interface.Output != "eth0" {
+		t.Errorf("output: %v", target.Interface.Output)
+	}
+}
+
+func TestParseTargetReportsAll(t *testing.T) {
+	targetStr := "sken://x.com/?port=70000,22-10/tcp&port=1/foo&port=bla/icmp&snat4=::1&inIface=a/b&outIface=abcdefghijklmnopq&foo=1&type=MX"
+	target, errs := parseTarget(targetStr, nil, bothFamilies)
+	if target != nil {
+		t.Errorf("target should be nil")
+	}
+	expected := []string{
+		"foo=1: unknown option",
+		"type=MX: unsupported record type",
+		"port=70000,22-10/tcp: port 70000 out of range 1-65535",
+		"port=70000,22-10/tcp: port range 22-10 is reversed, use 10-22",
+		"port=1/foo: unknown protocol \"foo\"",
+		"port=bla/icmp: unknown icmp type \"bla\"",
+		"inIface=a/b: interface name must not contain",
+		"outIface=abcdefghijklmnopq: interface name longer than 15 characters",
+		"snat4=::1: snat4 needs an ipv4 address",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors: %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), "target "+targetStr+": "+expected[i]) {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+}
+
+func TestParseTargetInvalid(t *testing.T) {
+	for targetStr, msg := range map[string]string{
+		"http://www.google.de":                     "invalid scheme \"http\"",
+		"sken://10.0.0.1/33":                       "prefix /33 out of range /0-/32",
+		"sken://[fe80::1]/129":                     "prefix /129 out of range /0-/128",
+		"sken://10.0.0.1/foo":                      "path /foo is not a prefix",
+		"sken://10.0.0.1/?type=A":                  "type=A: only valid for dns names",
+		"sken://www.google.de/?nameserver=dns":     "nameserver=dns: \"dns\" is not an ip address",
+		"sken://www.google.de/?port=22/all":        "port=22/all: protocol all does not take ports",
+		"sken://www.google.de/?snat6=10.0.0.1":     "snat6=10.0.0.1: snat6 needs an ipv6 address",
+		"sken://www.google.de/?snat4=1.1.1.1&masq": "masq=: only one mode is allowed snat/masq",
+		"sken://www.google.de/?inIface=e%2Bth0":    "inIface=e+th0: wildcard + is only allowed at the end",
+		"sken://www.google.de/?port=1/2/tcp":       "port=1/2/tcp: \"1/2\" is neither a port number nor a known tcp service",
+	} {
+		target, errs := parseTarget(targetStr, nil, bothFamilies)
+		if target != nil {
+			t.Errorf("%s: target should be nil", targetStr)
+		}
+		if len(errs) != 1 {
+			t.Errorf("%s: expected one error: %v", targetStr, errs)
+			continue
+		}
+		if !strings.HasPrefix(errs[0].Error(), "target "+targetStr+": "+msg) {
+			t.Errorf("%s: %v", targetStr, errs[0])
+		}
+	}
+}
+
+func TestValidateDnsForward(t *testing.T) {
+	opts := DnsForwardOptions{Listen: ":53", Upstreams: []string{"192.0.2.53", "[2001:db8::53]", "192.0.2.54:5353"}}
+	errs := validateDnsForward(&opts)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if !reflect.DeepEqual(opts.Upstreams, []string{"192.0.2.53:53", "[2001:db8::53]:53", "192.0.2.54:5353"}) {
+		t.Errorf("upstreams: %v", opts.Upstreams)
+	}
+	errs = validateDnsForward(&DnsForwardOptions{Listen: ":53"})
+	if len(errs) != 1 {
+		t.Errorf("upstream needed: %v", errs)
+	}
+	errs = validateDnsForward(&DnsForwardOptions{Listen: ":53", Upstreams: []string{"dns.google"}})
+	if len(errs) != 1 {
+		t.Errorf("upstream is no address: %v", errs)
+	}
+	errs = validateDnsForward(&DnsForwardOptions{Listen: ":53", Upstreams: []string{"192.0.2.53"}, Filter: "nxdomain", Allow: []string{"*.example.com"}})
+	if len(errs) != 0 {
+		t.Errorf("filter: %v", errs)
+	}
+	errs = validateDnsForward(&DnsForwardOptions{Listen: ":53", Upstreams: []string{"192.0.2.53"}, Filter: "drop", Allow: []string{"a.*.com"}})
+	if len(errs) != 2 {
+		t.Errorf("filter and allow are invalid: %v", errs)
+	}
+	errs = validateDnsForward(&DnsForwardOptions{Filter: "refused"})
+	if len(errs) != 1 {
+		t.Errorf("filter needs the forwarder: %v", errs)
+	}
+}
+
+func TestValidateDnsSnoop(t *testing.T) {
+	for _, opts := range []DnsSnoopOptions{{}, {Mode: "nflog"}, {Mode: "nfqueue", Queue: 53}, {Mode: "afpacket", Iface: "eth1"}} {
+		if errs := validateDnsSnoop(&opts); len(errs) != 0 {
+			t.Errorf("%v: %v", opts, errs)
+		}
+	}
+	for _, opts := range []DnsSnoopOptions{{Mode: "pcap"}, {Mode: "nfqueue", Queue: 65536}, {Mode: "afpacket"}, {Mode: "nflog", MinTTL: -time.Second}} {
+		if errs := validateDnsSnoop(&opts); len(errs) != 1 {
+			t.Errorf("%v: %v", opts, errs)
+		}
+	}
+}
+
+func TestTargetDnsNames(t *testing.T) {
+	target, errs := parseTarget("sken://www.example.com/?type=A&type=AAAA", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if !reflect.DeepEqual(target.DnsNames(), []string{"www.example.com.", "www.example.com."}) {
+		t.Errorf("names: %v", target.DnsNames())
+	}
+	target, _ = parseTarget("sken://192.0.2.0/24", nil, bothFamilies)
+	if len(target.DnsNames()) != 0 {
+		t.Errorf("literal targets have no names: %v", target.DnsNames())
+	}
+}
+
+func TestParseTargetWildcard(t *testing.T) {
+	target, errs := parseTarget("sken://*.githubusercontent.com/?port=443&type=A&type=AAAA&idle=5m", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if target.Wildcard == nil || target.Wildcard.Pattern != "*.githubusercontent.com" || target.Wildcard.Idle != 5*time.Minute || len(target.Wildcard.Types) != 2 {
+		t.Fatalf("wildcard: %+v", target.Wildcard)
+	}
+	if len(target.Sources) != 0 || !reflect.DeepEqual(target.DnsNames(), []string{"*.githubusercontent.com"}) {
+		t.Errorf("sources: %v names: %v", target.Sources, target.DnsNames())
+	}
+	for name, matches := range map[string]bool{
+		"raw.githubusercontent.com.": true,
+		"A.B.GITHUBUSERCONTENT.COM":  true,
+		"githubusercontent.com.":     false,
+		"xgithubusercontent.com.":    false,
+	} {
+		if target.Wildcard.Matches(name) != matches {
+			t.Errorf("%s: expected %v", name, matches)
+		}
+	}
+	for _, targetStr := range []string{
+		"sken://*.x.com/?nameserver=1.1.1.1",
+		"sken://*.x.com/?idle=forever",
+		"sken://a.*.com/",
+		"sken://*/",
+		"sken://x.com/?idle=5m",
+	} {
+		_, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 1 {
+			t.Errorf("%s: %v", targetStr, errs)
+		}
+	}
+}
+
+func TestParseTargetAuthoritative(t *testing.T) {
+	target, errs := parseTarget("sken://www.example.com/?authoritative&type=A&type=AAAA&from=client.example.com", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if !target.Authoritative {
+		t.Fatalf("not authoritative")
+	}
+	authority := &local.Authority{}
+	target.setAuthority(authority)
+	for _, source := range append(target.Sources, target.From...) {
+		if sys, _ := DnsSubject(source); sys.Authority != authority {
+			t.Errorf("%v: authority not set", source.Key())
+		}
+	}
+	for _, targetStr := range []string{
+		"sken://www.example.com/?authoritative&nameserver=1.1.1.1",
+		"sken://192.0.2.1/?authoritative",
+		"sken://*.example.com/?authoritative",
+	} {
+		_, errs := parseTarget(targetStr, nil, bothFamilies)
+		if len(errs) != 1 {
+			t.Errorf("%s: %v", targetStr, errs)
+		}
+	}
+}
+
+func TestParseTargetSearch(t *testing.T) {
+	target, errs := parseTarget("sken://db/?from=client.example.com.", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	sys, _ := DnsSubject(target.Sources[0])
+	if !sys.Search || sys.Question.Name != "db." {
+		t.Errorf("relative name: %+v", sys)
+	}
+	if from, _ := DnsSubject(target.From[0]); from.Search {
+		t.Errorf("absolute source name is not searched")
+	}
+	target, errs = parseTarget("sken://api.example.com/?from=client", nil, bothFamilies)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	// with ndots:5 like kubernetes a name with dots would be searched first
+	if sys, _ := DnsSubject(target.Sources[0]); sys.Search || sys.Question.Name != "api.example.com." {
+		t.Errorf("name with dots is searched: %+v", sys)
+	}
+	if from, _ := DnsSubject(target.From[0]); !from.Search {
+		t.Errorf("single label source is not searched")
+	}
+}
+
+func sourceKeys(sources []dnsEvents.AddressSource) string {
+	keys := []string{}
+	for _, source := range sources {
+		keys = append(keys, source.Key())
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestParseTargetFamilies(t *testing.T) {
+	ipv4 := []dnsEvents.Family{dnsEvents.IPv4}
+	for _, tc := range []struct {
+		target  string
+		enabled []dnsEvents.Family
+		sources string
+		from    string
+	}{
+		{"sken://www.example.com./", bothFamilies, "www.example.com:IN:A www.example.com:IN:AAAA", ""},
+		{"sken://www.example.com./", ipv4, "www.example.com:IN:A", ""},
+		{"sken://www.example.com./?family=6", bothFamilies, "www.example.com:IN:AAAA", ""},
+		{"sken://www.example.com./?family=ipv4,ipv6&type=AAAA", bothFamilies, "www.example.com:IN:AAAA", ""},
+		{"sken://www.example.com./?from=client.example.com.", ipv4, "www.example.com:IN:A", "client.example.com:IN:A"},
+	} {
+		target, errs := parseTarget(tc.target, nil, tc.enabled)
+		if len(errs) != 0 {
+			t.Errorf("%s: %v", tc.target, errs)
+			continue
+		}
+		if sourceKeys(target.Sources) != tc.sources || sourceKeys(target.From) != tc.from {
+			t.Errorf("%s: %s from %s", tc.target, sourceKeys(target.Sources), sourceKeys(target.From))
+		}
+	}
+	target, errs := parseTarget("sken://*.example.com/?family=4", nil, bothFamilies)
+	if len(errs) != 0 || !reflect.DeepEqual(target.Wildcard.Types, []uint16{1}) || target.HasFamily(dnsEvents.IPv6) {
+		t.Errorf("wildcard of ipv4: %+v %v", target, errs)
+	}
+	for _, tc := range []struct {
+		target  string
+		enabled []dnsEvents.Family
+	}{
+		{"sken://www.example.com./?family=6", ipv4},
+		{"sken://www.example.com./?family=4&type=AAAA", bothFamilies},
+		{"sken://www.example.com./?family=5", bothFamilies},
+		{"sken://[2001:db8::1]/", ipv4},
+		{"sken://www.example.com./?from=2001:db8::/32", ipv4},
+		{"sken://www.example.com./", []dnsEvents.Family{}},
+	} {
+		if _, errs := parseTarget(tc.target, nil, tc.enabled); len(errs) != 1 {
+			t.Errorf("%s: %v", tc.target, errs)
+		}
+	}
+}
+
+func TestTargetIDAndInstance(t *testing.T) {
+	a, _ := parseTarget("sken://www.example.com./", nil, bothFamilies)
+	b, _ := parseTarget("sken://www.example.com./", nil, bothFamilies)
+	c, _ := parseTarget("sken://www.example.com./?port=80", nil, bothFamilies)
+	if a.ID != b.ID || a.ID == c.ID || len(a.ID) != 8 {
+		t.Errorf("ids: %s %s %s", a.ID, b.ID, c.ID)
+	}
+	for _, tc := range []struct {
+		conf Config
+		errs int
+	}{
+		{Config{InstanceID: "gw-1.example"}, 0},
+		{Config{InstanceID: "gw,1"}, 1},
+		{Config{InstanceID: ""}, 0},
+		{Config{InstanceID: "", Adopt: true, AdoptGrace: time.Minute}, 1},
+		{Config{InstanceID: "gw/1"}, 1},
+		{Config{InstanceID: "gw1", Adopt: true}, 1},
+		{Config{InstanceID: "gw1", Adopt: true, AdoptGrace: time.Minute}, 0},
+	} {
+		if errs := validateInstance(&tc.conf); len(errs) != tc.errs {
+			t.Errorf("%+v: %v", tc.conf, errs)
+		}
+	}
+}
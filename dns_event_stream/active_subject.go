@@ -14,7 +14,7 @@ import (
 )
 
 type ActionItem struct {
-	Action  string
+	Action  Action
 	Idx     int
 	Current dns.RR
 	Prev    dns.RR
@@ -36,20 +36,37 @@ func (as *ActiveSubject) ensureLog() *zerolog.Logger {
 type Subject interface {
 	ConnectActiveSubject(as *ActiveSubject)
 	Key() dns.Question
-	Resolve() ([]dns.RR, error)
+	// Resolve is aborted with ctx if the subject is deactivated
+	Resolve(ctx context.Context) ([]dns.RR, error)
+}
+
+// disconnecter is a Subject which holds resources for its active subject
+// until it is released
+type disconnecter interface {
+	DisconnectActiveSubject(as *ActiveSubject)
+}
+
+func disconnect(as *ActiveSubject) {
+	if d, ok := as.Subject.(disconnecter); ok {
+		d.DisconnectActiveSubject(as)
+	}
 }
 
 type ActiveSubject struct {
 	Subject            Subject
 	Log                *zerolog.Logger
+	lock               sync.Mutex // activated, ctx and boundFns
 	activated          bool
+	ctx                context.Context // of the activation
+	cancel             func()
 	askBackend         sync.Mutex
+	deliver            sync.Mutex // the bound functions and subscribers in order
+	subscribers        hub
 	history            []*DnsResult
 	dnsEventStream     *DnsEventStream
-	isWaiting          bool
-	cancelFn           func()
 	doneBackendResolve chan []*DnsResult
 	boundFns           map[string]func(history []*DnsResult)
+	shares             int // of DnsEventStream.Share, under its activeLock
 }
 
 func NewActiveSubject(subject Subject, dnsEventStream *DnsEventStream) (*ActiveSubject, error) {
@@ -67,17 +84,29 @@ func NewActiveSubject(subject Subject, dnsEventStream *DnsEventStream) (*ActiveS
 	return as, nil
 }
 
+// Bind calls fn with the history if the answers changed, the refresh
+// returns after fn, slow consumers should Subscribe
 func (as *ActiveSubject) Bind(fn func(history []*DnsResult)) func() {
+	as.lock.Lock()
+	defer as.lock.Unlock()
 	if as.boundFns == nil {
 		as.boundFns = make(map[string]func(history []*DnsResult))
 	}
 	id := uuid.NewString()
 	as.boundFns[id] = fn
 	return func() {
+		as.lock.Lock()
+		defer as.lock.Unlock()
 		delete(as.boundFns, id)
 	}
 }
 
+func (as *ActiveSubject) isActivated() bool {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+	return as.activated
+}
+
 func unshift(new *DnsResult, history []*DnsResult) []*DnsResult {
 	for i := len(history) - 1; i > 0; i-- {
 		history[i] = history[i-1]
@@ -99,8 +128,13 @@ func unshiftMax(new *DnsResult, history []*DnsResult, max int) []*DnsResult {
 	return unshift(new, history)
 }
 
+// Refresh resolves the subject, calls the bound functions if the answer
+// changed and schedules the next refresh by the ttl
 func (as *ActiveSubject) Refresh() {
-	if !as.activated {
+	as.lock.Lock()
+	activated, ctx := as.activated, as.ctx
+	as.lock.Unlock()
+	if !activated {
 		as.ensureLog().Debug().Msg("not activated")
 		return
 	}
@@ -113,8 +147,14 @@ func (as *ActiveSubject) Refresh() {
 		as.history = make([]*DnsResult, 0, as.dnsEventStream.HistoryLimit())
 	}
 	startTime := time.Now()
-	dnsrr.Rrs, dnsrr.Err = as.Subject.Resolve()
+	dnsrr.Rrs, dnsrr.Err = as.Subject.Resolve(ctx)
 	dnsrr.ResolveTime = time.Since(startTime)
+	if ctx.Err() != nil {
+		// deactivated while resolving, the result is not part of the history
+		as.ensureLog().Debug().Err(ctx.Err()).Msg("refresh aborted")
+		as.askBackend.Unlock()
+		return
+	}
 	invokeBounds := false
 	ai := []ActionItem{}
 	if len(as.history) > 0 {
@@ -150,32 +190,67 @@ func (as *ActiveSubject) Refresh() {
 		refreshTime > as.dnsEventStream.refreshTimes.max {
 		refreshTime = as.dnsEventStream.refreshTimes.max
 	}
-	if !as.isWaiting {
-		var ctx context.Context
-		ctx, as.cancelFn = context.WithCancel(context.Background())
-		as.isWaiting = true
-		go func() {
-			ret := as.dnsEventStream.timeIf.Delay(ctx, refreshTime)
-			as.isWaiting = false
-			as.cancelFn = nil
-			if ret == nil {
-				// as.dnsEventStream.time().Sleep(refreshTime)
-				as.ensureLog().Debug().Dur("refreshing in ", refreshTime)
-				as.Refresh()
-			}
-		}()
+	fns := []func(history []*DnsResult){}
+	as.lock.Lock()
+	// a deactivated subject is not scheduled again
+	if as.activated {
+		as.ensureLog().Debug().Dur("refreshTime", refreshTime).Msg("scheduled")
+		as.dnsEventStream.scheduler().schedule(as, dnsrr.Created.Add(refreshTime))
+	}
+	if invokeBounds {
+		for _, fn := range as.boundFns {
+			fns = append(fns, fn)
+		}
 	}
+	as.lock.Unlock()
 	my := make([]*DnsResult, len(as.history))
 	copy(my, as.history)
-	defer as.askBackend.Unlock()
+	question := as.Subject.Key()
 	if as.doneBackendResolve != nil {
 		as.doneBackendResolve <- my
 	}
-	if invokeBounds {
-		for _, fn := range as.boundFns {
-			fn(my)
-		}
+	if !invokeBounds {
+		as.askBackend.Unlock()
+		return
 	}
+	// the next refresh resolves while this one is delivered, its delivery
+	// waits to keep the order
+	as.deliver.Lock()
+	as.askBackend.Unlock()
+	defer as.deliver.Unlock()
+	for _, fn := range fns {
+		fn(my)
+	}
+	ev := NewEvent(question, my)
+	as.subscribers.publish(ev)
+	as.dnsEventStream.subscribers.publish(ev)
+}
+
+// Subscribe delivers the changes of the subject, the subscription ends with
+// the deactivation
+func (as *ActiveSubject) Subscribe(opts SubscribeOptions) *Subscription {
+	return as.subscribers.subscribe(opts)
+}
+
+// subscribeCurrent subscribes and sends the current answers as added, in
+// order with the deliveries of the refreshes
+func (as *ActiveSubject) subscribeCurrent(opts SubscribeOptions) *Subscription {
+	as.askBackend.Lock()
+	my := make([]*DnsResult, len(as.history))
+	copy(my, as.history)
+	as.deliver.Lock()
+	as.askBackend.Unlock()
+	defer as.deliver.Unlock()
+	sub := as.subscribers.subscribe(opts)
+	if len(my) == 0 {
+		return sub
+	}
+	ev := NewEvent(as.Subject.Key(), my)
+	ev.Err = nil
+	ev.Actions = ToActions(NewestValidHistory(my).Rrs, []dns.RR{})
+	ev.Changes = ToAddressChanges(ev.Key, ev.Actions)
+	sub.send(ev)
+	return sub
 }
 
 func (as *ActiveSubject) Resolve() DnsResult {
@@ -189,7 +264,7 @@ func (as *ActiveSubject) Resolve() DnsResult {
 	// 	}()
 	// }
 
-	if !as.activated {
+	if !as.isActivated() {
 		return DnsResult{
 			Err: fmt.Errorf("subject not activated: %s", KeySubject(as.Subject.Key())),
 		}
@@ -213,25 +288,50 @@ func (as *ActiveSubject) Resolve() DnsResult {
 	return dnsrr
 }
 
+// Activate refreshes the subject before it returns
 func (as *ActiveSubject) Activate() error {
+	err := as.activate()
+	if err != nil {
+		return err
+	}
+	as.Refresh()
+	return nil
+}
+
+func (as *ActiveSubject) activate() error {
+	as.lock.Lock()
+	defer as.lock.Unlock()
 	if as.activated {
 		return fmt.Errorf("subject already activated: %s", KeySubject(as.Subject.Key()))
 	}
 	as.ensureLog().Info().Msg("Activate")
 	as.activated = true
-	as.Refresh()
+	as.ctx, as.cancel = context.WithCancel(as.dnsEventStream.context())
 	return nil
 }
 
+// Trigger refreshes the activated subject soon on the workers of the
+// DnsEventStream
+func (as *ActiveSubject) Trigger() {
+	as.lock.Lock()
+	defer as.lock.Unlock()
+	if as.activated {
+		as.dnsEventStream.scheduler().schedule(as, as.dnsEventStream.time().Now())
+	}
+}
+
+// Deactivate drops the next refresh and aborts a running one
 func (as *ActiveSubject) Deactivate() error {
+	as.lock.Lock()
+	defer as.lock.Unlock()
 	if !as.activated {
 		return fmt.Errorf("subject not activated: %s", KeySubject(as.Subject.Key()))
 	}
-	if as.cancelFn != nil {
-		as.cancelFn()
-	}
+	as.dnsEventStream.scheduler().unschedule(as)
+	as.cancel()
 	as.activated = false
 	as.boundFns = make(map[string]func(history []*DnsResult))
+	as.subscribers.closeAll()
 	as.ensureLog().Info().Msg("Deactivate")
 	return nil
 }
@@ -0,0 +1,156 @@
+package dns_event_stream
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// AddressSource produces the address set of a target or of its sources
+type AddressSource interface {
+	Key() string
+	// Run calls update with the complete set if it changed or with the
+	// error of a failed refresh until ctx is done
+	Run(ctx context.Context, des *DnsEventStream, update func(addrs []Address, err error))
+}
+
+// AddressEvent is the change of the address set of a source, a failed
+// refresh keeps the previous set
+type AddressEvent struct {
+	Key       string
+	Err       error
+	Addresses []Address       // the current set
+	Changes   []AddressChange // NewAdd and OldDel against the previous set
+}
+
+func lessPrefix(a, b netip.Prefix) bool {
+	if a.Addr() != b.Addr() {
+		return a.Addr().Less(b.Addr())
+	}
+	return a.Bits() < b.Bits()
+}
+
+func sortedAddresses(set map[netip.Prefix]Address) []Address {
+	out := make([]Address, 0, len(set))
+	for _, addr := range set {
+		out = append(out, addr)
+	}
+	sort.Slice(out, func(i, j int) bool { return lessPrefix(out[i].Prefix, out[j].Prefix) })
+	return out
+}
+
+// DiffAddresses returns the OldDel of the prefixes gone from prev and the
+// NewAdd of the prefixes new in next
+func DiffAddresses(key string, prev, next map[netip.Prefix]Address) []AddressChange {
+	changes := []AddressChange{}
+	for _, addr := range sortedAddresses(prev) {
+		if _, found := next[addr.Prefix]; !found {
+			changes = append(changes, AddressChange{Action: OldDel, Key: key, Prev: addr})
+		}
+	}
+	for _, addr := range sortedAddresses(next) {
+		if _, found := prev[addr.Prefix]; !found {
+			changes = append(changes, AddressChange{Action: NewAdd, Key: key, Current: addr})
+		}
+	}
+	return changes
+}
+
+// WatchSource runs src until the stream or the returned stop is called, fn
+// is called with the changes of its address set and its errors
+func (s *DnsEventStream) WatchSource(src AddressSource, fn func(ev AddressEvent)) func() {
+	lock := sync.Mutex{}
+	current := map[netip.Prefix]Address{}
+	update := func(addrs []Address, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		ev := AddressEvent{Key: src.Key(), Err: err}
+		if err == nil {
+			next := make(map[netip.Prefix]Address, len(addrs))
+			for _, addr := range addrs {
+				next[addr.Prefix] = addr
+			}
+			ev.Changes = DiffAddresses(ev.Key, current, next)
+			if len(ev.Changes) == 0 {
+				return
+			}
+			current = next
+		}
+		ev.Addresses = sortedAddresses(current)
+		fn(ev)
+	}
+	ctx, cancel := context.WithCancel(s.context())
+	go src.Run(ctx, s, update)
+	return cancel
+}
+
+// LiteralSource is a fixed set of addresses and cidrs
+type LiteralSource struct {
+	Prefixes []netip.Prefix
+}
+
+func (l *LiteralSource) Key() string {
+	strs := make([]string, 0, len(l.Prefixes))
+	for _, prefix := range l.Prefixes {
+		strs = append(strs, prefix.String())
+	}
+	return strings.Join(strs, ",")
+}
+
+func (l *LiteralSource) Run(ctx context.Context, des *DnsEventStream, update func(addrs []Address, err error)) {
+	addrs := make([]Address, 0, len(l.Prefixes))
+	for _, prefix := range l.Prefixes {
+		addrs = append(addrs, newAddress(prefix, 0))
+	}
+	update(addrs, nil)
+	<-ctx.Done()
+}
+
+// DnsSource is the address set of the newest answers of a subject
+type DnsSource struct {
+	Subject Subject
+}
+
+func (d *DnsSource) Key() string {
+	return KeySubject(d.Subject.Key())
+}
+
+func (d *DnsSource) Run(ctx context.Context, des *DnsEventStream, update func(addrs []Address, err error)) {
+	// the targets of the same name share the resolution
+	sub, err := des.Share(d.Subject, SubscribeOptions{})
+	if err != nil {
+		update(nil, err)
+		return
+	}
+	defer sub.Close()
+	des.log.Info().Str("source", d.Key()).Msg("shared")
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			if ev.Err != nil {
+				update(nil, ev.Err)
+				continue
+			}
+			update(rrAddresses(NewestValidHistory(ev.History).Rrs), nil)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func rrAddresses(rrs []dns.RR) []Address {
+	addrs := make([]Address, 0, len(rrs))
+	for _, rr := range rrs {
+		if addr, found := ParseAddress(rr); found {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,183 @@
+package dns_event_stream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+func startedStream(t *testing.T) *DnsEventStream {
+	zlog := zerolog.Nop()
+	des := NewDnsEventStream(&zlog)
+	if err := des.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { des.Stop(context.Background()) })
+	return des
+}
+
+func watch(des *DnsEventStream, src AddressSource) chan AddressEvent {
+	events := make(chan AddressEvent, 16)
+	des.WatchSource(src, func(ev AddressEvent) { events <- ev })
+	return events
+}
+
+func nextAddressEvent(t *testing.T, events chan AddressEvent) AddressEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no address event")
+	}
+	return AddressEvent{}
+}
+
+func changeStrs(changes []AddressChange) string {
+	strs := []string{}
+	for _, c := range changes {
+		switch c.Action {
+		case NewAdd:
+			strs = append(strs, "+"+c.Current.String())
+		case OldDel:
+			strs = append(strs, "-"+c.Prev.String())
+		}
+	}
+	return strings.Join(strs, " ")
+}
+
+func TestDnsSource(t *testing.T) {
+	des := startedStream(t)
+	a1, _ := dns.NewRR("www.example.com. 3600 IN A 192.0.2.1")
+	cname, _ := dns.NewRR("www.example.com. 3600 IN CNAME web.example.com.")
+	fix := &FixResolverSubject{
+		Question: dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		Result:   []dns.RR{cname, a1},
+	}
+	src := &DnsSource{Subject: fix}
+	ev := nextAddressEvent(t, watch(des, src))
+	if ev.Key != "www.example.com:IN:A" || ev.Err != nil || changeStrs(ev.Changes) != "+192.0.2.1" || len(ev.Addresses) != 1 {
+		t.Errorf("dns source: %+v", ev)
+	}
+}
+
+func activeCount(des *DnsEventStream) int {
+	des.activeLock.Lock()
+	defer des.activeLock.Unlock()
+	return len(des.activeSubjects)
+}
+
+func TestDnsSourceShared(t *testing.T) {
+	des := startedStream(t)
+	a1, _ := dns.NewRR("www.example.com. 3600 IN A 192.0.2.1")
+	a2, _ := dns.NewRR("www.example.com. 3600 IN A 192.0.2.2")
+	question := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	first := make(chan AddressEvent, 16)
+	stopFirst := des.WatchSource(&DnsSource{Subject: &FixResolverSubject{Question: question, Result: []dns.RR{a1}}},
+		func(ev AddressEvent) { first <- ev })
+	if ev := nextAddressEvent(t, first); changeStrs(ev.Changes) != "+192.0.2.1" {
+		t.Errorf("first: %+v", ev)
+	}
+	// the second target of the name gets the answers of the first
+	second := make(chan AddressEvent, 16)
+	stopSecond := des.WatchSource(&DnsSource{Subject: &FixResolverSubject{Question: question, Result: []dns.RR{a2}}},
+		func(ev AddressEvent) { second <- ev })
+	if ev := nextAddressEvent(t, second); ev.Err != nil || changeStrs(ev.Changes) != "+192.0.2.1" {
+		t.Errorf("second: %+v", ev)
+	}
+	if activeCount(des) != 1 {
+		t.Errorf("shared subjects: %d", activeCount(des))
+	}
+	stopFirst()
+	time.Sleep(50 * time.Millisecond)
+	if activeCount(des) != 1 {
+		t.Errorf("released with a share left")
+	}
+	stopSecond()
+	for i := 0; i < 100 && activeCount(des) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if activeCount(des) != 0 {
+		t.Errorf("not released")
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	des := startedStream(t)
+	path := filepath.Join(t.TempDir(), "cidrs")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# clients\n10.0.0.0/8\n192.0.2.1 # gateway\n\n2001:db8::/32\n")
+	src := &FileSource{Path: path, CheckInterval: 10 * time.Millisecond}
+	events := watch(des, src)
+	ev := nextAddressEvent(t, events)
+	if changeStrs(ev.Changes) != "+10.0.0.0/8 +192.0.2.1 +2001:db8::/32" || ev.Key != "file://"+path {
+		t.Errorf("first read: %s", changeStrs(ev.Changes))
+	}
+
+	// a broken file keeps the previous set
+	write("10.0.0.0/8\nnot a cidr\n")
+	ev = nextAddressEvent(t, events)
+	if ev.Err == nil || !strings.Contains(ev.Err.Error(), "line 2") || len(ev.Addresses) != 3 {
+		t.Errorf("broken file: %+v", ev)
+	}
+	write("10.0.0.0/8\n198.51.100.0/24\n")
+	for ev = nextAddressEvent(t, events); ev.Err != nil; ev = nextAddressEvent(t, events) {
+	}
+	if changeStrs(ev.Changes) != "-192.0.2.1 -2001:db8::/32 +198.51.100.0/24" || len(ev.Addresses) != 2 {
+		t.Errorf("changed file: %s", changeStrs(ev.Changes))
+	}
+}
+
+func TestHttpSource(t *testing.T) {
+	des := startedStream(t)
+	var notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"syncToken": "1", "prefixes": [
+			{"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "AMAZON"},
+			{"ipv6Prefix": "2600:1f14::/35"}, {"ip_prefix": "no cidr"}],
+			"web": ["192.0.2.0/24", "3.5.140.0/22"]}`))
+	}))
+	defer server.Close()
+	src := &HttpSource{URL: server.URL + "/ranges.json", Interval: 10 * time.Millisecond}
+	events := watch(des, src)
+	ev := nextAddressEvent(t, events)
+	if ev.Err != nil || changeStrs(ev.Changes) != "+3.5.140.0/22 +192.0.2.0/24 +2600:1f14::/35" {
+		t.Errorf("feed: %+v", ev)
+	}
+	for atomic.LoadInt32(&notModified) < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("the unchanged feed is no event: %+v", ev)
+	default:
+	}
+
+	ev = nextAddressEvent(t, watch(des, &HttpSource{URL: server.URL + "/missing"}))
+	if ev.Err == nil || !strings.Contains(ev.Err.Error(), "404") {
+		t.Errorf("missing feed: %+v", ev)
+	}
+}
@@ -0,0 +1,90 @@
+package dns_event_stream
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// AggregatePrefixes merges the prefixes into the minimal set of covering
+// prefixes, exact unless maxWiden4 or maxWiden6 allow to widen neighbouring
+// prefixes up to this length, 0 never widens
+func AggregatePrefixes(prefixes []netip.Prefix, maxWiden4, maxWiden6 int) []netip.Prefix {
+	out := aggregateExact(prefixes)
+	widened := false
+	groups := map[netip.Prefix][]netip.Prefix{}
+	for _, p := range out {
+		limit := maxWiden6
+		if p.Addr().Is4() {
+			limit = maxWiden4
+		}
+		if limit <= 0 || p.Bits() <= limit {
+			continue
+		}
+		parent := netip.PrefixFrom(p.Addr(), limit).Masked()
+		groups[parent] = append(groups[parent], p)
+	}
+	for parent, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		widened = true
+		out = append(out, commonPrefix(parent, members))
+	}
+	if !widened {
+		return out
+	}
+	return aggregateExact(out)
+}
+
+func sortPrefixes(prefixes []netip.Prefix) {
+	sort.Slice(prefixes, func(i, j int) bool { return lessPrefix(prefixes[i], prefixes[j]) })
+}
+
+// aggregateExact drops the covered prefixes and merges the sibling halves
+func aggregateExact(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p.IsValid() {
+			sorted = append(sorted, p.Masked())
+		}
+	}
+	sortPrefixes(sorted)
+	stack := make([]netip.Prefix, 0, len(sorted))
+	for _, p := range sorted {
+		// sorted by address and length, a covering prefix comes first
+		if len(stack) > 0 && stack[len(stack)-1].Bits() <= p.Bits() && stack[len(stack)-1].Contains(p.Addr()) {
+			continue
+		}
+		stack = append(stack, p)
+		for len(stack) >= 2 {
+			a, b := stack[len(stack)-2], stack[len(stack)-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				break
+			}
+			parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+			if parent.Addr() != a.Addr() || !parent.Contains(b.Addr()) {
+				break
+			}
+			stack = append(stack[:len(stack)-2], parent)
+		}
+	}
+	return stack
+}
+
+// commonPrefix is the longest prefix within parent covering the members
+func commonPrefix(parent netip.Prefix, members []netip.Prefix) netip.Prefix {
+	for bits := members[0].Bits(); bits > parent.Bits(); bits-- {
+		candidate := netip.PrefixFrom(members[0].Addr(), bits).Masked()
+		covers := true
+		for _, m := range members[1:] {
+			if !candidate.Contains(m.Addr()) || m.Bits() < bits {
+				covers = false
+				break
+			}
+		}
+		if covers {
+			return candidate
+		}
+	}
+	return parent
+}
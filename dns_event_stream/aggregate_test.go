@@ -0,0 +1,40 @@
+package dns_event_stream
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestAggregatePrefixes(t *testing.T) {
+	for _, tc := range []struct {
+		in                   string
+		maxWiden4, maxWiden6 int
+		want                 string
+	}{
+		{"192.0.2.1/32 192.0.2.0/32 192.0.2.2/32", 0, 0, "192.0.2.0/31 192.0.2.2/32"},
+		{"192.0.2.0/32 192.0.2.1/32 192.0.2.2/32 192.0.2.3/32", 0, 0, "192.0.2.0/30"},
+		{"10.0.0.0/8 10.1.2.3/32 10.0.0.0/16 11.0.0.0/8", 0, 0, "10.0.0.0/7"},
+		{"10.0.0.5/24 10.0.1.0/24", 0, 0, "10.0.0.0/23"},
+		{"2001:db8::/33 2001:db8:8000::/33 192.0.2.1/32", 0, 0, "192.0.2.1/32 2001:db8::/32"},
+		// neighbours are only widened within maxWiden
+		{"192.0.2.1/32 192.0.2.200/32 198.51.100.1/32", 0, 0, "192.0.2.1/32 192.0.2.200/32 198.51.100.1/32"},
+		{"192.0.2.1/32 192.0.2.200/32 198.51.100.1/32", 24, 0, "192.0.2.0/24 198.51.100.1/32"},
+		{"192.0.2.1/32 192.0.2.6/32 192.0.3.1/32", 24, 0, "192.0.2.0/29 192.0.3.1/32"},
+		{"192.0.2.1/32 192.0.3.1/32", 24, 0, "192.0.2.1/32 192.0.3.1/32"},
+		{"192.0.2.1/32 192.0.3.1/32", 23, 0, "192.0.2.0/23"},
+		{"2001:db8::1/128 2001:db8::ff/128 192.0.2.1/32 192.0.2.2/32", 0, 64, "192.0.2.1/32 192.0.2.2/32 2001:db8::/120"},
+	} {
+		prefixes := []netip.Prefix{}
+		for _, p := range strings.Fields(tc.in) {
+			prefixes = append(prefixes, netip.MustParsePrefix(p))
+		}
+		strs := []string{}
+		for _, p := range AggregatePrefixes(prefixes, tc.maxWiden4, tc.maxWiden6) {
+			strs = append(strs, p.String())
+		}
+		if got := strings.Join(strs, " "); got != tc.want {
+			t.Errorf("%s /%d /%d: %s != %s", tc.in, tc.maxWiden4, tc.maxWiden6, got, tc.want)
+		}
+	}
+}
@@ -27,14 +27,20 @@ type RefreshTimes struct {
 }
 
 type DnsEventStream struct {
-	activeLock     sync.Mutex
+	activeLock     sync.Mutex // activeSubjects, started and ctx
 	activeSubjects map[string]*ActiveSubject
 	log            *zerolog.Logger
 	started        bool
+	ctx            context.Context // of Start, the subjects are activated with it
+	cancel         func()
 	historyLimit   int // default 5
 	refreshTimes   RefreshTimes
 	waitResolve    time.Duration
 	timeIf         timeInterface
+	concurrency    int // default 8 refreshes at once
+	refresherOnce  sync.Once
+	refresher      *scheduler
+	subscribers    hub
 }
 
 func NewDnsEventStream(zlog *zerolog.Logger) *DnsEventStream {
@@ -78,33 +84,69 @@ func (d *DnsEventStream) time() timeInterface {
 	if d.timeIf != nil {
 		return d.timeIf
 	}
-	d.timeIf = &sysTime{}
-	return d.timeIf
+	return &sysTime{}
 }
 
-func (s *DnsEventStream) Start() error {
+// scheduler refreshes the activated subjects when they are due
+func (d *DnsEventStream) scheduler() *scheduler {
+	d.refresherOnce.Do(func() {
+		concurrency := d.concurrency
+		if concurrency == 0 {
+			concurrency = 8
+		}
+		d.refresher = newScheduler(d.time(), concurrency)
+	})
+	return d.refresher
+}
+
+// context is the context of Start or the background without Start
+func (s *DnsEventStream) context() context.Context {
+	s.activeLock.Lock()
+	defer s.activeLock.Unlock()
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// Start allows to create subjects, they are deactivated if ctx is done
+func (s *DnsEventStream) Start(ctx context.Context) error {
+	s.activeLock.Lock()
+	defer s.activeLock.Unlock()
 	if s.started {
 		return fmt.Errorf("already started")
 	}
 	s.started = true
+	s.ctx, s.cancel = context.WithCancel(ctx)
 	s.log.Info().Msg("Start")
 	return nil
 }
 
-func (s *DnsEventStream) Stop() error {
+// Stop deactivates the subjects and waits until ctx is done for the
+// running refreshes
+func (s *DnsEventStream) Stop(ctx context.Context) error {
+	s.activeLock.Lock()
 	if !s.started {
+		s.activeLock.Unlock()
 		return fmt.Errorf("not started")
 	}
-	s.activeLock.Lock()
-	defer s.activeLock.Unlock()
+	subjects := make([]*ActiveSubject, 0, len(s.activeSubjects))
 	for _, as := range s.activeSubjects {
-		if as.activated {
+		subjects = append(subjects, as)
+	}
+	s.started = false
+	s.cancel()
+	s.activeLock.Unlock()
+	for _, as := range subjects {
+		if as.isActivated() {
 			as.Deactivate()
 		}
 	}
-	s.started = false
-	s.log.Info().Msg("Stop")
-	return nil
+	// the bound functions of the running refreshes may add subjects
+	err := s.scheduler().Stop(ctx)
+	s.subscribers.closeAll()
+	s.log.Info().Err(err).Msg("Stop")
+	return err
 }
 
 func (s *DnsEventStream) HistoryLimit() int {
@@ -116,48 +158,86 @@ func (s *DnsEventStream) HistoryLimit() int {
 }
 
 func (s *DnsEventStream) CreateSubject(sub Subject) (*ActiveSubject, error) {
+	s.activeLock.Lock()
+	defer s.activeLock.Unlock()
+	return s.createSubject(sub)
+}
+
+// createSubject returns the subject of the key of sub, locked
+func (s *DnsEventStream) createSubject(sub Subject) (*ActiveSubject, error) {
+	key := KeySubject(sub.Key())
 	if !s.started {
 		err := fmt.Errorf("not started")
 		s.log.Error().Err(err)
 		return nil, err
 	}
-	key := KeySubject(sub.Key())
+	as, found := s.activeSubjects[key]
+	if found {
+		return as, nil
+	}
 	aslog := s.log.With().Str("subject", key).Logger()
-	var as *ActiveSubject
-	{
-		s.activeLock.Lock()
-		defer s.activeLock.Unlock()
-		var found bool
-		as, found = s.activeSubjects[key]
-		if found {
-			// aslog.Debug().Msg("already added")
-			return as, nil
-		}
-		as = &ActiveSubject{
-			Subject:        sub,
-			Log:            &aslog,
-			dnsEventStream: s,
-		}
-		s.activeSubjects[key] = as
-		as.Subject.ConnectActiveSubject(as)
+	as = &ActiveSubject{
+		Subject:        sub,
+		Log:            &aslog,
+		dnsEventStream: s,
 	}
+	s.activeSubjects[key] = as
+	as.Subject.ConnectActiveSubject(as)
 	s.log.Info().Str("subject", key).Msg("added")
 	return as, nil
 }
 
-func (s *DnsEventStream) RemoveSubject(q dns.Question) error {
-	if !s.started {
-		return fmt.Errorf("not started")
+// Share subscribes to the subject of the key of sub, any number of
+// consumers share its resolution. The first share activates the subject,
+// a later one starts with the current answers. Close of the subscription
+// releases the share, the last one deactivates and removes the subject.
+func (s *DnsEventStream) Share(sub Subject, opts SubscribeOptions) (*Subscription, error) {
+	s.activeLock.Lock()
+	as, err := s.createSubject(sub)
+	if err != nil {
+		s.activeLock.Unlock()
+		return nil, err
+	}
+	as.shares++
+	s.activeLock.Unlock()
+	subscription := as.subscribeCurrent(opts)
+	subscription.release = func() { s.release(as) }
+	if as.activate() == nil {
+		as.Refresh()
 	}
+	return subscription, nil
+}
+
+func (s *DnsEventStream) release(as *ActiveSubject) {
+	key := KeySubject(as.Subject.Key())
+	s.activeLock.Lock()
+	as.shares--
+	last := as.shares == 0
+	if last && s.activeSubjects[key] == as {
+		delete(s.activeSubjects, key)
+	}
+	s.activeLock.Unlock()
+	if last {
+		as.Deactivate()
+		disconnect(as)
+		s.log.Info().Str("subject", key).Msg("released")
+	}
+}
+
+func (s *DnsEventStream) RemoveSubject(q dns.Question) error {
 	key := KeySubject(q)
 	s.activeLock.Lock()
 	defer s.activeLock.Unlock()
-	_, found := s.activeSubjects[key]
+	if !s.started {
+		return fmt.Errorf("not started")
+	}
+	as, found := s.activeSubjects[key]
 	if !found {
 		err := fmt.Errorf("subject not found: %s", key)
 		s.log.Error().Err(err)
 		return err
 	}
+	disconnect(as)
 	// err := as.Deactivate()
 	// if err != nil {
 	// 	return err
@@ -182,6 +262,12 @@ func (s *DnsEventStream) RemoveSubject(q dns.Question) error {
 // 	return !found, as, nil
 // }
 
+// Subscribe delivers the changes of all subjects, the subscription ends
+// with Stop
+func (s *DnsEventStream) Subscribe(opts SubscribeOptions) *Subscription {
+	return s.subscribers.subscribe(opts)
+}
+
 func (s *DnsEventStream) Bind(sub Subject, fn func(history []*DnsResult)) (func(), error) {
 	as, err := s.CreateSubject(sub)
 	if err != nil {
@@ -190,26 +276,44 @@ func (s *DnsEventStream) Bind(sub Subject, fn func(history []*DnsResult)) (func(
 	return as.Bind(fn), nil
 }
 
-func (s *DnsEventStream) Resolve(sub Subject) ([]dns.RR, error) {
+// Resolve activates the subject and waits for its first answers until ctx
+// is done
+func (s *DnsEventStream) Resolve(ctx context.Context, sub Subject) ([]dns.RR, error) {
 	as, err := s.CreateSubject(sub)
 	if err != nil {
 		return nil, err
 	}
-	if !as.activated {
-		as.Activate()
+	// the first refresh runs on the workers to not block beyond ctx
+	if as.activate() == nil {
+		as.Trigger()
 	}
-	dnsrr := as.Resolve()
-	if s.waitResolve == 0 {
-		s.waitResolve = 100 * time.Millisecond
+	waitResolve := s.waitResolve
+	if waitResolve == 0 {
+		waitResolve = 100 * time.Millisecond
+	}
+	wait := func() error {
+		timer := time.NewTimer(waitResolve)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
 	}
+	dnsrr := as.Resolve()
 	if dnsrr.Err != nil && strings.HasPrefix(dnsrr.Err.Error(), "subject not activated:") {
 		s.log.Info().Str("subject", KeySubject(sub.Key())).Msg("waiting for activation")
-		time.Sleep(s.waitResolve)
+		if err := wait(); err != nil {
+			return nil, err
+		}
 		dnsrr = as.Resolve()
 	}
-	for ; dnsrr.Err == nil && len(dnsrr.Rrs) == 0; time.Sleep(s.waitResolve) {
+	for dnsrr.Err == nil && len(dnsrr.Rrs) == 0 {
 		s.log.Info().Str("subject", KeySubject(sub.Key())).Msg("waiting for results")
-		// there should be a better way to do this
+		if err := wait(); err != nil {
+			return nil, err
+		}
 		dnsrr = as.Resolve()
 	}
 	return dnsrr.Rrs, dnsrr.Err
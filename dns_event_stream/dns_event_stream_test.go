@@ -19,29 +19,55 @@ import (
 
 // }
 
+// servePTR answers the PTR of 8.8.8.8 like dns.google
+func servePTR(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) }}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(2 * time.Millisecond)
+		res := dns.Msg{}
+		res.SetReply(req)
+		if req.Question[0].Qtype == dns.TypePTR {
+			ptr, _ := dns.NewRR("8.8.8.8.in-addr.arpa. 66354 IN PTR dns.google.")
+			res.Answer = []dns.RR{ptr}
+		}
+		w.WriteMsg(&res)
+	})
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
 func TestSysResolverSubject(t *testing.T) {
+	addr, stop := servePTR(t)
+	defer stop()
 	srs := SysResolverSubject{
 		Question: dns.Question{
 			Name:   "8.8.8.8.in-addr.arpa.",
 			Qtype:  dns.TypePTR,
 			Qclass: dns.ClassINET,
 		},
-		NameServers: []string{"8.8.8.8", "1.1.1.1"},
+		NameServers: []string{"127.0.0.1:1", addr},
 	}
 	des := NewDnsEventStream(nil)
-	err := des.Start()
+	err := des.Start(context.Background())
 	if err != nil {
 		t.Fatalf("start: %v", err)
 	}
+	lock := sync.Mutex{}
 	bounds := [][]*DnsResult{}
 	des.Bind(&srs, func(history []*DnsResult) {
+		lock.Lock()
+		defer lock.Unlock()
 		bounds = append(bounds, history)
 	})
-	// _, err = des.CreateSubject(&srs)
-	// if err != nil {
-	// 	t.Fatalf("add: %v", err)
-	// }
-	rrs, err := des.Resolve(&srs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rrs, err := des.Resolve(ctx, &srs)
 	if err != nil {
 		t.Fatalf("resolve: %v", err)
 	}
@@ -51,9 +77,13 @@ func TestSysResolverSubject(t *testing.T) {
 	if !strings.HasSuffix(rrs[0].String(), "dns.google.") {
 		t.Errorf("%s != 8.8.8.8.in-addr.arpa.\t66354\tIN\tPTR\tdns.google.", rrs[0].String())
 	}
-	des.Stop()
+	if err := des.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
 	if len(bounds) != 1 {
-		t.Error("len(bounds) != 1")
+		t.Fatal("len(bounds) != 1")
 	}
 	if bounds[0][0].ResolveTime < time.Millisecond {
 		t.Errorf("bounds[0][0].ResolveTime < time.Millisecond")
@@ -63,9 +93,91 @@ func TestSysResolverSubject(t *testing.T) {
 	}
 }
 
+// blockingSubject resolves until its context is done
+type blockingSubject struct {
+	question dns.Question
+	started  chan bool
+	aborted  chan error
+}
+
+func (bs *blockingSubject) ConnectActiveSubject(as *ActiveSubject) {}
+
+func (bs *blockingSubject) Key() dns.Question {
+	return bs.question
+}
+
+func (bs *blockingSubject) Resolve(ctx context.Context) ([]dns.RR, error) {
+	bs.started <- true
+	<-ctx.Done()
+	bs.aborted <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestDeactivateAbortsResolve(t *testing.T) {
+	zlog := zerolog.Nop()
+	des := NewDnsEventStream(&zlog)
+	if err := des.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	bs := &blockingSubject{
+		question: dns.Question{Name: "block.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		started:  make(chan bool, 1),
+		aborted:  make(chan error, 1),
+	}
+	as, err := des.CreateSubject(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	as.Bind(func(history []*DnsResult) { called = true })
+	activated := make(chan error)
+	go func() {
+		activated <- as.Activate()
+	}()
+	<-bs.started
+	if err := as.Deactivate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-bs.aborted; err != context.Canceled {
+		t.Errorf("canceled expected: %v", err)
+	}
+	if err := <-activated; err != nil {
+		t.Error(err)
+	}
+	if called || len(as.history) != 0 {
+		t.Errorf("an aborted refresh is no result: %v", as.history)
+	}
+
+	// a deadline of Resolve ends the wait for the first answers
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		<-bs.started
+	}()
+	_, err = des.Resolve(ctx, bs)
+	if err != context.DeadlineExceeded {
+		t.Errorf("deadline expected: %v", err)
+	}
+
+	// Stop aborts the refresh and waits for it
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), time.Second)
+	defer stopCancel()
+	if err := des.Stop(stopCtx); err != nil {
+		t.Error(err)
+	}
+	select {
+	case err := <-bs.aborted:
+		if err != context.Canceled {
+			t.Errorf("canceled expected: %v", err)
+		}
+	default:
+		t.Error("the refresh is still running")
+	}
+}
+
 func TestDnsEventStream(t *testing.T) {
 	des := NewDnsEventStream(nil)
-	err := des.Stop()
+	err := des.Stop(context.Background())
 	if err.Error() != "not started" {
 		t.Fatal(err)
 	}
@@ -82,11 +194,11 @@ func TestDnsEventStream(t *testing.T) {
 	if err.Error() != "not started" {
 		t.Fatal(err)
 	}
-	err = des.Start()
+	err = des.Start(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = des.Start()
+	err = des.Start(context.Background())
 	if err.Error() != "already started" {
 		t.Fatal(err)
 	}
@@ -135,11 +247,11 @@ func TestDnsEventStream(t *testing.T) {
 			t.Fatal(err)
 		}
 	}
-	err = des.Stop()
+	err = des.Stop(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = des.Stop()
+	err = des.Stop(context.Background())
 	if err.Error() != "not started" {
 		t.Fatal(err)
 	}
@@ -365,7 +477,7 @@ func (ts *testSubject) Key() dns.Question {
 	return ts.question
 }
 
-func (ts *testSubject) Resolve() ([]dns.RR, error) {
+func (ts *testSubject) Resolve(ctx context.Context) ([]dns.RR, error) {
 	// ts.ensureLog().Debug().Msgf("resolve %d/%d", ts.calls.resolve, ts.calls.resolve/3)
 	ttl := 10
 	if ts.doTtl {
@@ -396,8 +508,9 @@ func TestActiveResolve(t *testing.T) {
 		},
 	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer as.dnsEventStream.scheduler().Stop(context.Background())
 
 	var bound []*DnsResult
 	as.Bind(func(history []*DnsResult) {
@@ -432,11 +545,14 @@ func TestActiveResolve(t *testing.T) {
 	}
 }
 
+// mockTime is a clock which advances by the delays, a delay waits for
+// releaseDelay and after sleepAfter delays only for the cancel
 type mockTime struct {
 	sleepAfter int
 	sysTime    sysTime
 
-	nows         []time.Time
+	lock         sync.Mutex
+	now          time.Time
 	sleeps       []time.Duration
 	releaseDelay chan int
 	sleepWait    sync.WaitGroup
@@ -446,6 +562,7 @@ func newMockTime(mt *mockTime) *mockTime {
 	rt := mockTime{
 		sleepAfter: mt.sleepAfter,
 		sysTime:    mt.sysTime,
+		now:        time.Unix(1000, 0),
 	}
 	rt.sleepWait = sync.WaitGroup{}
 	rt.sleepWait.Add(1)
@@ -454,21 +571,33 @@ func newMockTime(mt *mockTime) *mockTime {
 }
 
 func (mt *mockTime) Now() time.Time {
-	if mt.nows == nil {
-		mt.nows = []time.Time{}
-	}
-	mt.nows = append(mt.nows, time.Now())
-	return mt.nows[len(mt.nows)-1]
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	return mt.now
+}
+
+func (mt *mockTime) Sleeps() []time.Duration {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	out := make([]time.Duration, len(mt.sleeps))
+	copy(out, mt.sleeps)
+	return out
 }
 
 func (mt *mockTime) Delay(ctx context.Context, d time.Duration) error {
-	if mt.sleeps == nil {
-		mt.sleeps = []time.Duration{}
-	}
+	mt.lock.Lock()
 	mt.sleeps = append(mt.sleeps, d)
-	<-mt.releaseDelay
-	// mt.delayCalled <- len(mt.sleeps)
-	if len(mt.sleeps) >= mt.sleepAfter {
+	sleeps := len(mt.sleeps)
+	mt.lock.Unlock()
+	select {
+	case <-mt.releaseDelay:
+	case <-ctx.Done():
+		return fmt.Errorf("Interrupted")
+	}
+	mt.lock.Lock()
+	mt.now = mt.now.Add(d)
+	mt.lock.Unlock()
+	if sleeps >= mt.sleepAfter {
 		mt.sleepWait.Done()
 		return mt.sysTime.Delay(ctx, time.Hour)
 	}
@@ -527,8 +656,9 @@ func TestActiveBind(t *testing.T) {
 		},
 	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer as.dnsEventStream.scheduler().Stop(context.Background())
 
 	bounds := [][]*DnsResult{}
 	as.Bind(func(history []*DnsResult) {
@@ -574,19 +704,27 @@ func TestActiveBind(t *testing.T) {
 			}
 		}
 	}
-	if len(mockTime.nows) != 10 {
-		t.Errorf("nows should be 10: %v", len(mockTime.nows))
+	sleeps := mockTime.Sleeps()
+	if len(sleeps) != 10 {
+		t.Errorf("sleeps should be 10: %v", len(sleeps))
 	}
-	if len(mockTime.sleeps) != 10 {
-		t.Errorf("sleeps should be 10: %v", len(mockTime.sleeps))
+	// every refresh happens when the previous one is due
+	created := time.Unix(1000, 0)
+	for i, b := range bounds {
+		if !b[0].Created.Equal(created) {
+			t.Errorf("refresh %d at %v not %v", i, b[0].Created, created)
+		}
+		if i < len(sleeps) {
+			created = created.Add(sleeps[i])
+		}
 	}
-	if !reflect.DeepEqual(mockTime.sleeps, []time.Duration{
+	if !reflect.DeepEqual(sleeps, []time.Duration{
 		3 * time.Second, 3 * time.Second, 3 * time.Second,
 		4 * time.Second,
 		5 * time.Second,
 		6 * time.Second,
 		7 * time.Second, 7 * time.Second, 7 * time.Second, 7 * time.Second}) {
-		t.Errorf("nows should not be same: %v:%v", mockTime.sleeps, mockTime.sleeps)
+		t.Errorf("nows should not be same: %v", sleeps)
 	}
 	if ts.calls.resolve != 10 {
 		t.Errorf("calls.resolve should be 10: %v", ts.calls.resolve)
@@ -604,7 +742,7 @@ func TestDnsEventStreamRunning(t *testing.T) {
 	des.waitResolve = 3 * time.Millisecond
 	// des.
 
-	err := des.Start()
+	err := des.Start(context.Background())
 	if err != nil {
 		t.Errorf("err should be nil: %v", err)
 	}
@@ -634,7 +772,7 @@ func TestDnsEventStreamRunning(t *testing.T) {
 		// t.Logf("TestDnsEventStreamRunning:post:%d", called)
 		// var refRrs []dns.RR
 		for i := 0; i < 10; i++ {
-			rrs, err := des.Resolve(&ts)
+			rrs, err := des.Resolve(context.Background(), &ts)
 			if err != nil {
 				t.Errorf("err should be nil: %v", err)
 			}
@@ -646,7 +784,7 @@ func TestDnsEventStreamRunning(t *testing.T) {
 		ptrMockTime.releaseDelay <- 1
 	}
 	ptrMockTime.sleepWait.Wait()
-	des.Stop()
+	des.Stop(context.Background())
 	if !reflect.DeepEqual(out, []string{
 		"test	10	IN	A	0.0.0.0", "test	10	IN	A	0.0.0.0", "test	10	IN	A	0.0.0.0",
 		"test	10	IN	A	1.0.0.0", "test	10	IN	A	1.0.0.0", "test	10	IN	A	1.0.0.0",
@@ -678,3 +816,24 @@ func TestDnsEventStreamRunning(t *testing.T) {
 	}
 
 }
+
+func TestCurrentToActions(t *testing.T) {
+	a1, _ := dns.NewRR("x.com. 10 IN A 192.0.2.1")
+	a2, _ := dns.NewRR("x.com. 10 IN A 192.0.2.2")
+	history := []*DnsResult{
+		{Rrs: []dns.RR{a2}},
+		{Err: fmt.Errorf("timeout")},
+		{Rrs: []dns.RR{a1}},
+	}
+	actions := CurrentToActions(history)
+	if len(actions) != 1 || actions[0].Action != "change" || actions[0].Prev != a1 || actions[0].Current != a2 {
+		t.Errorf("actions: %v", actions)
+	}
+	if len(CurrentToActions(history[1:])) != 0 {
+		t.Errorf("error results have no actions")
+	}
+	actions = CurrentToActions(history[2:])
+	if len(actions) != 1 || actions[0].Action != "newAdd" {
+		t.Errorf("actions: %v", actions)
+	}
+}
@@ -1,6 +1,7 @@
 package dns_event_stream
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -13,18 +14,28 @@ import (
 )
 
 type XSubject struct {
-	Name       string
-	Resolver   resolvers.Resolver
-	LastUpdate time.Time
+	Name        string
+	Resolver    resolvers.Resolver
+	LastUpdate  time.Time
+	Last        resolvers.DNSResult // the addresses which were sent as Update
+	NextResolve time.Time
 }
 
+// DNSObserver resolves its subjects after the ttl of their last result
+// and sends the changed addresses to Results
 type DNSObserver struct {
-	resolver     resolvers.Resolver
-	results      chan resolvers.Result
-	mutexSubject sync.Mutex
-	subjects     map[string]XSubject
-	running      bool
-	logger       *log.Logger
+	MinInterval   time.Duration // default 5s, lower bound of the ttl
+	ErrorInterval time.Duration // default 30s, retry after a failed resolve
+	resolver      resolvers.Resolver
+	results       chan resolvers.Result
+	mutexSubject  sync.Mutex
+	subjects      map[string]XSubject
+	removed       []XSubject // their addresses are sent as Remove
+	runLock       sync.Mutex
+	stop          func() // of the running loop
+	done          chan struct{}
+	tick          time.Duration
+	logger        *log.Logger
 }
 
 func NewDNSObserver(logs ...*log.Logger) (*DNSObserver, error) {
@@ -36,19 +47,30 @@ func NewDNSObserver(logs ...*log.Logger) (*DNSObserver, error) {
 		logger = log.New(os.Stdout, "observer: ", log.LstdFlags)
 	}
 	return &DNSObserver{
-		results:  make(chan resolvers.Result, 16),
-		subjects: make(map[string]XSubject),
-		logger:   logger,
+		MinInterval:   5 * time.Second,
+		ErrorInterval: 30 * time.Second,
+		results:       make(chan resolvers.Result, 16),
+		subjects:      make(map[string]XSubject),
+		tick:          time.Second,
+		logger:        logger,
 	}, nil
 }
 
+// Results has to be read, the observer blocks if the channel is full
+func (o *DNSObserver) Results() <-chan resolvers.Result {
+	return o.results
+}
+
 func (o *DNSObserver) AddSubject(name string, resolver resolvers.Resolver) XSubject {
 	o.mutexSubject.Lock()
 	defer o.mutexSubject.Unlock()
+	// the addresses which were sent are kept to diff the next result
+	last := o.subjects[name].Last
 	o.subjects[name] = XSubject{
 		Name:       name,
 		Resolver:   resolver,
 		LastUpdate: time.Now(),
+		Last:       last,
 	}
 	o.logger.Printf("Added subject %v", o.subjects[name])
 	return o.subjects[name]
@@ -63,6 +85,7 @@ func (o *DNSObserver) RemoveSubject(name string) *XSubject {
 	}
 	o.logger.Printf("Remove subject %v", o.subjects[name])
 	delete(o.subjects, name)
+	o.removed = append(o.removed, ret)
 	return &ret
 }
 
@@ -91,26 +114,119 @@ func (o *DNSObserver) GetSubjects() []XSubject {
 	return subjects
 }
 
-func (o *DNSObserver) Start() error {
-	if o.running {
+// Start resolves the subjects until ctx is done or Stop is called
+func (o *DNSObserver) Start(ctx context.Context) error {
+	o.runLock.Lock()
+	if o.stop != nil {
+		o.runLock.Unlock()
 		return fmt.Errorf("observer already running")
 	}
-	o.running = true
+	ctx, o.stop = context.WithCancel(ctx)
+	done := make(chan struct{})
+	o.done = done
+	o.runLock.Unlock()
 	o.logger.Printf("Starting observer")
-	wait := time.Duration(time.Second)
-	for o.running {
-		subs := o.GetSubjects()
-		o.logger.Printf("Running for %d subjects", len(subs))
-		// for range o.subjects {
-		// }
-		time.Sleep(wait)
+	ticker := time.NewTicker(o.tick)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		o.resolveDue(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
 	}
+	o.runLock.Lock()
+	o.stop()
+	o.stop = nil
+	o.runLock.Unlock()
+	close(done)
 	o.logger.Printf("Stopped observer")
 	return nil
 }
 
-func (o *DNSObserver) Stop() error {
+func (o *DNSObserver) isRunning() bool {
+	o.runLock.Lock()
+	defer o.runLock.Unlock()
+	return o.stop != nil
+}
+
+// resolveDue sends the Remove of the removed subjects and resolves the
+// subjects which are due
+func (o *DNSObserver) resolveDue(ctx context.Context, now time.Time) {
+	o.mutexSubject.Lock()
+	removed := o.removed
+	o.removed = nil
+	due := []XSubject{}
+	for _, subject := range o.subjects {
+		if !subject.NextResolve.After(now) {
+			due = append(due, subject)
+		}
+	}
+	o.mutexSubject.Unlock()
+	sort.Sort(subjectSorted(due))
+	for _, subject := range removed {
+		o.send(ctx, resolvers.Diff(subject.Last, resolvers.DNSResult{}))
+	}
+	for _, subject := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		result, err := subject.Resolver.Resolve(subject.Name)
+		o.mutexSubject.Lock()
+		current, found := o.subjects[subject.Name]
+		if !found {
+			// removed while resolving
+			o.mutexSubject.Unlock()
+			continue
+		}
+		if err != nil {
+			o.logger.Printf("Error resolving %s: %v", subject.Name, err)
+			current.NextResolve = now.Add(o.ErrorInterval)
+			o.subjects[subject.Name] = current
+			o.mutexSubject.Unlock()
+			continue
+		}
+		// the events carry the name of the subject
+		result.Name = subject.Name
+		changes := resolvers.Diff(current.Last, result)
+		interval := result.TTL
+		if interval < o.MinInterval {
+			interval = o.MinInterval
+		}
+		current.Last = result
+		current.LastUpdate = now
+		current.NextResolve = now.Add(interval)
+		o.subjects[subject.Name] = current
+		o.mutexSubject.Unlock()
+		o.send(ctx, changes)
+	}
+}
+
+// send gives up if ctx is done, the results are lost
+func (o *DNSObserver) send(ctx context.Context, results []resolvers.Result) {
+	for _, result := range results {
+		select {
+		case o.results <- result:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop ends the loop of Start and waits for it until ctx is done
+func (o *DNSObserver) Stop(ctx context.Context) error {
+	o.runLock.Lock()
+	stop, done := o.stop, o.done
+	o.runLock.Unlock()
+	if stop == nil {
+		return nil
+	}
 	o.logger.Printf("Stopping observer")
-	o.running = false
-	return nil
+	stop()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
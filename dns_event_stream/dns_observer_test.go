@@ -1,10 +1,17 @@
 package dns_event_stream
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
+	"net/netip"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/mabels/steinstuecken/resolvers"
+	"github.com/mabels/steinstuecken/resolvers/local"
 )
 
 var noLogger = log.New(io.Discard, "noLogger: ", log.LstdFlags)
@@ -21,83 +28,173 @@ func TestStartStop(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	wg := sync.WaitGroup{}
 	wgStop := sync.WaitGroup{}
-	wg.Add(1)
 	wgStop.Add(1)
 	go func() {
-		wg.Done()
-		obs.Start()
+		obs.Start(context.Background())
 		wgStop.Done()
 	}()
-	wg.Wait()
-	if !obs.running {
-		t.Error("Observer not running")
+	for start := time.Now(); !obs.isRunning(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Observer not running")
+		}
+	}
+	if err := obs.Start(context.Background()); err == nil {
+		t.Error("Observer started twice")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := obs.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+	wgStop.Wait()
+	if obs.isRunning() {
+		t.Error("Observer still running")
 	}
-	obs.Stop()
+
+	// the loop ends with the context of Start
+	ctx, cancel = context.WithCancel(context.Background())
+	wgStop.Add(1)
+	go func() {
+		obs.Start(ctx)
+		wgStop.Done()
+	}()
+	cancel()
 	wgStop.Wait()
-	if obs.running {
+	if obs.isRunning() {
 		t.Error("Observer still running")
 	}
 }
 
-// func TestSubjects(t *testing.T) {
-// 	obs, err := NewDNSObserver()
-// 	if err != nil {
-// 		t.Error(err)
-// 	}
-// 	subs := obs.GetSubjects()
-// 	if len(subs) != 0 {
-// 		t.Errorf("Subjects not right:%d", len(subs))
-// 	}
-// 	for i := 0; i < 10; i++ {
-// 		for j := 0; j < 10; j++ {
-// 			domain := fmt.Sprintf("www%d.adviser.com", i)
-// 			sub := obs.AddSubject(domain, &local.LocalResolver{})
-// 			if sub.Name != domain {
-// 				t.Error("Subject name not set")
-// 			}
-// 			_, ok := sub.Resolver.(*local.LocalResolver)
-// 			if !ok {
-// 				t.Error("Subject resolver not set")
-// 			}
-// 			subs = obs.GetSubjects()
-// 			if len(subs) != i+1 {
-// 				t.Errorf("Subject not added:%d:%d", len(subs), i)
-// 			}
-// 			if subs[i].Name != domain {
-// 				t.Error("Subject name not set", subs[i].Name, domain)
-// 			}
-// 		}
-// 	}
-// 	subs = obs.GetSubjects()
-// 	if len(subs) != 10 {
-// 		t.Errorf("Subjects not right:%d", len(subs))
-// 	}
-// 	sub := obs.RemoveSubject("notexisting")
-// 	if sub != nil {
-// 		t.Error("Subject removed")
-// 	}
-// 	for i := 0; i < 10; i++ {
-// 		domain := fmt.Sprintf("www%d.adviser.com", i)
-// 		sub := obs.RemoveSubject(domain)
-// 		if sub == nil {
-// 			t.Error("Subject not removed")
-// 		}
-// 		if sub.Name != domain {
-// 			t.Error("Subject name not set")
-// 		}
-// 		sub = obs.RemoveSubject(domain)
-// 		if sub != nil {
-// 			t.Error("Subject removed")
-// 		}
-// 		subs = obs.GetSubjects()
-// 		if len(subs) != 9-i {
-// 			t.Errorf("Subject not removed:%d:%d", len(subs), i)
-// 		}
-// 	}
-// 	subs = obs.GetSubjects()
-// 	if len(subs) != 0 {
-// 		t.Errorf("Subjects not empty:%d", len(subs))
-// 	}
-// }
+type fakeResolver struct {
+	results []resolvers.DNSResult
+	calls   int
+}
+
+func (r *fakeResolver) Resolve(name string) (resolvers.DNSResult, error) {
+	r.calls++
+	if len(r.results) == 0 {
+		return resolvers.DNSResult{}, fmt.Errorf("no result")
+	}
+	result := r.results[0]
+	r.results = r.results[1:]
+	return result, nil
+}
+
+func TestObserverResults(t *testing.T) {
+	obs, _ := NewDNSObserver(noLogger)
+	a1 := netip.MustParseAddr("192.0.2.1")
+	a2 := netip.MustParseAddr("192.0.2.2")
+	a6 := netip.MustParseAddr("2001:db8::1")
+	fr := &fakeResolver{results: []resolvers.DNSResult{
+		{A: []netip.Addr{a1}, AAAA: []netip.Addr{a6}, TTL: time.Minute},
+		{A: []netip.Addr{a2}, AAAA: []netip.Addr{a6}, TTL: time.Second},
+	}}
+	obs.AddSubject("www.example.com", fr)
+	now := time.Unix(1000, 0)
+	obs.resolveDue(context.Background(), now)
+	expected := []resolvers.Result{
+		{Action: resolvers.Update, Name: "www.example.com", Type: resolvers.A, Addr: a1},
+		{Action: resolvers.Update, Name: "www.example.com", Type: resolvers.AAAA, Addr: a6},
+	}
+	for _, e := range expected {
+		if r := <-obs.Results(); r != e {
+			t.Errorf("%v != %v", r, e)
+		}
+	}
+	obs.resolveDue(context.Background(), now.Add(59*time.Second))
+	if fr.calls != 1 {
+		t.Errorf("resolved before the ttl: %d", fr.calls)
+	}
+	now = now.Add(time.Minute)
+	obs.resolveDue(context.Background(), now)
+	expected = []resolvers.Result{
+		{Action: resolvers.Update, Name: "www.example.com", Type: resolvers.A, Addr: a2},
+		{Action: resolvers.Remove, Name: "www.example.com", Type: resolvers.A, Addr: a1},
+	}
+	for _, e := range expected {
+		if r := <-obs.Results(); r != e {
+			t.Errorf("%v != %v", r, e)
+		}
+	}
+	// the ttl of 1s is raised to MinInterval, errors keep the addresses
+	obs.resolveDue(context.Background(), now.Add(obs.MinInterval))
+	if fr.calls != 3 || len(obs.results) != 0 {
+		t.Errorf("error: %d %d", fr.calls, len(obs.results))
+	}
+	if obs.GetSubjects()[0].NextResolve != now.Add(obs.MinInterval+obs.ErrorInterval) {
+		t.Errorf("retry: %v", obs.GetSubjects()[0].NextResolve)
+	}
+	obs.RemoveSubject("www.example.com")
+	obs.resolveDue(context.Background(), now)
+	expected = []resolvers.Result{
+		{Action: resolvers.Remove, Name: "www.example.com", Type: resolvers.A, Addr: a2},
+		{Action: resolvers.Remove, Name: "www.example.com", Type: resolvers.AAAA, Addr: a6},
+	}
+	for _, e := range expected {
+		if r := <-obs.Results(); r != e {
+			t.Errorf("%v != %v", r, e)
+		}
+	}
+}
+
+func TestSubjects(t *testing.T) {
+	obs, err := NewDNSObserver(noLogger)
+	if err != nil {
+		t.Error(err)
+	}
+	subs := obs.GetSubjects()
+	if len(subs) != 0 {
+		t.Errorf("Subjects not right:%d", len(subs))
+	}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			domain := fmt.Sprintf("www%d.adviser.com", i)
+			sub := obs.AddSubject(domain, &local.LocalResolver{})
+			if sub.Name != domain {
+				t.Error("Subject name not set")
+			}
+			_, ok := sub.Resolver.(*local.LocalResolver)
+			if !ok {
+				t.Error("Subject resolver not set")
+			}
+			subs = obs.GetSubjects()
+			if len(subs) != i+1 {
+				t.Errorf("Subject not added:%d:%d", len(subs), i)
+			}
+			if subs[i].Name != domain {
+				t.Error("Subject name not set", subs[i].Name, domain)
+			}
+		}
+	}
+	subs = obs.GetSubjects()
+	if len(subs) != 10 {
+		t.Errorf("Subjects not right:%d", len(subs))
+	}
+	sub := obs.RemoveSubject("notexisting")
+	if sub != nil {
+		t.Error("Subject removed")
+	}
+	for i := 0; i < 10; i++ {
+		domain := fmt.Sprintf("www%d.adviser.com", i)
+		sub := obs.RemoveSubject(domain)
+		if sub == nil {
+			t.Error("Subject not removed")
+		}
+		if sub.Name != domain {
+			t.Error("Subject name not set")
+		}
+		sub = obs.RemoveSubject(domain)
+		if sub != nil {
+			t.Error("Subject removed")
+		}
+		subs = obs.GetSubjects()
+		if len(subs) != 9-i {
+			t.Errorf("Subject not removed:%d:%d", len(subs), i)
+		}
+	}
+	subs = obs.GetSubjects()
+	if len(subs) != 0 {
+		t.Errorf("Subjects not empty:%d", len(subs))
+	}
+}
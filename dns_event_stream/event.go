@@ -0,0 +1,134 @@
+package dns_event_stream
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Action is the kind of change between two results of a subject
+type Action string
+
+const (
+	NewAdd = Action("newAdd") // an answer was added
+	Change = Action("change") // an answer replaced the previous one
+	OldDel = Action("oldDel") // an answer is gone
+)
+
+type Family int
+
+const (
+	IPv4 = Family(4)
+	IPv6 = Family(6)
+)
+
+// Address is the prefix of an A or AAAA record or the first CIDR in a TXT
+// record
+type Address struct {
+	Prefix netip.Prefix
+	Family Family
+	TTL    uint32
+}
+
+// String is the address without the length for single addresses
+func (a Address) String() string {
+	if a.Prefix.IsSingleIP() {
+		return a.Prefix.Addr().String()
+	}
+	return a.Prefix.String()
+}
+
+// ParseAddress returns false for records without an address like CNAME
+func ParseAddress(rr dns.RR) (Address, bool) {
+	var ip netip.Addr
+	switch r := rr.(type) {
+	case *dns.A:
+		ip, _ = netip.AddrFromSlice(r.A.To4())
+	case *dns.AAAA:
+		ip, _ = netip.AddrFromSlice(r.AAAA.To16())
+	case *dns.TXT:
+		for _, txt := range r.Txt {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(txt))
+			if err == nil {
+				return newAddress(prefix, rr.Header().Ttl), true
+			}
+		}
+	}
+	if !ip.IsValid() {
+		return Address{}, false
+	}
+	ip = ip.Unmap()
+	return newAddress(netip.PrefixFrom(ip, ip.BitLen()), rr.Header().Ttl), true
+}
+
+func newAddress(prefix netip.Prefix, ttl uint32) Address {
+	family := IPv6
+	if prefix.Addr().Is4() {
+		family = IPv4
+	}
+	return Address{Prefix: prefix, Family: family, TTL: ttl}
+}
+
+// AddressChange is an ActionItem with the parsed addresses, a record
+// without an address is left out
+type AddressChange struct {
+	Action  Action
+	Key     string  // KeySubject of the originating subject
+	Current Address // NewAdd and Change
+	Prev    Address // Change and OldDel
+}
+
+// ToAddressChanges parses the actions, a change to or from a record
+// without an address becomes an add or a delete
+func ToAddressChanges(key string, actions []ActionItem) []AddressChange {
+	out := make([]AddressChange, 0, len(actions))
+	for _, action := range actions {
+		var current, prev Address
+		hasCurrent, hasPrev := false, false
+		if action.Current != nil {
+			current, hasCurrent = ParseAddress(action.Current)
+		}
+		if action.Prev != nil {
+			prev, hasPrev = ParseAddress(action.Prev)
+		}
+		switch {
+		case hasCurrent && hasPrev:
+			if current.Prefix == prev.Prefix {
+				continue
+			}
+			out = append(out, AddressChange{Action: Change, Key: key, Current: current, Prev: prev})
+		case hasCurrent:
+			out = append(out, AddressChange{Action: NewAdd, Key: key, Current: current})
+		case hasPrev:
+			out = append(out, AddressChange{Action: OldDel, Key: key, Prev: prev})
+		}
+	}
+	return out
+}
+
+// Event is published if the answers of a subject changed
+type Event struct {
+	Key      string // KeySubject of the question
+	Question dns.Question
+	Err      error           // the error of the newest result
+	Actions  []ActionItem    // the changes against the previous valid result
+	Changes  []AddressChange // the parsed Actions
+	History  []*DnsResult    // newest first
+}
+
+// NewEvent computes the changes of the newest result in history
+func NewEvent(q dns.Question, history []*DnsResult) Event {
+	key := KeySubject(q)
+	ev := Event{
+		Key:      key,
+		Question: q,
+		Actions:  CurrentToActions(history),
+		History:  history,
+	}
+	if len(history) > 0 {
+		ev.Err = history[0].Err
+	}
+	ev.Changes = ToAddressChanges(key, ev.Actions)
+	return ev
+}
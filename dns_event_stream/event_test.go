@@ -0,0 +1,87 @@
+package dns_event_stream
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseAddress(t *testing.T) {
+	for rr, want := range map[string]string{
+		"a.example.com. 60 IN A 192.0.2.1":                    "192.0.2.1/32",
+		"a.example.com. 60 IN AAAA 2001:db8::1":               "2001:db8::1/128",
+		"a.example.com. 60 IN TXT \"v=spf1\" \"10.0.0.0/8\"":  "10.0.0.0/8",
+		"a.example.com. 60 IN TXT \"2001:db8::/32\"":          "2001:db8::/32",
+		"a.example.com. 60 IN TXT \"no address\" \"1.2.3.4\"": "",
+		"a.example.com. 60 IN CNAME b.example.com.":           "",
+	} {
+		r, err := dns.NewRR(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, found := ParseAddress(r)
+		if want == "" {
+			if found {
+				t.Errorf("%s: no address expected: %v", rr, addr)
+			}
+			continue
+		}
+		if !found || addr.Prefix != netip.MustParsePrefix(want) || addr.TTL != 60 {
+			t.Errorf("%s: %v", rr, addr)
+		}
+		family := IPv4
+		if addr.Prefix.Addr().Is6() {
+			family = IPv6
+		}
+		if addr.Family != family {
+			t.Errorf("%s: family %d", rr, addr.Family)
+		}
+	}
+}
+
+func TestToAddressChanges(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, _ := dns.NewRR(s)
+		return r
+	}
+	a1 := rr("a.example.com. 60 IN A 192.0.2.1")
+	a2 := rr("a.example.com. 30 IN A 192.0.2.2")
+	a1ttl := rr("a.example.com. 10 IN A 192.0.2.1")
+	cname := rr("a.example.com. 60 IN CNAME b.example.com.")
+	changes := ToAddressChanges("a.example.com:IN:A", []ActionItem{
+		{Action: NewAdd, Current: a1},
+		{Action: Change, Current: a2, Prev: a1},
+		{Action: Change, Current: a1ttl, Prev: a1},
+		{Action: Change, Current: a2, Prev: cname},
+		{Action: Change, Current: cname, Prev: a1},
+		{Action: OldDel, Prev: cname},
+	})
+	if len(changes) != 4 {
+		t.Fatalf("changes: %v", changes)
+	}
+	for i, want := range []struct {
+		action        Action
+		current, prev string
+	}{
+		{NewAdd, "192.0.2.1", ""},
+		{Change, "192.0.2.2", "192.0.2.1"},
+		{NewAdd, "192.0.2.2", ""},
+		{OldDel, "", "192.0.2.1"},
+	} {
+		c := changes[i]
+		current, prev := "", ""
+		if c.Current.Prefix.IsValid() {
+			current = c.Current.String()
+		}
+		if c.Prev.Prefix.IsValid() {
+			prev = c.Prev.String()
+		}
+		if c.Action != want.action || current != want.current || prev != want.prev || c.Key != "a.example.com:IN:A" {
+			t.Errorf("change %d: %+v", i, c)
+		}
+	}
+	if changes[1].Current.TTL != 30 {
+		t.Errorf("ttl: %d", changes[1].Current.TTL)
+	}
+}
@@ -0,0 +1,208 @@
+package dns_event_stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FeedFilter selects the prefixes of a provider feed, empty matches all,
+// the values are compared case insensitive
+type FeedFilter struct {
+	Services []string
+	Regions  []string
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Feed is the published ip range document of a provider
+type Feed struct {
+	URL     string
+	Regions bool // the prefixes have a region
+	Parse   func(r io.Reader, filter FeedFilter) ([]Address, error)
+}
+
+var Feeds = map[string]Feed{
+	"aws":    {URL: "https://ip-ranges.amazonaws.com/ip-ranges.json", Regions: true, Parse: ParseAwsFeed},
+	"gcp":    {URL: "https://www.gstatic.com/ipranges/cloud.json", Regions: true, Parse: ParseGcpFeed},
+	"github": {URL: "https://api.github.com/meta", Parse: ParseGithubFeed},
+}
+
+// FeedSource fetches and filters the feed of a provider
+type FeedSource struct {
+	Provider string
+	Filter   FeedFilter
+	URL      string        // default the url of the provider
+	Interval time.Duration // default 1h
+}
+
+func (f *FeedSource) Key() string {
+	query := url.Values{}
+	for _, service := range f.Filter.Services {
+		query.Add("service", service)
+	}
+	for _, region := range f.Filter.Regions {
+		query.Add("region", region)
+	}
+	key := "feed://" + f.Provider
+	if len(query) > 0 {
+		key += "?" + query.Encode()
+	}
+	return key
+}
+
+func (f *FeedSource) Run(ctx context.Context, des *DnsEventStream, update func(addrs []Address, err error)) {
+	feed, found := Feeds[f.Provider]
+	if !found {
+		update(nil, fmt.Errorf("unknown feed %q", f.Provider))
+		return
+	}
+	feedUrl := f.URL
+	if feedUrl == "" {
+		feedUrl = feed.URL
+	}
+	source := &HttpSource{
+		URL:      feedUrl,
+		Interval: f.Interval,
+		Parse: func(r io.Reader) ([]Address, error) {
+			addrs, err := feed.Parse(r, f.Filter)
+			// a misspelled filter would silently install nothing
+			if err == nil && len(addrs) == 0 {
+				err = fmt.Errorf("no prefixes match %s", f.Key())
+			}
+			return addrs, err
+		},
+	}
+	source.Run(ctx, des, update)
+}
+
+func feedAddress(prefix string) (Address, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return Address{}, err
+	}
+	return newAddress(p, 0), nil
+}
+
+// ParseAwsFeed parses ip-ranges.json, the service is like S3 and the
+// region like eu-central-1
+func ParseAwsFeed(r io.Reader, filter FeedFilter) ([]Address, error) {
+	doc := struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		Ipv6Prefixes []struct {
+			Ipv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	addrs := []Address{}
+	add := func(prefix, region, service string) error {
+		if !matchesAny(filter.Services, service) || !matchesAny(filter.Regions, region) {
+			return nil
+		}
+		addr, err := feedAddress(prefix)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+		return nil
+	}
+	for _, p := range doc.Prefixes {
+		if err := add(p.IPPrefix, p.Region, p.Service); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range doc.Ipv6Prefixes {
+		if err := add(p.Ipv6Prefix, p.Region, p.Service); err != nil {
+			return nil, err
+		}
+	}
+	return addrs, nil
+}
+
+// ParseGcpFeed parses cloud.json, the region is the scope like
+// europe-west3 and the service like Google Cloud
+func ParseGcpFeed(r io.Reader, filter FeedFilter) ([]Address, error) {
+	doc := struct {
+		Prefixes []struct {
+			Ipv4Prefix string `json:"ipv4Prefix"`
+			Ipv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	addrs := []Address{}
+	for _, p := range doc.Prefixes {
+		if !matchesAny(filter.Services, p.Service) || !matchesAny(filter.Regions, p.Scope) {
+			continue
+		}
+		for _, prefix := range []string{p.Ipv4Prefix, p.Ipv6Prefix} {
+			if prefix == "" {
+				continue
+			}
+			addr, err := feedAddress(prefix)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// ParseGithubFeed parses the meta api, the services are its lists like
+// actions, hooks or git, the other fields are skipped
+func ParseGithubFeed(r io.Reader, filter FeedFilter) ([]Address, error) {
+	doc := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	services := make([]string, 0, len(doc))
+	for service := range doc {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	addrs := []Address{}
+	for _, service := range services {
+		if !matchesAny(filter.Services, service) {
+			continue
+		}
+		prefixes := []string{}
+		if json.Unmarshal(doc[service], &prefixes) != nil {
+			continue
+		}
+		for _, prefix := range prefixes {
+			// ssh_keys are lists of strings too
+			if addr, err := feedAddress(prefix); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs, nil
+}
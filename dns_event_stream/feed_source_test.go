@@ -0,0 +1,81 @@
+package dns_event_stream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parseSample(t *testing.T, file string, parse func(r io.Reader, filter FeedFilter) ([]Address, error), filter FeedFilter) string {
+	t.Helper()
+	f, err := os.Open("testdata/" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	addrs, err := parse(f, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := []string{}
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return strings.Join(strs, " ")
+}
+
+func TestParseFeeds(t *testing.T) {
+	for _, tc := range []struct {
+		file   string
+		parse  func(r io.Reader, filter FeedFilter) ([]Address, error)
+		filter FeedFilter
+		want   string
+	}{
+		{"aws-ip-ranges.json", ParseAwsFeed, FeedFilter{Services: []string{"s3"}, Regions: []string{"eu-central-1"}},
+			"3.5.136.0/22 52.219.140.0/24 2a05:d050:8000::/40"},
+		{"aws-ip-ranges.json", ParseAwsFeed, FeedFilter{Regions: []string{"eu-west-1"}},
+			"52.219.72.0/22 2a05:d07a:c000::/40"},
+		{"gcp-cloud.json", ParseGcpFeed, FeedFilter{Regions: []string{"europe-west3"}},
+			"34.89.0.0/17 2600:1900:4060::/44"},
+		{"gcp-cloud.json", ParseGcpFeed, FeedFilter{Services: []string{"Google Cloud"}, Regions: []string{"us-central1", "africa-south1"}},
+			"34.1.208.0/20 34.16.0.0/17"},
+		{"github-meta.json", ParseGithubFeed, FeedFilter{Services: []string{"actions"}},
+			"4.148.0.0/16 13.64.0.0/16 2603:1030::/43"},
+		{"github-meta.json", ParseGithubFeed, FeedFilter{},
+			"4.148.0.0/16 13.64.0.0/16 2603:1030::/43 192.30.252.0/22 2a0a:a440::/29 192.30.252.0/22 140.82.112.0/20"},
+	} {
+		if got := parseSample(t, tc.file, tc.parse, tc.filter); got != tc.want {
+			t.Errorf("%s %+v: %s", tc.file, tc.filter, got)
+		}
+	}
+}
+
+func TestFeedSource(t *testing.T) {
+	des := startedStream(t)
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	src := &FeedSource{
+		Provider: "aws",
+		Filter:   FeedFilter{Services: []string{"S3"}, Regions: []string{"eu-central-1"}},
+		URL:      server.URL + "/aws-ip-ranges.json",
+		Interval: time.Hour,
+	}
+	if src.Key() != "feed://aws?region=eu-central-1&service=S3" {
+		t.Errorf("key: %s", src.Key())
+	}
+	ev := nextAddressEvent(t, watch(des, src))
+	if ev.Err != nil || changeStrs(ev.Changes) != "+3.5.136.0/22 +52.219.140.0/24 +2a05:d050:8000::/40" {
+		t.Errorf("feed: %+v", ev)
+	}
+
+	// nothing matches a misspelled service
+	src = &FeedSource{Provider: "github", Filter: FeedFilter{Services: []string{"action"}}, URL: server.URL + "/github-meta.json"}
+	ev = nextAddressEvent(t, watch(des, src))
+	if ev.Err == nil || !strings.Contains(ev.Err.Error(), "no prefixes match feed://github?service=action") {
+		t.Errorf("misspelled: %+v", ev)
+	}
+}
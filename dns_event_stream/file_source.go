@@ -0,0 +1,92 @@
+package dns_event_stream
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// FileSource reads a file with a cidr or address per line, # starts a
+// comment, the file is read again if its modification time or size changed
+type FileSource struct {
+	Path          string
+	CheckInterval time.Duration // default 5s
+}
+
+func (f *FileSource) Key() string {
+	return "file://" + f.Path
+}
+
+func (f *FileSource) Run(ctx context.Context, des *DnsEventStream, update func(addrs []Address, err error)) {
+	interval := f.CheckInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	var modTime time.Time
+	size := int64(-1)
+	for {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			update(nil, err)
+		} else if !info.ModTime().Equal(modTime) || info.Size() != size {
+			addrs, err := f.read()
+			update(addrs, err)
+			if err == nil {
+				modTime = info.ModTime()
+				size = info.Size()
+			}
+		}
+		if des.time().Delay(ctx, interval) != nil || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (f *FileSource) read() ([]Address, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseAddressList(file)
+}
+
+// ParseAddressList parses a cidr or address per line, a broken line fails
+// the whole list
+func ParseAddressList(r io.Reader) ([]Address, error) {
+	addrs := []Address{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if idx := strings.Index(text, "#"); idx >= 0 {
+			text = text[:idx]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		prefix, err := parsePrefixOrAddr(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		addrs = append(addrs, newAddress(prefix, 0))
+	}
+	return addrs, scanner.Err()
+}
+
+func parsePrefixOrAddr(str string) (netip.Prefix, error) {
+	if strings.Contains(str, "/") {
+		return netip.ParsePrefix(str)
+	}
+	addr, err := netip.ParseAddr(str)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,135 @@
+package dns_event_stream
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type forwardedAnswer struct {
+	rr      dns.RR
+	expires time.Time
+}
+
+// ForwardedSubject returns the addresses a dns forwarder handed to its
+// clients until their ttl is expired
+type ForwardedSubject struct {
+	Question      dns.Question
+	MinTTL        time.Duration // default 30s, answers with a lower ttl are kept longer
+	lock          sync.Mutex
+	answers       map[string]forwardedAnswer
+	activeSubject *ActiveSubject
+	now           func() time.Time
+}
+
+func (r *ForwardedSubject) ConnectActiveSubject(as *ActiveSubject) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.activeSubject = as
+}
+
+func (r *ForwardedSubject) Key() dns.Question {
+	return r.Question
+}
+
+func (r *ForwardedSubject) time() time.Time {
+	if r.now == nil {
+		return time.Now()
+	}
+	return r.now()
+}
+
+func (r *ForwardedSubject) minTTL() time.Duration {
+	if r.MinTTL == 0 {
+		return 30 * time.Second
+	}
+	return r.MinTTL
+}
+
+// Observe adds the addresses of the question type, it returns true if
+// an address was not known before
+func (r *ForwardedSubject) Observe(rrs []dns.RR) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.answers == nil {
+		r.answers = make(map[string]forwardedAnswer)
+	}
+	now := r.time()
+	added := false
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != r.Question.Qtype {
+			continue
+		}
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+		default:
+			continue
+		}
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		if ttl < r.minTTL() {
+			ttl = r.minTTL()
+		}
+		key := canonicalStr(rr)
+		expires := now.Add(ttl)
+		prev, found := r.answers[key]
+		if found && !now.After(prev.expires) {
+			// the record is kept to not change the history by a new ttl
+			if expires.After(prev.expires) {
+				prev.expires = expires
+				r.answers[key] = prev
+			}
+			continue
+		}
+		r.answers[key] = forwardedAnswer{rr: rr, expires: expires}
+		added = true
+	}
+	return added
+}
+
+// Authorize observes the answer and refreshes the active subject
+// synchronously if it contains new addresses, the bound functions have
+// installed the addresses when it returns
+func (r *ForwardedSubject) Authorize(rrs []dns.RR) {
+	if !r.Observe(rrs) {
+		return
+	}
+	r.lock.Lock()
+	as := r.activeSubject
+	r.lock.Unlock()
+	if as != nil {
+		as.Refresh()
+	}
+}
+
+// Clear forgets all addresses, the next refresh removes them
+func (r *ForwardedSubject) Clear() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.answers = nil
+}
+
+// Resolve returns copies with the remaining ttl, the next refresh is due
+// when the first address expires
+func (r *ForwardedSubject) Resolve(ctx context.Context) ([]dns.RR, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.time()
+	out := make([]dns.RR, 0, len(r.answers))
+	for key, answer := range r.answers {
+		if now.After(answer.expires) {
+			delete(r.answers, key)
+			continue
+		}
+		rr := dns.Copy(answer.rr)
+		rr.Header().Ttl = uint32((answer.expires.Sub(now) + time.Second - 1) / time.Second)
+		if rr.Header().Ttl == 0 {
+			rr.Header().Ttl = 1
+		}
+		out = append(out, rr)
+	}
+	sort.Slice(out, dnsSort(out))
+	return out, nil
+}
@@ -0,0 +1,63 @@
+package dns_event_stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestForwardedSubject(t *testing.T) {
+	now := time.Unix(1000, 0)
+	fs := &ForwardedSubject{
+		Question: dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		now:      func() time.Time { return now },
+	}
+	des := NewDnsEventStream(nil)
+	as, err := NewActiveSubject(fs, des)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []ActionItem{}
+	as.Bind(func(history []*DnsResult) {
+		actions = append(actions, CurrentToActions(history)...)
+	})
+	err = as.Activate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer as.Deactivate()
+	cname, _ := dns.NewRR("www.example.com. 300 IN CNAME edge.cdn.net.")
+	a1, _ := dns.NewRR("edge.cdn.net. 10 IN A 192.0.2.1")
+	a2, _ := dns.NewRR("edge.cdn.net. 300 IN A 192.0.2.2")
+	aaaa, _ := dns.NewRR("edge.cdn.net. 300 IN AAAA 2001:db8::1")
+	fs.Authorize([]dns.RR{cname, a1, aaaa})
+	// the bound function was called before Authorize returned
+	if len(actions) != 1 || actions[0].Action != "newAdd" || actions[0].Current.(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("actions: %v", actions)
+	}
+	fs.Authorize([]dns.RR{a1})
+	if len(actions) != 1 {
+		t.Errorf("known address should not refresh: %v", actions)
+	}
+	fs.Authorize([]dns.RR{a2})
+	if len(actions) != 2 || actions[1].Current.(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("actions: %v", actions)
+	}
+	// a1 is kept for the min ttl of 30s
+	now = now.Add(31 * time.Second)
+	rrs, _ := fs.Resolve(context.Background())
+	if len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("expired: %v", rrs)
+	}
+	// the ttl counts down to the expiry
+	if rrs[0].Header().Ttl != 269 || a2.Header().Ttl != 300 {
+		t.Errorf("remaining ttl: %d", rrs[0].Header().Ttl)
+	}
+	now = now.Add(268*time.Second + 500*time.Millisecond)
+	rrs, _ = fs.Resolve(context.Background())
+	if len(rrs) != 1 || rrs[0].Header().Ttl != 1 {
+		t.Errorf("remaining ttl: %v", rrs)
+	}
+}
@@ -0,0 +1,113 @@
+package dns_event_stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// HttpSource fetches a json document like the ip ranges of a cloud
+// provider, every string of the document which is a cidr is an address
+type HttpSource struct {
+	URL      string
+	Interval time.Duration                        // default 1h
+	Client   *http.Client                         // default http.DefaultClient
+	Parse    func(r io.Reader) ([]Address, error) // default ParseJsonPrefixes
+	etag     string
+	modified string
+}
+
+func (h *HttpSource) Key() string {
+	return h.URL
+}
+
+func (h *HttpSource) Run(ctx context.Context, des *DnsEventStream, update func(addrs []Address, err error)) {
+	interval := h.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for {
+		addrs, changed, err := h.fetch(ctx)
+		if err != nil || changed {
+			update(addrs, err)
+		}
+		if des.time().Delay(ctx, interval) != nil || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// fetch asks with the etag and last modified of the previous document,
+// an unchanged document is not parsed again
+func (h *HttpSource) fetch(ctx context.Context) ([]Address, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+	if h.modified != "" {
+		req.Header.Set("If-Modified-Since", h.modified)
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("%s: %s", h.URL, res.Status)
+	}
+	parse := h.Parse
+	if parse == nil {
+		parse = ParseJsonPrefixes
+	}
+	addrs, err := parse(res.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", h.URL, err)
+	}
+	h.etag = res.Header.Get("ETag")
+	h.modified = res.Header.Get("Last-Modified")
+	return addrs, true, nil
+}
+
+// ParseJsonPrefixes collects the strings of a json document which are
+// cidrs
+func ParseJsonPrefixes(r io.Reader) ([]Address, error) {
+	var doc interface{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	addrs := []Address{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			for _, item := range val {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range val {
+				walk(item)
+			}
+		case string:
+			if prefix, err := netip.ParsePrefix(val); err == nil {
+				addrs = append(addrs, newAddress(prefix, 0))
+			}
+		}
+	}
+	walk(doc)
+	return addrs, nil
+}
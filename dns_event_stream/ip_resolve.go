@@ -1,6 +1,7 @@
 package dns_event_stream
 
 import (
+	"context"
 	"github.com/miekg/dns"
 )
 
@@ -16,6 +17,6 @@ func (r *FixResolverSubject) Key() dns.Question {
 	return r.Question
 }
 
-func (r *FixResolverSubject) Resolve() ([]dns.RR, error) {
+func (r *FixResolverSubject) Resolve(ctx context.Context) ([]dns.RR, error) {
 	return r.Result, nil
 }
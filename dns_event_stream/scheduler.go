@@ -0,0 +1,208 @@
+package dns_event_stream
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+type scheduled struct {
+	as    *ActiveSubject
+	due   time.Time
+	index int
+}
+
+// refreshQueue is a min-heap of the next refresh times
+type refreshQueue []*scheduled
+
+func (q refreshQueue) Len() int           { return len(q) }
+func (q refreshQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q refreshQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *refreshQueue) Push(x interface{}) {
+	item := x.(*scheduled)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// scheduler refreshes the subjects of a DnsEventStream when they are due,
+// one loop waits for the earliest subject and at most concurrency subjects
+// are refreshed at once
+type scheduler struct {
+	timeIf      timeInterface
+	concurrency int
+	lock        sync.Mutex
+	queue       refreshQueue
+	entries     map[*ActiveSubject]*scheduled
+	running     bool
+	wake        chan struct{}
+	cancelDelay func()
+	stop        func()
+	done        chan struct{}
+}
+
+func newScheduler(timeIf timeInterface, concurrency int) *scheduler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &scheduler{
+		timeIf:      timeIf,
+		concurrency: concurrency,
+		entries:     make(map[*ActiveSubject]*scheduled),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// schedule sets the next refresh of as, the loop is started with the first
+// subject
+func (s *scheduler) schedule(as *ActiveSubject, due time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, found := s.entries[as]
+	if found {
+		entry.due = due
+		heap.Fix(&s.queue, entry.index)
+	} else {
+		entry = &scheduled{as: as, due: due}
+		heap.Push(&s.queue, entry)
+		s.entries[as] = entry
+	}
+	if !s.running {
+		s.start()
+	}
+	if s.queue[0] == entry {
+		s.interrupt()
+	}
+}
+
+// unschedule drops the next refresh of as, a running refresh is finished
+func (s *scheduler) unschedule(as *ActiveSubject) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, found := s.entries[as]
+	if !found {
+		return
+	}
+	delete(s.entries, as)
+	heap.Remove(&s.queue, entry.index)
+}
+
+// interrupt makes the loop look at the queue again, locked
+func (s *scheduler) interrupt() {
+	if s.cancelDelay != nil {
+		s.cancelDelay()
+		s.cancelDelay = nil
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start runs the loop and the workers, locked
+func (s *scheduler) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.running = true
+	s.stop = cancel
+	// a stopped loop may still run when the next one is started
+	done := make(chan struct{})
+	s.done = done
+	jobs := make(chan *ActiveSubject)
+	workers := sync.WaitGroup{}
+	for i := 0; i < s.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for as := range jobs {
+				as.Refresh()
+			}
+		}()
+	}
+	go func() {
+		s.loop(ctx, jobs)
+		close(jobs)
+		workers.Wait()
+		close(done)
+	}()
+}
+
+// due pops the next subject or returns how long to wait for it
+func (s *scheduler) due(ctx context.Context) (*ActiveSubject, time.Duration, context.Context, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.queue) == 0 {
+		return nil, 0, nil, false
+	}
+	wait := s.queue[0].due.Sub(s.timeIf.Now())
+	if wait <= 0 {
+		entry := heap.Pop(&s.queue).(*scheduled)
+		delete(s.entries, entry.as)
+		return entry.as, 0, nil, true
+	}
+	delayCtx, cancel := context.WithCancel(ctx)
+	s.cancelDelay = cancel
+	return nil, wait, delayCtx, true
+}
+
+func (s *scheduler) loop(ctx context.Context, jobs chan<- *ActiveSubject) {
+	for ctx.Err() == nil {
+		as, wait, delayCtx, queued := s.due(ctx)
+		switch {
+		case !queued:
+			select {
+			case <-s.wake:
+			case <-ctx.Done():
+			}
+		case as != nil:
+			select {
+			case jobs <- as:
+			case <-ctx.Done():
+			}
+		default:
+			// interrupted by an earlier subject or the stop
+			_ = s.timeIf.Delay(delayCtx, wait)
+			s.lock.Lock()
+			if s.cancelDelay != nil {
+				s.cancelDelay()
+				s.cancelDelay = nil
+			}
+			s.lock.Unlock()
+		}
+	}
+}
+
+// Stop ends the loop and waits for the running refreshes until ctx is
+// done, the queue is kept and a later schedule starts the loop again
+func (s *scheduler) Stop(ctx context.Context) error {
+	s.lock.Lock()
+	if !s.running {
+		s.lock.Unlock()
+		return nil
+	}
+	s.running = false
+	s.stop()
+	done := s.done
+	s.interrupt()
+	s.lock.Unlock()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
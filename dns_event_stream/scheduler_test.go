@@ -0,0 +1,206 @@
+package dns_event_stream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+// stepTime advances by the delays, with release a delay waits for it
+type stepTime struct {
+	lock    sync.Mutex
+	now     time.Time
+	release chan bool
+}
+
+func (st *stepTime) Now() time.Time {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.now
+}
+
+func (st *stepTime) Delay(ctx context.Context, d time.Duration) error {
+	if st.release != nil {
+		select {
+		case <-st.release:
+		case <-ctx.Done():
+			return fmt.Errorf("Interrupted")
+		}
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.now = st.now.Add(d)
+	return nil
+}
+
+type refreshed struct {
+	name string
+	at   time.Time
+}
+
+// ttlSubject answers with a fixed ttl, resolves after the first wait for
+// the gate
+type ttlSubject struct {
+	name     string
+	ttl      uint32
+	clock    *stepTime
+	resolved chan refreshed
+	gate     chan bool
+	calls    int32
+	running  *int32
+	maxRun   *int32
+}
+
+func (ts *ttlSubject) ConnectActiveSubject(as *ActiveSubject) {}
+
+func (ts *ttlSubject) Key() dns.Question {
+	return dns.Question{Name: ts.name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+}
+
+func (ts *ttlSubject) Resolve(ctx context.Context) ([]dns.RR, error) {
+	if atomic.AddInt32(&ts.calls, 1) > 1 && ts.gate != nil {
+		running := atomic.AddInt32(ts.running, 1)
+		for max := atomic.LoadInt32(ts.maxRun); running > max; max = atomic.LoadInt32(ts.maxRun) {
+			if atomic.CompareAndSwapInt32(ts.maxRun, max, running) {
+				break
+			}
+		}
+		<-ts.gate
+		atomic.AddInt32(ts.running, -1)
+	}
+	if ts.resolved != nil {
+		ts.resolved <- refreshed{name: ts.name, at: ts.clock.Now()}
+	}
+	a := &dns.A{
+		Hdr: dns.RR_Header{Name: ts.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ts.ttl},
+		A:   net.ParseIP("192.0.2.1"),
+	}
+	return []dns.RR{a}, nil
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	zlog := zerolog.Nop()
+	clock := &stepTime{now: time.Unix(1000, 0), release: make(chan bool)}
+	des := &DnsEventStream{log: &zlog, timeIf: clock, concurrency: 1}
+	defer des.scheduler().Stop(context.Background())
+	resolved := make(chan refreshed, 16)
+	subjects := []*ActiveSubject{}
+	for _, ts := range []*ttlSubject{
+		{name: "a.", ttl: 25},
+		{name: "b.", ttl: 7},
+		{name: "c.", ttl: 10},
+	} {
+		ts.clock = clock
+		ts.resolved = resolved
+		as, err := NewActiveSubject(ts, des)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := as.Activate(); err != nil {
+			t.Fatal(err)
+		}
+		<-resolved
+		subjects = append(subjects, as)
+	}
+	expected := []string{"b.@7", "c.@10", "b.@14", "c.@20", "b.@21", "a.@25", "b.@28", "c.@30"}
+	for i, want := range expected {
+		clock.release <- true
+		select {
+		case r := <-resolved:
+			got := fmt.Sprintf("%s@%d", r.name, r.at.Unix()-1000)
+			if got != want {
+				t.Errorf("refresh %d: %s != %s", i, got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("refresh %d not done", i)
+		}
+	}
+	for _, as := range subjects {
+		if err := as.Deactivate(); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(des.scheduler().entries) != 0 || des.scheduler().queue.Len() != 0 {
+		t.Errorf("deactivated subjects are scheduled")
+	}
+}
+
+func TestSchedulerConcurrency(t *testing.T) {
+	zlog := zerolog.Nop()
+	clock := &stepTime{now: time.Unix(1000, 0)}
+	des := &DnsEventStream{log: &zlog, timeIf: clock, concurrency: 2}
+	gate := make(chan bool)
+	var running, maxRun int32
+	subjects := []*ttlSubject{}
+	actives := []*ActiveSubject{}
+	for i := 0; i < 5; i++ {
+		ts := &ttlSubject{name: fmt.Sprintf("s%d.", i), ttl: 10, clock: clock, gate: gate, running: &running, maxRun: &maxRun}
+		as, err := NewActiveSubject(ts, des)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := as.Activate(); err != nil {
+			t.Fatal(err)
+		}
+		subjects = append(subjects, ts)
+		actives = append(actives, as)
+	}
+	for atomic.LoadInt32(&running) < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&maxRun) != 2 {
+		t.Errorf("2 refreshes at once expected: %d", maxRun)
+	}
+	for _, as := range actives {
+		as.Deactivate()
+	}
+	close(gate)
+	des.scheduler().Stop(context.Background())
+	refreshes := int32(0)
+	for _, ts := range subjects {
+		refreshes += atomic.LoadInt32(&ts.calls)
+	}
+	// the waiting subjects were dropped by the deactivation
+	if refreshes < 7 || refreshes > 10 {
+		t.Errorf("refreshes: %d", refreshes)
+	}
+}
+
+func TestSchedulerRestart(t *testing.T) {
+	zlog := zerolog.Nop()
+	clock := &stepTime{now: time.Unix(1000, 0)}
+	des := &DnsEventStream{log: &zlog, timeIf: clock, concurrency: 1}
+	gate := make(chan bool)
+	var running, maxRun int32
+	ts := &ttlSubject{name: "a.", ttl: 10, clock: clock, gate: gate, running: &running, maxRun: &maxRun}
+	as, err := NewActiveSubject(ts, des)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := as.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt32(&running) < 1 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// the refresh outlives the stop, a new loop is started meanwhile
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := des.scheduler().Stop(ctx); err == nil {
+		t.Fatal("the stop should time out")
+	}
+	des.scheduler().schedule(as, clock.Now())
+	as.Deactivate()
+	close(gate)
+	if err := des.scheduler().Stop(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,163 @@
+package dns_event_stream
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// OverflowPolicy decides what happens to an event if the buffer of a
+// subscription is full
+type OverflowPolicy int
+
+const (
+	Block      OverflowPolicy = iota // the refresh waits for the consumer
+	DropNewest                       // the event is dropped
+	DropOldest                       // the oldest buffered event is dropped
+)
+
+type SubscribeOptions struct {
+	Buffer int // default 16
+	Policy OverflowPolicy
+}
+
+// Subscription delivers the events on a channel, the consumer runs in its
+// own goroutine and does not hold up the resolving
+type Subscription struct {
+	id      string
+	events  chan Event
+	policy  OverflowPolicy
+	lock    sync.Mutex // sending and closing
+	closed  bool
+	done    chan struct{}
+	once    sync.Once
+	dropped int
+	hub     *hub
+	release func() // of a shared subject
+}
+
+// Events is closed by Close, the deactivation of the subject or the stop of
+// the stream
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped counts the events lost by the drop policies
+func (s *Subscription) Dropped() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+func (s *Subscription) Close() {
+	s.hub.remove(s.id)
+	s.close()
+	s.lock.Lock()
+	release := s.release
+	s.release = nil
+	s.lock.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
+func (s *Subscription) close() {
+	// a blocked send gives up before the channel is closed
+	s.once.Do(func() { close(s.done) })
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
+
+func (s *Subscription) send(ev Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	switch s.policy {
+	case DropNewest:
+		select {
+		case s.events <- ev:
+		default:
+			s.dropped++
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.events <- ev:
+				return
+			default:
+			}
+			select {
+			case <-s.events:
+				s.dropped++
+			default:
+			}
+		}
+	default:
+		select {
+		case s.events <- ev:
+		case <-s.done:
+		}
+	}
+}
+
+// hub holds the subscriptions of a subject or a stream
+type hub struct {
+	lock          sync.Mutex
+	subscriptions map[string]*Subscription
+}
+
+func (h *hub) subscribe(opts SubscribeOptions) *Subscription {
+	buffer := opts.Buffer
+	if buffer <= 0 {
+		buffer = 16
+	}
+	s := &Subscription{
+		id:     uuid.NewString(),
+		events: make(chan Event, buffer),
+		policy: opts.Policy,
+		done:   make(chan struct{}),
+		hub:    h,
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.subscriptions == nil {
+		h.subscriptions = make(map[string]*Subscription)
+	}
+	h.subscriptions[s.id] = s
+	return s
+}
+
+func (h *hub) remove(id string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.subscriptions, id)
+}
+
+func (h *hub) publish(ev Event) {
+	h.lock.Lock()
+	subscriptions := make([]*Subscription, 0, len(h.subscriptions))
+	for _, s := range h.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	h.lock.Unlock()
+	for _, s := range subscriptions {
+		s.send(ev)
+	}
+}
+
+// closeAll ends the subscriptions
+func (h *hub) closeAll() {
+	h.lock.Lock()
+	subscriptions := h.subscriptions
+	h.subscriptions = nil
+	h.lock.Unlock()
+	for _, s := range subscriptions {
+		s.close()
+	}
+}
@@ -0,0 +1,137 @@
+package dns_event_stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-sub.Events():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestSubscribe(t *testing.T) {
+	zlog := zerolog.Nop()
+	des := NewDnsEventStream(&zlog)
+	if err := des.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	all := des.Subscribe(SubscribeOptions{})
+	a1, _ := dns.NewRR("www.example.com. 3600 IN A 192.0.2.1")
+	a2, _ := dns.NewRR("www.example.com. 3600 IN A 192.0.2.2")
+	fix := &FixResolverSubject{
+		Question: dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		Result:   []dns.RR{a1},
+	}
+	as, err := des.CreateSubject(fix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := as.Subscribe(SubscribeOptions{Buffer: 4})
+	if err := as.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Subscription{sub, all} {
+		ev := nextEvent(t, s)
+		if ev.Key != "www.example.com:IN:A" || len(ev.History) != 1 {
+			t.Errorf("event: %+v", ev)
+		}
+		if len(ev.Actions) != 1 || ev.Actions[0].Action != NewAdd || ev.Actions[0].Current != a1 {
+			t.Errorf("actions: %v", ev.Actions)
+		}
+		if len(ev.Changes) != 1 || ev.Changes[0].Current.String() != "192.0.2.1" || ev.Changes[0].Current.Family != IPv4 {
+			t.Errorf("changes: %v", ev.Changes)
+		}
+	}
+
+	// unchanged answers are no event
+	as.Refresh()
+	fix.Result = []dns.RR{a2}
+	as.Refresh()
+	ev := nextEvent(t, sub)
+	if len(ev.History) != 2 || len(ev.Actions) != 1 || ev.Actions[0].Action != Change || ev.Actions[0].Prev != a1 {
+		t.Errorf("change: %+v", ev)
+	}
+	select {
+	case ev := <-sub.Events():
+		t.Errorf("unexpected event: %+v", ev)
+	default:
+	}
+
+	if err := as.Deactivate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-sub.Events(); ok {
+		t.Error("the subscription ends with the deactivation")
+	}
+	nextEvent(t, all)
+	if err := des.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-all.Events(); ok {
+		t.Error("the subscription ends with the stop")
+	}
+}
+
+func TestSubscriptionPolicies(t *testing.T) {
+	h := hub{}
+	newest := h.subscribe(SubscribeOptions{Buffer: 1, Policy: DropNewest})
+	oldest := h.subscribe(SubscribeOptions{Buffer: 1, Policy: DropOldest})
+	for _, key := range []string{"1", "2", "3"} {
+		h.publish(Event{Key: key})
+	}
+	if ev := <-newest.Events(); ev.Key != "1" || newest.Dropped() != 2 {
+		t.Errorf("drop newest: %s %d", ev.Key, newest.Dropped())
+	}
+	if ev := <-oldest.Events(); ev.Key != "3" || oldest.Dropped() != 2 {
+		t.Errorf("drop oldest: %s %d", ev.Key, oldest.Dropped())
+	}
+	newest.Close()
+	oldest.Close()
+
+	blocking := h.subscribe(SubscribeOptions{Buffer: 1})
+	h.publish(Event{Key: "1"})
+	published := make(chan bool)
+	go func() {
+		h.publish(Event{Key: "2"})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("block does not wait for the consumer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if ev := <-blocking.Events(); ev.Key != "1" {
+		t.Errorf("block: %s", ev.Key)
+	}
+	<-published
+	go func() {
+		h.publish(Event{Key: "3"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// a blocked publisher is released by Close
+	blocking.Close()
+	keys := []string{}
+	for ev := range blocking.Events() {
+		keys = append(keys, ev.Key)
+	}
+	if len(keys) != 1 || keys[0] != "2" || blocking.Dropped() != 0 {
+		t.Errorf("buffered: %v", keys)
+	}
+	if len(h.subscriptions) != 0 {
+		t.Errorf("closed subscriptions are kept: %v", h.subscriptions)
+	}
+}
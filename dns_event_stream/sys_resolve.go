@@ -1,48 +1,45 @@
 package dns_event_stream
 
 import (
-	"bufio"
+	"context"
 	"net"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mabels/steinstuecken/resolvers"
+	"github.com/mabels/steinstuecken/resolvers/local"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog"
 )
 
 type SysResolverSubject struct {
 	NameServers   []string
+	Authority     *local.Authority // asks the authoritative nameservers instead of NameServers
 	Log           *zerolog.Logger
-	ResolvConf    *string
+	ResolvConf    *string           // default /etc/resolv.conf, shared by the subjects and reloaded on change
+	Search        bool              // expand the single label Question.Name with the search domains
+	Engine        *resolvers.Engine // default resolvers.DefaultEngine
 	Timeout       time.Duration
 	Question      dns.Question
 	activeSubject *ActiveSubject
 	request       int
-}
-
-func append53(addr string) (string, int, error) {
-	host, portStr, err := net.SplitHostPort(addr)
-	if err != nil && !strings.HasSuffix(err.Error(), "missing port in address") {
-		return "", 0, err
-	} else {
-		host = addr
-	}
-	port := 53
-	if portStr != "" {
-		my, err := strconv.Atoi(portStr)
-		if err != nil {
-			return "", 0, err
-		}
-		port = my
-	}
-	return host, port, nil
+	unwatch       func()
 }
 
 func (r *SysResolverSubject) ConnectActiveSubject(as *ActiveSubject) {
 	r.activeSubject = as
+	// the answer of the other address family was received with ours
+	r.unwatch = r.engine().Watch(r.Question, as.Trigger)
+}
+
+// DisconnectActiveSubject ends the watch of the released subject
+func (r *SysResolverSubject) DisconnectActiveSubject(as *ActiveSubject) {
+	if r.unwatch != nil {
+		r.unwatch()
+		r.unwatch = nil
+	}
 }
 
 func (r *SysResolverSubject) Key() dns.Question {
@@ -70,80 +67,144 @@ func (r *SysResolverSubject) ensureLog() *zerolog.Logger {
 	return r.Log
 }
 
-var reSpace = regexp.MustCompile(`\s+`)
+func (r *SysResolverSubject) resolvConf() (*resolvers.ResolvConf, error) {
+	path := ""
+	if r.ResolvConf != nil {
+		path = *r.ResolvConf
+	}
+	return resolvers.SharedResolvConf(path).Get()
+}
 
-func (r *SysResolverSubject) readResolvConf() ([]string, error) {
-	if r.ResolvConf == nil {
-		resolvConfFile := "/etc/resolv.conf"
-		r.ResolvConf = &resolvConfFile
+func (r *SysResolverSubject) names(rc *resolvers.ResolvConf) []string {
+	if !r.Search {
+		return []string{r.Question.Name}
 	}
+	return rc.Names(strings.TrimSuffix(r.Question.Name, "."))
+}
 
-	resolvFile, err := os.Open(*r.ResolvConf)
+// Names returns the names asked for the question, with Search the
+// expansions of the current resolv.conf which clients ask for too
+func (r *SysResolverSubject) Names() []string {
+	if !r.Search {
+		return []string{r.Question.Name}
+	}
+	rc, err := r.resolvConf()
 	if err != nil {
-		return nil, err
+		return []string{r.Question.Name}
 	}
-	defer resolvFile.Close()
-	fileScanner := bufio.NewScanner(resolvFile)
-	fileScanner.Split(bufio.ScanLines)
-	out := make([]string, 0)
-	for fileScanner.Scan() {
-		line := strings.TrimSpace(fileScanner.Text())
-		tokens := reSpace.Split(line, -1)
-		if len(tokens) > 1 {
-			if tokens[0] == "nameserver" {
-				out = append(out, tokens[1])
+	return r.names(rc)
+}
+
+// nameservers returns the servers in the order to ask them, the
+// nameserver= of the target are used round robin
+func (r *SysResolverSubject) nameservers(rc *resolvers.ResolvConf) ([]string, error) {
+	servers := []string{}
+	rotate := true
+	if len(r.NameServers) > 0 {
+		for _, ns := range r.NameServers {
+			host, port, err := resolvers.SplitNameserver(ns)
+			if err != nil {
+				return nil, err
 			}
+			servers = append(servers, net.JoinHostPort(host, strconv.Itoa(port)))
 		}
+	} else {
+		servers = rc.Nameservers
+		rotate = rc.Rotate
 	}
-	if len(out) == 0 {
-		out = []string{"127.0.0.1", "[::1]"}
+	if !rotate {
+		return servers, nil
 	}
-	return out, nil
+	start := r.request % len(servers)
+	return append(append([]string{}, servers[start:]...), servers[:start]...), nil
 }
 
-func (r *SysResolverSubject) Resolve() ([]dns.RR, error) {
-	port := 53
-	r.request++
-	var ip string
-	if len(r.NameServers) == 0 {
-		var err error
-		r.ensureLog().Info().Msg("reading resolv.conf")
-		r.NameServers, err = r.readResolvConf()
-		if err != nil {
-			return nil, err
-		}
+func (r *SysResolverSubject) engine() *resolvers.Engine {
+	if r.Engine == nil {
+		return resolvers.DefaultEngine
 	}
-	var err error
-	ip, port, err = append53(r.NameServers[r.request%len(r.NameServers)])
-	if err != nil {
-		return nil, err
-	}
-	r.ensureLog().Debug().Str("ip", ip).Int("port", port).Strs("nameservers", r.NameServers).Msg("using nameserver")
+	return r.Engine
+}
 
-	c := dns.Client{
-		Dialer: &net.Dialer{
-			Timeout: r.defaultTimeout(),
-		},
+// exchange asks the servers in order for attempts rounds until one answers
+func (r *SysResolverSubject) exchange(ctx context.Context, servers []string, timeout time.Duration, attempts int, question dns.Question) (*dns.Msg, error) {
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		for _, server := range servers {
+			start := time.Now()
+			in, err := r.engine().Exchange(ctx, server, question, timeout)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				r.ensureLog().Error().
+					Str("dns_server", server).
+					Str("name", question.Name).
+					Str("type", dns.TypeToString[question.Qtype]).
+					Str("class", dns.ClassToString[question.Qclass]).
+					Err(err).Msg("exchange")
+				lastErr = err
+				continue
+			}
+			r.ensureLog().Debug().Str("name", question.Name).
+				Str("dns_server", server).
+				Str("type", dns.TypeToString[question.Qtype]).
+				Str("class", dns.ClassToString[question.Qclass]).
+				Dur("rtt", time.Since(start)).Msg("request")
+			return in, nil
+		}
 	}
-	m1 := dns.Msg{}
-	m1.Id = dns.Id()
-	m1.RecursionDesired = true
-	m1.Question = []dns.Question{r.Question}
-	in, rtt, err := c.Exchange(&m1, net.JoinHostPort(ip, strconv.Itoa(port)))
+	return nil, lastErr
+}
+
+// resolveAuthoritative returns the answers of the authoritative nameservers
+func (r *SysResolverSubject) resolveAuthoritative(ctx context.Context) ([]dns.RR, error) {
+	res, err := r.Authority.Exchange(ctx, r.Question.Name, r.Question.Qtype)
 	if err != nil {
 		r.ensureLog().Error().
-			Str("dns_server", net.JoinHostPort(ip, strconv.Itoa(port))).
 			Str("name", r.Question.Name).
 			Str("type", dns.TypeToString[r.Question.Qtype]).
-			Str("class", dns.ClassToString[r.Question.Qclass]).
-			Err(err).Msg("exchange")
+			Err(err).Msg("authoritative exchange")
 		return nil, err
 	}
+	return res.Answer, nil
+}
 
-	r.ensureLog().Debug().Str("name", r.Question.Name).
-		Str("type", dns.TypeToString[r.Question.Qtype]).
-		Str("class", dns.ClassToString[r.Question.Qclass]).
-		Dur("rtt", rtt).Err(err).Msg("request")
-
-	return in.Answer, nil
+func (r *SysResolverSubject) Resolve(ctx context.Context) ([]dns.RR, error) {
+	if r.Authority != nil {
+		return r.resolveAuthoritative(ctx)
+	}
+	r.request++
+	rc, err := r.resolvConf()
+	if err != nil {
+		if len(r.NameServers) == 0 {
+			return nil, err
+		}
+		// the nameservers of the target work without resolv.conf
+		rc = &resolvers.ResolvConf{Ndots: 1, Attempts: 1}
+	}
+	servers, err := r.nameservers(rc)
+	if err != nil {
+		return nil, err
+	}
+	timeout := rc.Timeout
+	attempts := rc.Attempts
+	if len(r.NameServers) > 0 || r.Timeout != 0 {
+		timeout = r.defaultTimeout()
+	}
+	var answers []dns.RR
+	for _, name := range r.names(rc) {
+		question := r.Question
+		question.Name = name
+		in, err := r.exchange(ctx, servers, timeout, attempts, question)
+		if err != nil {
+			return nil, err
+		}
+		answers = in.Answer
+		// like the libc resolver the next name is tried without answers
+		if in.Rcode == dns.RcodeSuccess && len(answers) > 0 {
+			break
+		}
+	}
+	return answers, nil
 }
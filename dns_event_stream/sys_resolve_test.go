@@ -0,0 +1,88 @@
+package dns_event_stream
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+func TestSysResolverSubjectSearch(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asked := make(chan string, 8)
+	started := make(chan bool)
+	server := &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) }}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		// the engine asks AAAA with A
+		if req.Question[0].Qtype == dns.TypeA {
+			asked <- req.Question[0].Name
+		}
+		res := dns.Msg{}
+		res.SetReply(req)
+		if req.Question[0].Name == "db.corp.example.com." {
+			a, _ := dns.NewRR("db.corp.example.com. 60 IN A 192.0.2.1")
+			res.Answer = []dns.RR{a}
+		} else {
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(&res)
+	})
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	err = os.WriteFile(resolvConf, []byte("nameserver "+pc.LocalAddr().String()+"\nsearch other.example.com corp.example.com\noptions timeout:1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zlog := zerolog.Nop()
+	srs := SysResolverSubject{
+		Log:        &zlog,
+		ResolvConf: &resolvConf,
+		Search:     true,
+		Question:   dns.Question{Name: "db.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	rrs, err := srs.Resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("answers: %v", rrs)
+	}
+	for _, expected := range []string{"db.other.example.com.", "db.corp.example.com."} {
+		select {
+		case name := <-asked:
+			if name != expected {
+				t.Errorf("%s != %s", name, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not asked", expected)
+		}
+	}
+
+	if names := srs.Names(); !reflect.DeepEqual(names, []string{"db.other.example.com.", "db.corp.example.com.", "db."}) {
+		t.Errorf("names: %v", names)
+	}
+
+	srs.Search = false
+	if names := srs.Names(); !reflect.DeepEqual(names, []string{"db."}) {
+		t.Errorf("absolute names: %v", names)
+	}
+	rrs, err = srs.Resolve(context.Background())
+	if err != nil || len(rrs) != 0 {
+		t.Errorf("absolute name: %v %v", rrs, err)
+	}
+	if name := <-asked; name != "db." {
+		t.Errorf("absolute name asked: %s", name)
+	}
+}
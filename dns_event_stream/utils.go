@@ -64,7 +64,8 @@ func CurrentToActions(dnsrr []*DnsResult) []ActionItem {
 	if dnsrr[0].Err != nil {
 		return []ActionItem{}
 	}
-	last := NewestValidHistory(dnsrr)
+	// compare with the previous valid result, not with the current one
+	last := NewestValidHistory(dnsrr[1:])
 	return ToActions(dnsrr[0].Rrs, last.Rrs)
 }
 
@@ -96,7 +97,7 @@ func ToActions(new, old []dns.RR) []ActionItem {
 	for cnew := 0; cnew < len(new); cnew++ {
 		if cnew >= len(old) {
 			action = append(action, ActionItem{
-				Action:  "newAdd",
+				Action:  NewAdd,
 				Idx:     cnew,
 				Current: new[cnew],
 			})
@@ -106,7 +107,7 @@ func ToActions(new, old []dns.RR) []ActionItem {
 			continue
 		} else {
 			action = append(action, ActionItem{
-				Action:  "change",
+				Action:  Change,
 				Idx:     cnew,
 				Current: new[cnew],
 				Prev:    old[cnew],
@@ -115,7 +116,7 @@ func ToActions(new, old []dns.RR) []ActionItem {
 	}
 	for cold := len(new); cold < len(old); cold++ {
 		action = append(action, ActionItem{
-			Action: "oldDel",
+			Action: OldDel,
 			Idx:    cold,
 			Prev:   old[cold],
 		})
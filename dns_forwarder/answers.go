@@ -0,0 +1,70 @@
+package dns_forwarder
+
+import (
+	"sync"
+
+	dnsEvents "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/miekg/dns"
+)
+
+// Authorizer installs the addresses of an answer before it is returned
+type Authorizer interface {
+	Key() dns.Question
+	Authorize(rrs []dns.RR)
+}
+
+// Observer sees every successful answer before the authorizers
+type Observer interface {
+	Observe(q dns.Question, rrs []dns.RR)
+}
+
+// Answers routes the answers seen by the forwarder or the snooping to
+// the observers and the authorizers of their question
+type Answers struct {
+	lock        sync.Mutex
+	authorizers map[string][]Authorizer
+	observers   []Observer
+}
+
+func NewAnswers() *Answers {
+	return &Answers{
+		authorizers: make(map[string][]Authorizer),
+	}
+}
+
+// Register authorizes the answers to the question of authorizer
+func (a *Answers) Register(authorizer Authorizer) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := dnsEvents.KeySubject(authorizer.Key())
+	a.authorizers[key] = append(a.authorizers[key], authorizer)
+}
+
+func (a *Answers) AddObserver(observer Observer) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.observers = append(a.observers, observer)
+}
+
+func (a *Answers) routes(q dns.Question) ([]Observer, []Authorizer) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.observers, a.authorizers[dnsEvents.KeySubject(q)]
+}
+
+// Answer passes a successful response to the observers and authorizers,
+// they have installed the addresses when it returns
+func (a *Answers) Answer(res *dns.Msg) {
+	if !res.Response || res.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, q := range res.Question {
+		observers, authorizers := a.routes(q)
+		for _, observer := range observers {
+			observer.Observe(q, res.Answer)
+		}
+		for _, authorizer := range authorizers {
+			authorizer.Authorize(res.Answer)
+		}
+	}
+}
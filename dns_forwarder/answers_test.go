@@ -0,0 +1,39 @@
+package dns_forwarder
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type recordObserver struct {
+	questions []string
+}
+
+func (ro *recordObserver) Observe(q dns.Question, rrs []dns.RR) {
+	ro.questions = append(ro.questions, q.Name)
+}
+
+func TestAnswers(t *testing.T) {
+	answers := NewAnswers()
+	ra := &recordAuthorizer{question: dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	answers.Register(ra)
+	ro := &recordObserver{}
+	answers.AddObserver(ro)
+	a, _ := dns.NewRR("www.example.com. 60 IN A 192.0.2.1")
+	res := dns.Msg{}
+	res.SetQuestion("www.example.com.", dns.TypeA)
+	res.Answer = []dns.RR{a}
+	// queries are ignored
+	answers.Answer(&res)
+	res.Response = true
+	answers.Answer(&res)
+	res.SetQuestion("www.example.com.", dns.TypeAAAA)
+	res.Response = true
+	answers.Answer(&res)
+	res.Rcode = dns.RcodeNameError
+	answers.Answer(&res)
+	if len(ra.rrs) != 1 || len(ro.questions) != 2 {
+		t.Errorf("authorized: %v observed: %v", ra.rrs, ro.questions)
+	}
+}
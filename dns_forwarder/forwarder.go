@@ -0,0 +1,136 @@
+package dns_forwarder
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+// Forwarder forwards the queries of the clients to the upstreams and
+// passes the answers to Answers before the reply
+type Forwarder struct {
+	Upstreams   []string
+	Timeout     time.Duration // default 2s per upstream
+	Policy      *Policy       // nil forwards every name
+	RefuseRcode int           // rcode of the names not allowed by Policy
+	answers     *Answers
+	log         *zerolog.Logger
+	servers     []*dns.Server
+}
+
+func NewForwarder(zlog *zerolog.Logger, upstreams []string, answers *Answers) *Forwarder {
+	return &Forwarder{
+		Upstreams: upstreams,
+		answers:   answers,
+		log:       zlog,
+	}
+}
+
+func (f *Forwarder) timeout() time.Duration {
+	if f.Timeout == 0 {
+		return 2 * time.Second
+	}
+	return f.Timeout
+}
+
+// exchange asks the upstreams in order until one answers
+func (f *Forwarder) exchange(req *dns.Msg, network string) (*dns.Msg, error) {
+	client := dns.Client{
+		Net:     network,
+		Timeout: f.timeout(),
+	}
+	var lastErr error = fmt.Errorf("no upstream")
+	for _, upstream := range f.Upstreams {
+		res, _, err := client.Exchange(req, upstream)
+		if err == nil {
+			return res, nil
+		}
+		f.log.Debug().Err(err).Str("upstream", upstream).Msg("upstream exchange")
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// refused answers the questions which are not allowed by the policy
+func (f *Forwarder) refused(w dns.ResponseWriter, req *dns.Msg) bool {
+	if f.Policy == nil {
+		return false
+	}
+	for _, q := range req.Question {
+		if f.Policy.Allowed(q.Name) {
+			continue
+		}
+		f.log.Info().Str("name", q.Name).
+			Str("type", dns.TypeToString[q.Qtype]).
+			Str("client", w.RemoteAddr().String()).
+			Str("rcode", dns.RcodeToString[f.RefuseRcode]).
+			Msg("refused query")
+		res := dns.Msg{}
+		res.SetRcode(req, f.RefuseRcode)
+		_ = w.WriteMsg(&res)
+		return true
+	}
+	return false
+}
+
+func (f *Forwarder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if f.refused(w, req) {
+		return
+	}
+	network := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		network = "tcp"
+	}
+	res, err := f.exchange(req, network)
+	if err != nil {
+		f.log.Warn().Err(err).Msg("no upstream answered")
+		fail := dns.Msg{}
+		fail.SetRcode(req, dns.RcodeServerFailure)
+		_ = w.WriteMsg(&fail)
+		return
+	}
+	f.answers.Answer(res)
+	err = w.WriteMsg(res)
+	if err != nil {
+		f.log.Debug().Err(err).Msg("error writing reply")
+	}
+}
+
+// Start listens on addr with udp and tcp
+func (f *Forwarder) Start(addr string) error {
+	for _, network := range []string{"udp", "tcp"} {
+		started := make(chan error, 1)
+		server := &dns.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: f,
+			NotifyStartedFunc: func() {
+				started <- nil
+			},
+		}
+		go func() {
+			err := server.ListenAndServe()
+			if err != nil {
+				started <- err
+			}
+		}()
+		err := <-started
+		if err != nil {
+			f.Stop()
+			return fmt.Errorf("dns forwarder %s %s: %w", network, addr, err)
+		}
+		f.servers = append(f.servers, server)
+	}
+	f.log.Info().Str("listen", addr).Strs("upstreams", f.Upstreams).Msg("dns forwarder started")
+	return nil
+}
+
+func (f *Forwarder) Stop() {
+	for _, server := range f.servers {
+		_ = server.Shutdown()
+	}
+	f.servers = nil
+}
@@ -0,0 +1,126 @@
+package dns_forwarder
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+type recordAuthorizer struct {
+	question dns.Question
+	lock     sync.Mutex
+	rrs      []dns.RR
+}
+
+func (ra *recordAuthorizer) Key() dns.Question {
+	return ra.question
+}
+
+func (ra *recordAuthorizer) Authorize(rrs []dns.RR) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	ra.rrs = append(ra.rrs, rrs...)
+}
+
+func (ra *recordAuthorizer) authorized() []dns.RR {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	return append([]dns.RR{}, ra.rrs...)
+}
+
+func serveUDP(t *testing.T, handler dns.Handler) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestForwarder(t *testing.T) {
+	upstream, stopUpstream := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := dns.Msg{}
+		res.SetReply(req)
+		if req.Question[0].Name == "www.example.com." {
+			a, _ := dns.NewRR("www.example.com. 60 IN A 192.0.2.1")
+			res.Answer = []dns.RR{a}
+		} else {
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(&res)
+	}))
+	defer stopUpstream()
+	zlog := zerolog.New(os.Stderr)
+	answers := NewAnswers()
+	f := NewForwarder(&zlog, []string{"127.0.0.1:1", upstream}, answers)
+	f.Timeout = 200 * time.Millisecond
+	ra := &recordAuthorizer{question: dns.Question{Name: "WWW.example.com", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	answers.Register(ra)
+	addr, stop := serveUDP(t, f)
+	defer stop()
+
+	c := dns.Client{}
+	req := dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	res, _, err := c.Exchange(&req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized := ra.authorized()
+	if len(res.Answer) != 1 || len(authorized) != 1 || authorized[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("answer: %v authorized: %v", res.Answer, authorized)
+	}
+	req.SetQuestion("other.example.com.", dns.TypeA)
+	res, _, err = c.Exchange(&req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rcode != dns.RcodeNameError || len(ra.authorized()) != 1 {
+		t.Errorf("rcode: %d authorized: %v", res.Rcode, ra.authorized())
+	}
+}
+
+func TestForwarderPolicy(t *testing.T) {
+	var asked int32
+	upstream, stopUpstream := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&asked, 1)
+		res := dns.Msg{}
+		res.SetReply(req)
+		w.WriteMsg(&res)
+	}))
+	defer stopUpstream()
+	zlog := zerolog.New(os.Stderr)
+	f := NewForwarder(&zlog, []string{upstream}, NewAnswers())
+	f.Policy, _ = NewPolicy([]string{"*.example.com"})
+	f.RefuseRcode = dns.RcodeRefused
+	addr, stop := serveUDP(t, f)
+	defer stop()
+
+	c := dns.Client{}
+	req := dns.Msg{}
+	req.SetQuestion("exfil.attacker.net.", dns.TypeTXT)
+	res, _, err := c.Exchange(&req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rcode != dns.RcodeRefused || atomic.LoadInt32(&asked) != 0 {
+		t.Errorf("rcode: %d asked: %d", res.Rcode, atomic.LoadInt32(&asked))
+	}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	res, _, err = c.Exchange(&req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rcode != dns.RcodeSuccess || atomic.LoadInt32(&asked) != 1 {
+		t.Errorf("rcode: %d asked: %d", res.Rcode, atomic.LoadInt32(&asked))
+	}
+}
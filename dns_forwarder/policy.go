@@ -0,0 +1,62 @@
+package dns_forwarder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Policy decides which names the clients are allowed to resolve,
+// patterns are names or wildcards like *.example.com which match the
+// subdomains but not example.com itself
+type Policy struct {
+	names     map[string]bool
+	wildcards []string // suffixes like .example.com
+}
+
+func cleanName(s string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimRight(s, ".")))
+}
+
+// ValidPattern checks a name or wildcard pattern
+func ValidPattern(pattern string) error {
+	name := strings.TrimPrefix(cleanName(pattern), "*.")
+	if strings.Contains(name, "*") {
+		return fmt.Errorf("%q: only a leading *. is allowed", pattern)
+	}
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return fmt.Errorf("%q is not a dns name", pattern)
+	}
+	return nil
+}
+
+func NewPolicy(patterns []string) (*Policy, error) {
+	p := &Policy{names: map[string]bool{}}
+	for _, pattern := range patterns {
+		err := ValidPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		name := cleanName(pattern)
+		if strings.HasPrefix(name, "*.") {
+			p.wildcards = append(p.wildcards, name[1:])
+			continue
+		}
+		p.names[name] = true
+	}
+	return p, nil
+}
+
+func (p *Policy) Allowed(name string) bool {
+	name = cleanName(name)
+	if p.names[name] {
+		return true
+	}
+	for _, suffix := range p.wildcards {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package dns_forwarder
+
+import "testing"
+
+func TestPolicy(t *testing.T) {
+	p, err := NewPolicy([]string{"registry.npmjs.org.", "*.Example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, allowed := range map[string]bool{
+		"registry.npmjs.org.":   true,
+		"REGISTRY.npmjs.org":    true,
+		"x.registry.npmjs.org.": false,
+		"www.example.com.":      true,
+		"a.b.example.com.":      true,
+		"example.com.":          false,
+		"badexample.com.":       false,
+	} {
+		if p.Allowed(name) != allowed {
+			t.Errorf("%s: expected %v", name, allowed)
+		}
+	}
+	for _, pattern := range []string{"a.*.com", "*", "**.x.com", "x..com"} {
+		if _, err := NewPolicy([]string{pattern}); err == nil {
+			t.Errorf("%s should be invalid", pattern)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package drop_reporter
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type proposalTarget struct {
+	host   string
+	isName bool
+	ports  map[string]map[uint16]bool // proto -> ports, 0 is a proto without ports
+	types  map[string]bool
+	addrs  map[netip.Addr]bool
+	count  int
+}
+
+func (pt *proposalTarget) url() string {
+	protos := make([]string, 0, len(pt.ports))
+	for proto := range pt.ports {
+		protos = append(protos, proto)
+	}
+	sort.Strings(protos)
+	params := []string{}
+	for _, proto := range protos {
+		ports := []int{}
+		for port := range pt.ports[proto] {
+			if port != 0 {
+				ports = append(ports, int(port))
+			}
+		}
+		sort.Ints(ports)
+		if len(ports) == 0 {
+			if proto == "icmp" || proto == "icmpv6" {
+				params = append(params, "port=/"+proto)
+			} else {
+				params = append(params, "port=/all")
+			}
+			continue
+		}
+		strPorts := make([]string, 0, len(ports))
+		for _, port := range ports {
+			strPorts = append(strPorts, strconv.Itoa(port))
+		}
+		params = append(params, fmt.Sprintf("port=%s/%s", strings.Join(strPorts, ","), proto))
+	}
+	if pt.isName {
+		for _, typ := range []string{"A", "AAAA"} {
+			if pt.types[typ] {
+				params = append(params, "type="+typ)
+			}
+		}
+	}
+	return fmt.Sprintf("sken://%s/?%s", pt.host, strings.Join(params, "&"))
+}
+
+func (pt *proposalTarget) sortedAddrs() []string {
+	addrs := make([]string, 0, len(pt.addrs))
+	for addr := range pt.addrs {
+		addrs = append(addrs, addr.String())
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// proposal groups the entries under the dns names which resolved to
+// their address, addresses without a name become literal targets
+func proposal(entries []DropEntry) []*proposalTarget {
+	byHost := map[string]*proposalTarget{}
+	add := func(host string, isName bool, entry *DropEntry) {
+		pt, found := byHost[host]
+		if !found {
+			pt = &proposalTarget{
+				host:   host,
+				isName: isName,
+				ports:  map[string]map[uint16]bool{},
+				types:  map[string]bool{},
+				addrs:  map[netip.Addr]bool{},
+			}
+			byHost[host] = pt
+		}
+		if pt.ports[entry.Proto] == nil {
+			pt.ports[entry.Proto] = map[uint16]bool{}
+		}
+		pt.ports[entry.Proto][entry.Port] = true
+		if entry.Dst.Is6() {
+			pt.types["AAAA"] = true
+		} else {
+			pt.types["A"] = true
+		}
+		pt.addrs[entry.Dst] = true
+		pt.count += entry.Count
+	}
+	for i := range entries {
+		entry := &entries[i]
+		if len(entry.Names) == 0 {
+			host := entry.Dst.String()
+			if entry.Dst.Is6() {
+				host = "[" + host + "]"
+			}
+			add(host, false, entry)
+			continue
+		}
+		for _, name := range entry.Names {
+			add(name, true, entry)
+		}
+	}
+	out := make([]*proposalTarget, 0, len(byHost))
+	for _, pt := range byHost {
+		out = append(out, pt)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].isName != out[j].isName {
+			return out[i].isName
+		}
+		return out[i].host < out[j].host
+	})
+	return out
+}
+
+// WriteProposal writes the proposed targets as commandline arguments
+// with the observed addresses as comment for the review
+func WriteProposal(w io.Writer, entries []DropEntry) error {
+	_, err := fmt.Fprintf(w, "# proposed targets from %d observed destinations, review before use\n", len(entries))
+	if err != nil {
+		return err
+	}
+	for _, pt := range proposal(entries) {
+		_, err = fmt.Fprintf(w, "--target '%s' # %d connections to %s\n", pt.url(), pt.count, strings.Join(pt.sortedAddrs(), ","))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package drop_reporter
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestWriteProposal(t *testing.T) {
+	entries := []DropEntry{
+		{Dst: netip.MustParseAddr("192.0.2.10"), Proto: "tcp", Port: 443, Names: []string{"api.example.com"}, Count: 3},
+		{Dst: netip.MustParseAddr("192.0.2.11"), Proto: "tcp", Port: 80, Names: []string{"api.example.com"}, Count: 1},
+		{Dst: netip.MustParseAddr("2001:db8::10"), Proto: "tcp", Port: 443, Names: []string{"api.example.com"}, Count: 2},
+		{Dst: netip.MustParseAddr("192.0.2.53"), Proto: "udp", Port: 53, Count: 4},
+		{Dst: netip.MustParseAddr("192.0.2.53"), Proto: "icmp", Count: 1},
+		{Dst: netip.MustParseAddr("2001:db8::1"), Proto: "gre", Count: 1},
+	}
+	buf := bytes.NewBuffer(nil)
+	err := WriteProposal(buf, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# proposed targets from 6 observed destinations, review before use
+--target 'sken://api.example.com/?port=80,443/tcp&type=A&type=AAAA' # 6 connections to 192.0.2.10,192.0.2.11,2001:db8::10
+--target 'sken://192.0.2.53/?port=/icmp&port=53/udp' # 5 connections to 192.0.2.53
+--target 'sken://[2001:db8::1]/?port=/all' # 1 connections to 2001:db8::1
+`
+	if buf.String() != expected {
+		t.Errorf("proposal:\n%s", buf.String())
+	}
+}
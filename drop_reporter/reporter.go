@@ -0,0 +1,217 @@
+package drop_reporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mabels/steinstuecken/traffic"
+	"github.com/rs/zerolog"
+)
+
+// maxEntries limits the memory, the least recently seen entries are evicted
+const maxEntries = 4096
+
+type dropKey struct {
+	dst   netip.Addr
+	proto uint8
+	port  uint16
+}
+
+// DropEntry aggregates the dropped packets to a destination
+type DropEntry struct {
+	Dst       netip.Addr `json:"dst"`
+	Proto     string     `json:"proto"`
+	Port      uint16     `json:"port,omitempty"`
+	Names     []string   `json:"names,omitempty"`
+	Count     int        `json:"count"`
+	FirstSeen time.Time  `json:"firstSeen"`
+	LastSeen  time.Time  `json:"lastSeen"`
+	Targets   []string   `json:"targets"`
+}
+
+// HostPort is the name or the address with the port like api.example.com:443
+func (e *DropEntry) HostPort() string {
+	host := e.Dst.String()
+	if len(e.Names) > 0 {
+		host = strings.Join(e.Names, ",")
+	}
+	if e.Port == 0 {
+		return fmt.Sprintf("%s/%s", host, e.Proto)
+	}
+	if e.Dst.Is6() && len(e.Names) == 0 {
+		host = "[" + host + "]"
+	}
+	return fmt.Sprintf("%s:%d/%s", host, e.Port, e.Proto)
+}
+
+// TargetURLs returns ready to paste sken targets, one per observed name
+// or the address if no name is known
+func (e *DropEntry) TargetURLs() []string {
+	port := "/all"
+	switch {
+	case e.Port != 0:
+		port = fmt.Sprintf("%d/%s", e.Port, e.Proto)
+	case e.Proto == "icmp" || e.Proto == "icmpv6":
+		port = "/" + e.Proto
+	}
+	if len(e.Names) == 0 {
+		host := e.Dst.String()
+		if e.Dst.Is6() {
+			host = "[" + host + "]"
+		}
+		return []string{fmt.Sprintf("sken://%s/?port=%s", host, port)}
+	}
+	typ := "A"
+	if e.Dst.Is6() {
+		typ = "AAAA"
+	}
+	out := make([]string, 0, len(e.Names))
+	for _, name := range e.Names {
+		out = append(out, fmt.Sprintf("sken://%s/?port=%s&type=%s", name, port, typ))
+	}
+	return out
+}
+
+type DropReporter struct {
+	lock    sync.Mutex
+	entries map[dropKey]*DropEntry
+	dns     *traffic.PassiveDNS
+	log     *zerolog.Logger
+	now     func() time.Time
+}
+
+func NewDropReporter(zlog *zerolog.Logger, pdns *traffic.PassiveDNS) *DropReporter {
+	return &DropReporter{
+		entries: make(map[dropKey]*DropEntry),
+		dns:     pdns,
+		log:     zlog,
+		now:     time.Now,
+	}
+}
+
+// Record counts a dropped packet
+func (dr *DropReporter) Record(pkt *traffic.Packet) {
+	key := dropKey{dst: pkt.Dst.Unmap(), proto: pkt.Proto}
+	if pkt.HasPorts() {
+		key.port = pkt.DstPort
+	}
+	now := dr.now()
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+	entry, found := dr.entries[key]
+	if !found {
+		if len(dr.entries) >= maxEntries {
+			dr.evictOldest()
+		}
+		entry = &DropEntry{
+			Dst:       key.dst,
+			Proto:     pkt.ProtoName(),
+			Port:      key.port,
+			FirstSeen: now,
+		}
+		dr.entries[key] = entry
+	}
+	entry.Count++
+	entry.LastSeen = now
+	// the names are taken at drop time, the dns answer may expire later
+	entry.Names = mergeNames(entry.Names, dr.dns.Lookup(key.dst))
+}
+
+func (dr *DropReporter) evictOldest() {
+	var oldest *dropKey
+	for key, entry := range dr.entries {
+		if oldest == nil || entry.LastSeen.Before(dr.entries[*oldest].LastSeen) {
+			k := key
+			oldest = &k
+		}
+	}
+	if oldest != nil {
+		delete(dr.entries, *oldest)
+	}
+}
+
+func mergeNames(names []string, add []string) []string {
+	for _, name := range add {
+		found := false
+		for _, n := range names {
+			if n == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Entries returns a copy of the entries, the most dropped first
+func (dr *DropReporter) Entries() []DropEntry {
+	dr.lock.Lock()
+	out := make([]DropEntry, 0, len(dr.entries))
+	for _, entry := range dr.entries {
+		e := *entry
+		e.Names = append([]string{}, entry.Names...)
+		e.Targets = e.TargetURLs()
+		out = append(out, e)
+	}
+	dr.lock.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		if !out[i].LastSeen.Equal(out[j].LastSeen) {
+			return out[i].LastSeen.After(out[j].LastSeen)
+		}
+		return out[i].HostPort() < out[j].HostPort()
+	})
+	return out
+}
+
+// LogReport writes one line per denied destination
+func (dr *DropReporter) LogReport() {
+	for _, entry := range dr.Entries() {
+		dr.log.Info().Str("denied", entry.HostPort()).
+			Str("dst", entry.Dst.String()).
+			Int("count", entry.Count).
+			Time("lastSeen", entry.LastSeen).
+			Strs("targets", entry.Targets).
+			Msg("dropped connection")
+	}
+}
+
+// ServeHTTP returns the entries as json, with ?format=targets the
+// sken targets one per line or with ?format=proposal grouped by name
+func (dr *DropReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entries := dr.Entries()
+	switch r.URL.Query().Get("format") {
+	case "proposal":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err := WriteProposal(w, entries)
+		if err != nil {
+			dr.log.Error().Err(err).Msg("error writing proposal")
+		}
+		return
+	case "targets":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, entry := range entries {
+			for _, target := range entry.Targets {
+				fmt.Fprintf(w, "--target '%s' # %d drops, last %s\n", target, entry.Count, entry.LastSeen.Format(time.RFC3339))
+			}
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		dr.log.Error().Err(err).Msg("error encoding drops")
+	}
+}
@@ -0,0 +1,54 @@
+package drop_reporter
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mabels/steinstuecken/traffic"
+	"github.com/rs/zerolog"
+)
+
+func TestDropReporter(t *testing.T) {
+	zlog := zerolog.New(os.Stderr)
+	pdns := traffic.NewPassiveDNS(time.Hour)
+	pdns.Add("api.example.com.", netip.MustParseAddr("192.0.2.10"), time.Minute)
+	dr := NewDropReporter(&zlog, pdns)
+	for i := 0; i < 3; i++ {
+		dr.Record(&traffic.Packet{Dst: netip.MustParseAddr("192.0.2.10"), Proto: traffic.ProtoTCP, SrcPort: uint16(40000 + i), DstPort: 443})
+	}
+	dr.Record(&traffic.Packet{Dst: netip.MustParseAddr("2001:db8::1"), Proto: traffic.ProtoUDP, DstPort: 123})
+	dr.Record(&traffic.Packet{Dst: netip.MustParseAddr("192.0.2.11"), Proto: traffic.ProtoICMP})
+	entries := dr.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("entries: %v", entries)
+	}
+	if entries[0].Count != 3 || entries[0].HostPort() != "api.example.com:443/tcp" {
+		t.Errorf("first: %+v", entries[0])
+	}
+	if !reflect.DeepEqual(entries[0].Targets, []string{"sken://api.example.com/?port=443/tcp&type=A"}) {
+		t.Errorf("targets: %v", entries[0].Targets)
+	}
+	targets := []string{}
+	for _, entry := range entries[1:] {
+		targets = append(targets, entry.Targets...)
+	}
+	if !reflect.DeepEqual(targets, []string{"sken://192.0.2.11/?port=/icmp", "sken://[2001:db8::1]/?port=123/udp"}) &&
+		!reflect.DeepEqual(targets, []string{"sken://[2001:db8::1]/?port=123/udp", "sken://192.0.2.11/?port=/icmp"}) {
+		t.Errorf("targets: %v", targets)
+	}
+	rec := httptest.NewRecorder()
+	dr.ServeHTTP(rec, httptest.NewRequest("GET", "/drops?format=targets", nil))
+	if !strings.HasPrefix(rec.Body.String(), "--target 'sken://api.example.com/?port=443/tcp&type=A' # 3 drops") {
+		t.Errorf("targets format: %s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	dr.ServeHTTP(rec, httptest.NewRequest("GET", "/drops", nil))
+	if !strings.Contains(rec.Body.String(), `"names":["api.example.com"]`) {
+		t.Errorf("json: %s", rec.Body.String())
+	}
+}
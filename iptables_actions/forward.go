@@ -24,72 +24,108 @@ func addOrRemove(add_or_remove string, zlog *zerolog.Logger, ipChain iptables.Ch
 	return err
 }
 
-func Forward(add_or_remove string, zlog *zerolog.Logger, ipChain iptables.Chain, ipTable iptables.Table, ip string, target *cli.Target, ipt iptables.Interface, jump []string) (errs []error) {
+// Forward adds or removes the rules from src to dst and the return path,
+// an empty src matches any source
+func Forward(add_or_remove string, zlog *zerolog.Logger, ipChain iptables.Chain, ipTable iptables.Table, src string, dst string, target *cli.Target, ipt iptables.Interface, jump []string) (errs []error) {
 	inIfaceParam := []string{}
 	if target.Interface.Input != nil {
 		inIfaceParam = []string{"-i", *target.Interface.Input}
 	}
 	outIfaceParam := []string{}
-	if target.Interface.Input != nil {
+	if target.Interface.Output != nil {
 		outIfaceParam = []string{"-o", *target.Interface.Output}
 	}
 
 	for _, port := range target.Ports {
+		portProto := port.Proto
+		icmpTypeParam := "--icmp-type"
+		switch portProto {
+		case "icmp":
+			if ipt.IsIpv6() {
+				portProto = "icmpv6"
+				icmpTypeParam = "--icmpv6-type"
+			}
+		case "icmpv6":
+			if !ipt.IsIpv6() {
+				zlog.Debug().Str("proto", portProto).Msg("skipping icmpv6 for ipv4")
+				continue
+			}
+			icmpTypeParam = "--icmpv6-type"
+		}
 		proto := NewStringArrayBuilder()
-		if !(port.Proto == "" || port.Proto == "all") {
-			proto.Add("-p", port.Proto)
+		if !(portProto == "" || portProto == "all") {
+			proto.Add("-p", portProto)
 		}
-		dport := NewStringArrayBuilder()
-		sport := NewStringArrayBuilder()
+		// icmp could only match one type per rule and multiport is limited to 15 ports
+		dports := []*StringArrayBuilder{NewStringArrayBuilder()}
+		sports := []*StringArrayBuilder{NewStringArrayBuilder()}
 		if len(port.Port) != 0 {
-			if port.Proto != "icmp" {
-				if len(port.Port) == 1 {
-					dport.Add("--dport", port.Port[0])
-					sport.Add("--sport", port.Port[0])
-				} else {
-					portStr := strings.Join(port.Port, ",")
-					dport.Add("-m", "multiport", "--dports", portStr)
-					sport.Add("-m", "multiport", "--sports", portStr)
+			if portProto != "icmp" && portProto != "icmpv6" {
+				dports = dports[:0]
+				sports = sports[:0]
+				for _, chunk := range multiportChunks(port.Port) {
+					dport, sport := portMatches(portProto, chunk)
+					dports = append(dports, dport)
+					sports = append(sports, sport)
 				}
 			} else {
-				portStr := strings.Join(port.Port, ",")
-				dport.Add("--icmp-type", portStr)
-				sport.Add("--icmp-type", portStr)
+				dports = dports[:0]
+				sports = sports[:0]
+				for _, icmpType := range port.Port {
+					dports = append(dports, NewStringArrayBuilder().Add(icmpTypeParam, icmpType))
+					sports = append(sports, NewStringArrayBuilder().Add(icmpTypeParam, icmpType))
+				}
 			}
 		}
-		outStateful := NewStringArrayBuilder()
-		inStateful := NewStringArrayBuilder()
-		if target.NonStateful {
-			outStateful.Add("-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED,NEW")
-			inStateful.Add("-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED")
+		for i := range dports {
+			errs = append(errs, forwardPort(add_or_remove, zlog, ipChain, ipTable, src, dst, target, ipt, jump, proto, dports[i], sports[i], inIfaceParam, outIfaceParam)...)
 		}
-		params := NewStringArrayBuilder().
-			Add(outStateful.Out...).
-			Add("-d", ip).
+	}
+	return
+}
+
+func forwardPort(add_or_remove string, zlog *zerolog.Logger, ipChain iptables.Chain, ipTable iptables.Table, src string, dst string, target *cli.Target, ipt iptables.Interface, jump []string,
+	proto, dport, sport *StringArrayBuilder, inIfaceParam, outIfaceParam []string) (errs []error) {
+	outStateful := NewStringArrayBuilder()
+	inStateful := NewStringArrayBuilder()
+	if target.NonStateful {
+		outStateful.Add("-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED,NEW")
+		inStateful.Add("-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED")
+	}
+	srcParam := []string{}
+	dstParam := []string{}
+	if src != "" {
+		srcParam = []string{"-s", src}
+		dstParam = []string{"-d", src}
+	}
+	params := NewStringArrayBuilder().
+		Add(outStateful.Out...).
+		Add(srcParam...).
+		Add("-d", dst).
+		Add(proto.Out...).
+		Add(dport.Out...).
+		Add(outIfaceParam...).
+		Add(jump...)
+	err := addOrRemove(add_or_remove, zlog, ipChain, ipTable, params, ipt)
+	if err != nil {
+		errs = append(errs, err)
+		zlog.Error().Str("add_or_remove", add_or_remove).Str("chain", string(ipChain)).Err(err).Msg("out error ensuring rule")
+		return
+	}
+	if ipTable != iptables.TableNAT {
+		params = NewStringArrayBuilder().
+			Add(inStateful.Out...).
+			Add("-s", dst).
+			Add(dstParam...).
 			Add(proto.Out...).
-			Add(dport.Out...).
-			Add(outIfaceParam...).
+			Add(sport.Out...).
+			Add(inIfaceParam...).
 			Add(jump...)
-		err := addOrRemove(add_or_remove, zlog, ipChain, ipTable, params, ipt)
+		err = addOrRemove(add_or_remove, zlog, ipChain, ipTable, params, ipt)
 		if err != nil {
 			errs = append(errs, err)
-			zlog.Error().Str("add_or_remove", add_or_remove).Str("chain", string(ipChain)).Err(err).Msg("out error ensuring rule")
-			continue
-		}
-		if ipTable != iptables.TableNAT {
-			params = NewStringArrayBuilder().
-				Add(inStateful.Out...).
-				Add("-s", ip).
-				Add(proto.Out...).
-				Add(sport.Out...).
-				Add(inIfaceParam...).
-				Add(jump...)
-			err = addOrRemove(add_or_remove, zlog, ipChain, ipTable, params, ipt)
-			if err != nil {
-				errs = append(errs, err)
-				zlog.Error().Str("add_or_remove", add_or_remove).Str("chain", string(ipChain)).Err(err).Msg("in error ensuring rule")
-				continue
-			}
+			zlog.Error().Str("add_or_remove", add_or_remove).Str("chain", string(ipChain)).Err(err).Msg("in error ensuring rule")
+			return
 		}
 	}
 	return
@@ -0,0 +1,36 @@
+//go:build linux
+
+package iptables_actions
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+type chainLock struct {
+	fd int
+}
+
+func (l *chainLock) Close() error {
+	return unix.Close(l.fd)
+}
+
+// lockChains binds the abstract unix socket of the chain name, like the
+// chains it exists per network namespace and is released with the process
+func lockChains(chainName string) (io.Closer, error) {
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("lock socket: %w", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrUnix{Name: "@steinstuecken/" + chainName})
+	if err != nil {
+		unix.Close(fd)
+		if err == unix.EADDRINUSE {
+			return nil, fmt.Errorf("chains of %s are owned by a running instance in this network namespace", chainName)
+		}
+		return nil, fmt.Errorf("lock %s: %w", chainName, err)
+	}
+	return &chainLock{fd: fd}, nil
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package iptables_actions
+
+import "testing"
+
+func TestLockChains(t *testing.T) {
+	lock, err := lockChains("TEST-LOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockChains("TEST-LOCK"); err == nil {
+		t.Error("the chains are locked twice")
+	}
+	other, err := lockChains("TEST-LOCK-OTHER")
+	if err != nil {
+		t.Error(err)
+	} else {
+		other.Close()
+	}
+	lock.Close()
+	lock, err = lockChains("TEST-LOCK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Close()
+}
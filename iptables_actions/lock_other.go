@@ -0,0 +1,15 @@
+//go:build !linux
+
+package iptables_actions
+
+import "io"
+
+type noLock struct{}
+
+func (noLock) Close() error {
+	return nil
+}
+
+func lockChains(chainName string) (io.Closer, error) {
+	return noLock{}, nil
+}
@@ -0,0 +1,90 @@
+package iptables_actions
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/mabels/steinstuecken/cmd/cli"
+)
+
+// kernel limits of the prefixes including the trailing zero
+const (
+	nflogPrefixMax = 64
+	logPrefixMax   = 29
+)
+
+func truncatePrefix(prefix string, max int) string {
+	if len(prefix) >= max {
+		return prefix[:max-1]
+	}
+	return prefix
+}
+
+// LogJump returns a rate limited NFLOG or LOG jump, an empty logTarget
+// uses the configured default
+func LogJump(log *cli.LogOptions, logTarget string, prefix string) []string {
+	if logTarget == "" {
+		logTarget = log.Target
+	}
+	jump := NewStringArrayBuilder().
+		Add("-m", "limit", "--limit", log.Rate, "--limit-burst", strconv.Itoa(log.Burst))
+	switch logTarget {
+	case "log":
+		jump.Add("-j", "LOG", "--log-prefix", truncatePrefix(prefix, logPrefixMax-1)+" ")
+	default:
+		jump.Add("-j", "NFLOG", "--nflog-group", strconv.Itoa(log.NflogGroup), "--nflog-prefix", truncatePrefix(prefix, nflogPrefixMax))
+	}
+	return jump.Out
+}
+
+// DropLogPrefix is the log prefix of the rule in front of the final DROP
+func DropLogPrefix(config *cli.Config) string {
+	return fmt.Sprintf("FWD-%s:drop", config.ChainName)
+}
+
+// DnsLogPrefix is the log prefix of the dns answers read by the drop reporter
+func DnsLogPrefix(config *cli.Config) string {
+	return fmt.Sprintf("FWD-%s:dns", config.ChainName)
+}
+
+// LearnLogPrefix is the log prefix of the new connections accepted by --learn
+func LearnLogPrefix(config *cli.Config) string {
+	return fmt.Sprintf("FWD-%s:learn", config.ChainName)
+}
+
+// LogDnsAnswers is true if the passive dns cache, the wildcard targets or
+// --dns-snoop=nflog need the forwarded answers
+func LogDnsAnswers(config *cli.Config) bool {
+	return config.ReportDrops || config.Learn || config.HasWildcards() || config.DnsSnoop.Mode == "nflog"
+}
+
+// LogDnsAnswersRule is the NFLOG rule of the forwarded dns answers, only
+// replies of a query which passed the chains are logged, a client can not
+// authorize addresses with a forged answer
+func LogDnsAnswersRule(config *cli.Config) []string {
+	return []string{"-p", "udp", "--sport", "53", "-m", "conntrack", "--ctstate", "ESTABLISHED", "--ctdir", "REPLY",
+		"-j", "NFLOG", "--nflog-group", strconv.Itoa(config.Log.NflogGroup),
+		"--nflog-prefix", truncatePrefix(DnsLogPrefix(config), nflogPrefixMax)}
+}
+
+// QueueDnsAnswers is the NFQUEUE rule which holds the answers to the
+// clients until --dns-snoop=nfqueue accepted them, queries which are not
+// forwarded have no ESTABLISHED answers
+func QueueDnsAnswers(config *cli.Config) []string {
+	if config.DnsSnoop.Mode != "nfqueue" {
+		return nil
+	}
+	return []string{"-p", "udp", "--sport", "53", "-m", "conntrack", "--ctstate", "ESTABLISHED", "--ctdir", "REPLY",
+		"-j", "NFQUEUE", "--queue-num", strconv.Itoa(config.DnsSnoop.Queue), "--queue-bypass"}
+}
+
+// DropLogJump is the log rule in front of the final DROP, the drop reporter
+// reads every new connection without the rate limit
+func DropLogJump(config *cli.Config) []string {
+	if !config.ReportDrops {
+		return LogJump(&config.Log, "", DropLogPrefix(config))
+	}
+	return []string{"-m", "conntrack", "--ctstate", "NEW", "-j", "NFLOG",
+		"--nflog-group", strconv.Itoa(config.Log.NflogGroup),
+		"--nflog-prefix", truncatePrefix(DropLogPrefix(config), nflogPrefixMax)}
+}
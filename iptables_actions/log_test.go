@@ -0,0 +1,78 @@
+package iptables_actions
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mabels/steinstuecken/cmd/cli"
+)
+
+func TestLogJump(t *testing.T) {
+	log := cli.LogOptions{
+		Target:     "nflog",
+		NflogGroup: 100,
+		Rate:       "10/minute",
+		Burst:      5,
+	}
+	jump := LogJump(&log, "", "www.google.de:IN:A")
+	if !reflect.DeepEqual(jump, []string{
+		"-m", "limit", "--limit", "10/minute", "--limit-burst", "5",
+		"-j", "NFLOG", "--nflog-group", "100", "--nflog-prefix", "www.google.de:IN:A",
+	}) {
+		t.Errorf("nflog: %v", jump)
+	}
+	jump = LogJump(&log, "log", "a-very-long-subject-name.example.com:IN:AAAA")
+	if !reflect.DeepEqual(jump, []string{
+		"-m", "limit", "--limit", "10/minute", "--limit-burst", "5",
+		"-j", "LOG", "--log-prefix", "a-very-long-subject-name.ex ",
+	}) {
+		t.Errorf("log: %v", jump)
+	}
+	jump = LogJump(&log, "", strings.Repeat("x", 100))
+	if len(jump[len(jump)-1]) != 63 {
+		t.Errorf("nflog prefix should be truncated: %v", len(jump[len(jump)-1]))
+	}
+}
+
+func TestDropReporterPrefixes(t *testing.T) {
+	config := cli.Config{ChainName: "STEINSTUECKEN"}
+	if DnsLogPrefix(&config) != "FWD-STEINSTUECKEN:dns" || DropLogPrefix(&config) != "FWD-STEINSTUECKEN:drop" {
+		t.Errorf("prefixes: %s %s", DnsLogPrefix(&config), DropLogPrefix(&config))
+	}
+	if LearnLogPrefix(&config) != "FWD-STEINSTUECKEN:learn" || LogDnsAnswers(&config) {
+		t.Errorf("learn: %s %v", LearnLogPrefix(&config), LogDnsAnswers(&config))
+	}
+	config.Learn = true
+	if !LogDnsAnswers(&config) {
+		t.Errorf("learn needs the dns answers")
+	}
+	config.Log = cli.LogOptions{Target: "log", NflogGroup: 100, Rate: "10/minute", Burst: 5}
+	if jump := strings.Join(DropLogJump(&config), " "); !strings.HasPrefix(jump, "-m limit") {
+		t.Errorf("the drop log should be limited: %s", jump)
+	}
+	config.ReportDrops = true
+	if jump := strings.Join(DropLogJump(&config), " "); jump != "-m conntrack --ctstate NEW -j NFLOG --nflog-group 100 --nflog-prefix FWD-STEINSTUECKEN:drop" {
+		t.Errorf("the reported drops should be unlimited new connections: %s", jump)
+	}
+}
+
+func TestDnsSnoopRules(t *testing.T) {
+	config := cli.Config{ChainName: "STEINSTUECKEN"}
+	config.DnsSnoop.Mode = "nflog"
+	if !LogDnsAnswers(&config) || QueueDnsAnswers(&config) != nil {
+		t.Errorf("nflog snooping needs the dns log rule only")
+	}
+	config.Log.NflogGroup = 100
+	if rule := strings.Join(LogDnsAnswersRule(&config), " "); rule != "-p udp --sport 53 -m conntrack --ctstate ESTABLISHED --ctdir REPLY -j NFLOG --nflog-group 100 --nflog-prefix FWD-STEINSTUECKEN:dns" {
+		t.Errorf("dns log rule: %s", rule)
+	}
+	config.DnsSnoop = cli.DnsSnoopOptions{Mode: "nfqueue", Queue: 7}
+	if LogDnsAnswers(&config) {
+		t.Errorf("nfqueue snooping needs no dns log rule")
+	}
+	queue := strings.Join(QueueDnsAnswers(&config), " ")
+	if queue != "-p udp --sport 53 -m conntrack --ctstate ESTABLISHED --ctdir REPLY -j NFQUEUE --queue-num 7 --queue-bypass" {
+		t.Errorf("queue rule: %s", queue)
+	}
+}
@@ -0,0 +1,46 @@
+package iptables_actions
+
+import "strings"
+
+// multiportMaxSlots is the kernel limit of the multiport match,
+// a port range from:to takes two slots
+const multiportMaxSlots = 15
+
+func multiportSlots(port string) int {
+	if strings.Contains(port, ":") {
+		return 2
+	}
+	return 1
+}
+
+// multiportChunks splits ports into groups which fit into one multiport match
+func multiportChunks(ports []string) [][]string {
+	chunks := [][]string{}
+	chunk := []string{}
+	slots := 0
+	for _, port := range ports {
+		portSlots := multiportSlots(port)
+		if slots+portSlots > multiportMaxSlots {
+			chunks = append(chunks, chunk)
+			chunk = []string{}
+			slots = 0
+		}
+		chunk = append(chunk, port)
+		slots += portSlots
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// portMatches returns the destination and source port matches of a chunk,
+// udplite has no match extension of its own and always uses multiport
+func portMatches(proto string, chunk []string) (*StringArrayBuilder, *StringArrayBuilder) {
+	if len(chunk) == 1 && proto != "udplite" {
+		return NewStringArrayBuilder().Add("--dport", chunk[0]), NewStringArrayBuilder().Add("--sport", chunk[0])
+	}
+	portStr := strings.Join(chunk, ",")
+	return NewStringArrayBuilder().Add("-m", "multiport", "--dports", portStr),
+		NewStringArrayBuilder().Add("-m", "multiport", "--sports", portStr)
+}
@@ -0,0 +1,50 @@
+package iptables_actions
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMultiportChunks(t *testing.T) {
+	if len(multiportChunks([]string{})) != 0 {
+		t.Error("empty should have no chunks")
+	}
+	ports := []string{}
+	for i := 1; i <= 15; i++ {
+		ports = append(ports, fmt.Sprintf("%d", i))
+	}
+	chunks := multiportChunks(ports)
+	if len(chunks) != 1 || len(chunks[0]) != 15 {
+		t.Errorf("15 ports should fit: %v", chunks)
+	}
+	chunks = multiportChunks(append(append([]string{}, ports...), "16"))
+	if !reflect.DeepEqual(chunks, [][]string{ports, {"16"}}) {
+		t.Errorf("16 ports should split: %v", chunks)
+	}
+	chunks = multiportChunks(append(append([]string{}, ports[:14]...), "30000:30100"))
+	if !reflect.DeepEqual(chunks, [][]string{ports[:14], {"30000:30100"}}) {
+		t.Errorf("range takes two slots: %v", chunks)
+	}
+	if len(ports) != 15 || ports[14] != "15" {
+		t.Errorf("fixture modified: %v", ports)
+	}
+}
+
+func TestPortMatches(t *testing.T) {
+	for _, tc := range []struct {
+		proto string
+		chunk []string
+		dport []string
+	}{
+		{"tcp", []string{"443"}, []string{"--dport", "443"}},
+		{"tcp", []string{"80", "443"}, []string{"-m", "multiport", "--dports", "80,443"}},
+		{"udplite", []string{"53"}, []string{"-m", "multiport", "--dports", "53"}},
+		{"udplite", []string{"5000:5010"}, []string{"-m", "multiport", "--dports", "5000:5010"}},
+	} {
+		dport, sport := portMatches(tc.proto, tc.chunk)
+		if !reflect.DeepEqual(dport.Out, tc.dport) || len(sport.Out) != len(tc.dport) {
+			t.Errorf("%s %v: %q %q", tc.proto, tc.chunk, dport.Out, sport.Out)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package iptables_actions
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// commentMax is the kernel limit of a comment without the trailing zero
+const commentMax = 255
+
+// ownerMark starts the comment of the rule which marks the owner of a chain
+const ownerMark = "owner"
+
+// Owner identifies the instance which installed the rules, the generation
+// counts its starts on the same chains
+type Owner struct {
+	Instance   string
+	Generation int
+}
+
+var (
+	commentEscaper   = strings.NewReplacer("%", "%25", ",", "%2C", "=", "%3D")
+	commentUnescaper = strings.NewReplacer("%25", "%", "%2C", ",", "%3D", "=")
+)
+
+// Comment is the structured comment of the rules of a target, the subject
+// is the last field and truncated to the kernel limit
+func (o Owner) Comment(targetID string, subject string) string {
+	comment := fmt.Sprintf("i=%s,g=%d,t=%s,s=%s", commentEscaper.Replace(o.Instance), o.Generation,
+		commentEscaper.Replace(targetID), commentEscaper.Replace(subject))
+	if len(comment) > commentMax {
+		comment = comment[:commentMax]
+		// without a cut escape
+		if idx := strings.LastIndex(comment, "%"); idx >= len(comment)-2 {
+			comment = comment[:idx]
+		}
+	}
+	return comment
+}
+
+func (o Owner) marker() string {
+	return fmt.Sprintf("%s,i=%s,g=%d", ownerMark, commentEscaper.Replace(o.Instance), o.Generation)
+}
+
+// ParseComment returns the fields of a structured comment, a comment like
+// the subject of former versions has no fields
+func ParseComment(comment string) map[string]string {
+	fields := map[string]string{}
+	for _, part := range strings.Split(comment, ",") {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			fields[commentUnescaper.Replace(part)] = ""
+			continue
+		}
+		fields[key] = commentUnescaper.Replace(value)
+	}
+	return fields
+}
+
+// savedRule is an -A line of iptables-save
+type savedRule struct {
+	Chain   string
+	Args    []string
+	Comment string
+}
+
+// splitSaveLine splits like the shell, iptables-save quotes arguments with
+// spaces like the log prefix
+func splitSaveLine(line string) []string {
+	args := []string{}
+	arg := strings.Builder{}
+	inArg, quoted, escaped := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped, inArg = true, true
+		case r == '"':
+			quoted, inArg = !quoted, true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+func parseSave(save string) []savedRule {
+	rules := []savedRule{}
+	for _, line := range strings.Split(save, "\n") {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		args := splitSaveLine(line)
+		if len(args) < 2 {
+			continue
+		}
+		rule := savedRule{Chain: args[1], Args: args[2:]}
+		for i, arg := range rule.Args {
+			if arg == "--comment" && i+1 < len(rule.Args) {
+				rule.Comment = rule.Args[i+1]
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// parseOwner returns the owner marked in chain, nil for chains of former
+// versions or new chains
+func parseOwner(rules []savedRule, chain string) *Owner {
+	for _, rule := range rules {
+		if rule.Chain != chain || !strings.HasPrefix(rule.Comment, ownerMark+",") {
+			continue
+		}
+		fields := ParseComment(rule.Comment)
+		generation, err := strconv.Atoi(fields["g"])
+		if err != nil {
+			continue
+		}
+		return &Owner{Instance: fields["i"], Generation: generation}
+	}
+	return nil
+}
+
+// claim returns the generation of self and if the rules of prev are kept,
+// prev is stopped while self holds the lock of the chains. The same instance
+// increments the generation.
+func claim(prev *Owner, self Owner, adopt bool) (int, bool) {
+	if prev == nil || prev.Instance != self.Instance {
+		return 1, false
+	}
+	return prev.Generation + 1, adopt
+}
+
+// staleRules returns the rules of chains with the comment of instance and
+// a generation before generation
+func staleRules(rules []savedRule, chains map[string]bool, instance string, generation int) []savedRule {
+	stale := []savedRule{}
+	for _, rule := range rules {
+		if !chains[rule.Chain] || strings.HasPrefix(rule.Comment, ownerMark+",") {
+			continue
+		}
+		fields := ParseComment(rule.Comment)
+		if fields["i"] != instance {
+			continue
+		}
+		g, err := strconv.Atoi(fields["g"])
+		if err != nil || g >= generation {
+			continue
+		}
+		stale = append(stale, rule)
+	}
+	return stale
+}
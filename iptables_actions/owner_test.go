@@ -0,0 +1,106 @@
+package iptables_actions
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSave = `# Generated by iptables-save
+*filter
+:FWD-STEINSTUECKEN - [0:0]
+:FWD-STEINSTUECKEN-1000 - [0:0]
+-A FWD-STEINSTUECKEN -m comment --comment owner,i=gw1,g=3
+-A FWD-STEINSTUECKEN -j FWD-STEINSTUECKEN-1000
+-A FWD-STEINSTUECKEN -j DROP
+-A FWD-STEINSTUECKEN-1000 -s 192.0.2.1/32 -p tcp -m tcp --sport 443 -m comment --comment i=gw1,g=3,t=0a1b2c3d,s=www.example.com:IN:A -j ACCEPT
+-A FWD-STEINSTUECKEN-1000 -d 192.0.2.1/32 -p tcp -m limit --limit 10/min -m comment --comment i=gw1,g=3,t=0a1b2c3d,s=www.example.com:IN:A -j LOG --log-prefix "www.example.com:IN:A "
+-A FWD-STEINSTUECKEN-1000 -d 192.0.2.2/32 -m comment --comment i=gw1,g=4,t=0a1b2c3d,s=www.example.com:IN:A -j ACCEPT
+-A FWD-STEINSTUECKEN-1000 -d 192.0.2.3/32 -m comment --comment i=gw2,g=1,t=0a1b2c3d,s=www.example.com:IN:A -j ACCEPT
+-A FORWARD -d 192.0.2.4/32 -m comment --comment i=gw1,g=1,t=0a1b2c3d,s=other -j ACCEPT
+COMMIT
+`
+
+func TestOwnerComment(t *testing.T) {
+	owner := Owner{Instance: "gw1", Generation: 3}
+	comment := owner.Comment("0a1b2c3d", "www.example.com:IN:A")
+	if comment != "i=gw1,g=3,t=0a1b2c3d,s=www.example.com:IN:A" {
+		t.Errorf("comment: %s", comment)
+	}
+	fields := ParseComment(comment)
+	if fields["i"] != "gw1" || fields["g"] != "3" || fields["t"] != "0a1b2c3d" || fields["s"] != "www.example.com:IN:A" {
+		t.Errorf("fields: %v", fields)
+	}
+	if len(owner.Comment("0a1b2c3d", strings.Repeat("a", 300))) != commentMax {
+		t.Errorf("not truncated")
+	}
+}
+
+func TestOwnerCommentEscape(t *testing.T) {
+	owner := Owner{Instance: "gw=1,a", Generation: 3}
+	comment := owner.Comment("0a1b2c3d", "a=b,g=9%")
+	if comment != "i=gw%3D1%2Ca,g=3,t=0a1b2c3d,s=a%3Db%2Cg%3D9%25" {
+		t.Errorf("comment: %s", comment)
+	}
+	fields := ParseComment(comment)
+	if len(fields) != 4 || fields["i"] != "gw=1,a" || fields["g"] != "3" || fields["s"] != "a=b,g=9%" {
+		t.Errorf("fields: %v", fields)
+	}
+	// the truncation does not cut an escape
+	for pad := 0; pad < 3; pad++ {
+		comment = owner.Comment("0a1b2c3d", strings.Repeat("a", 220+pad)+strings.Repeat(",", 20))
+		if len(comment) > commentMax || strings.Contains(comment[len(comment)-2:], "%") {
+			t.Errorf("cut escape: %s", comment)
+		}
+	}
+}
+
+func TestSplitSaveLine(t *testing.T) {
+	args := splitSaveLine(`-A FWD -j LOG --log-prefix "www.example.com:IN:A " --comment a\"b`)
+	if !reflect.DeepEqual(args, []string{"-A", "FWD", "-j", "LOG", "--log-prefix", "www.example.com:IN:A ", "--comment", `a"b`}) {
+		t.Errorf("args: %q", args)
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	rules := parseSave(testSave)
+	owner := parseOwner(rules, "FWD-STEINSTUECKEN")
+	if owner == nil || *owner != (Owner{Instance: "gw1", Generation: 3}) {
+		t.Errorf("owner: %v", owner)
+	}
+	if parseOwner(rules, "FWD-OTHER") != nil {
+		t.Errorf("owner of an unmarked chain")
+	}
+}
+
+func TestClaim(t *testing.T) {
+	self := Owner{Instance: "gw1"}
+	for _, tc := range []struct {
+		name       string
+		prev       *Owner
+		adopt      bool
+		generation int
+		keep       bool
+	}{
+		{"new", nil, true, 1, false},
+		{"restart", &Owner{Instance: "gw1", Generation: 3}, false, 4, false},
+		{"adopt", &Owner{Instance: "gw1", Generation: 3}, true, 4, true},
+		{"other instance", &Owner{Instance: "gw2", Generation: 7}, true, 1, false},
+	} {
+		generation, keep := claim(tc.prev, self, tc.adopt)
+		if generation != tc.generation || keep != tc.keep {
+			t.Errorf("%s: %d %v", tc.name, generation, keep)
+		}
+	}
+}
+
+func TestStaleRules(t *testing.T) {
+	chains := map[string]bool{"FWD-STEINSTUECKEN": true, "FWD-STEINSTUECKEN-1000": true}
+	stale := staleRules(parseSave(testSave), chains, "gw1", 4)
+	if len(stale) != 2 {
+		t.Fatalf("stale: %v", stale)
+	}
+	if stale[0].Args[1] != "192.0.2.1/32" || stale[1].Args[len(stale[1].Args)-1] != "www.example.com:IN:A " {
+		t.Errorf("stale: %q", stale)
+	}
+}
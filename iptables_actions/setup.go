@@ -1,7 +1,11 @@
 package iptables_actions
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/mabels/steinstuecken/cmd/cli"
@@ -17,22 +21,226 @@ type IpTableChain struct {
 }
 
 type IpTable struct {
-	Protocol iptables.Protocol
-	Execer   exec.Interface
-	IpTable  iptables.Interface
-	FWD      IpTableChain
-	NAT      IpTableChain
+	Protocol   iptables.Protocol
+	Execer     exec.Interface
+	IpTable    iptables.Interface
+	FWD        IpTableChain
+	NAT        IpTableChain
+	Priorities map[int]IpTableChain // jumped from FWD in ascending order
+	Owner      Owner                // in the comments of the rules
+	adopted    *Owner               // the kept rules of the previous generation
+}
+
+// PriorityChain returns the filter chain which holds the rules of targets with priority
+func (ipt *IpTable) PriorityChain(priority int) IpTableChain {
+	chain, found := ipt.Priorities[priority]
+	if !found {
+		return ipt.FWD
+	}
+	return chain
+}
+
+func priorityChainName(config *cli.Config, priority int) iptables.Chain {
+	return iptables.Chain(fmt.Sprintf("FWD-%s-%d", config.ChainName, priority))
+}
+
+func targetPriorities(config *cli.Config) []int {
+	found := map[int]bool{}
+	priorities := []int{}
+	for _, target := range config.Targets {
+		if !found[target.Priority] {
+			found[target.Priority] = true
+			priorities = append(priorities, target.Priority)
+		}
+	}
+	sort.Ints(priorities)
+	return priorities
+}
+
+// initPriorityChains creates a chain per target priority, which are jumped
+// from the FWD chain in ascending order, chains of former priorities are removed
+func initPriorityChains(zlog *zerolog.Logger, config *cli.Config, ret *IpTable) error {
+	keep := ret.adopted != nil
+	table := ret.IpTable
+	for _, priority := range targetPriorities(config) {
+		tableChain := IpTableChain{
+			Table:     ret.FWD.Table,
+			Chain:     priorityChainName(config, priority),
+			BaseChain: ret.FWD.Chain,
+		}
+		chainStr := string(tableChain.Chain)
+		_, err := table.EnsureChain(tableChain.Table, tableChain.Chain)
+		if err != nil {
+			zlog.Error().Str("chain", chainStr).Err(err).Msg("error ensuring priority chain")
+			return err
+		}
+		if !keep {
+			err = table.FlushChain(tableChain.Table, tableChain.Chain)
+			if err != nil {
+				zlog.Error().Str("chain", chainStr).Err(err).Msg("error flushing priority chain")
+				return err
+			}
+		}
+		_, err = table.EnsureRule(iptables.Prepend, tableChain.Table, tableChain.Chain, "-m", "comment", "--comment", priorityMark(config))
+		if err != nil {
+			zlog.Error().Str("chain", chainStr).Err(err).Msg("mark error ensuring priority rule")
+			return err
+		}
+		_, err = table.EnsureRule(iptables.Append, tableChain.Table, tableChain.BaseChain, "-j", chainStr)
+		if err != nil {
+			zlog.Error().Str("chain", chainStr).Err(err).Msg("jump error ensuring priority rule")
+			return err
+		}
+		ret.Priorities[priority] = tableChain
+	}
+	buf := bytes.NewBuffer(nil)
+	err := table.SaveInto(ret.FWD.Table, buf)
+	if err != nil {
+		zlog.Warn().Err(err).Msg("could not list chains, skipping cleanup of unused priority chains")
+		return nil
+	}
+	for _, chainStr := range unusedPriorityChains(parseSave(buf.String()), config, ret.Priorities) {
+		zlog.Info().Str("chain", chainStr).Msg("removing unused priority chain")
+		// the jump is left with the kept rules
+		_ = table.DeleteRule(ret.FWD.Table, ret.FWD.Chain, "-j", chainStr)
+		err = table.FlushChain(ret.FWD.Table, iptables.Chain(chainStr))
+		if err == nil {
+			err = table.DeleteChain(ret.FWD.Table, iptables.Chain(chainStr))
+		}
+		if err != nil {
+			zlog.Warn().Str("chain", chainStr).Err(err).Msg("error removing unused priority chain")
+		}
+	}
+	return nil
+}
+
+// priorityMark is the comment of the rule without verdict at the top of the
+// priority chains, a chain like the FWD chain of --chain-name NAME-1 is not
+// a priority chain of NAME
+func priorityMark(config *cli.Config) string {
+	return "priority:FWD-" + config.ChainName
+}
+
+// unusedPriorityChains returns the marked priority chains of config which
+// are not in priorities
+func unusedPriorityChains(rules []savedRule, config *cli.Config, priorities map[int]IpTableChain) []string {
+	prefix := fmt.Sprintf("FWD-%s-", config.ChainName)
+	mark := priorityMark(config)
+	unused := []string{}
+	for _, rule := range rules {
+		if rule.Comment != mark || !strings.HasPrefix(rule.Chain, prefix) {
+			continue
+		}
+		priority, err := strconv.Atoi(rule.Chain[len(prefix):])
+		if err != nil {
+			continue
+		}
+		if _, found := priorities[priority]; !found && indexOf(unused, rule.Chain) < 0 {
+			unused = append(unused, rule.Chain)
+		}
+	}
+	return unused
+}
+
+func indexOf(strs []string, str string) int {
+	for i, s := range strs {
+		if s == str {
+			return i
+		}
+	}
+	return -1
+}
+
+// claimChains reads the owner of the FWD chain under the lock of the
+// chains, the rules of the previous generation of the same instance are kept
+// with --adopt
+func claimChains(zlog *zerolog.Logger, config *cli.Config, ret *IpTable) {
+	ret.Owner = Owner{Instance: config.InstanceID, Generation: 1}
+	buf := bytes.NewBuffer(nil)
+	err := ret.IpTable.SaveInto(ret.FWD.Table, buf)
+	if err != nil {
+		zlog.Warn().Err(err).Msg("could not list chains, flushing without adopting")
+		return
+	}
+	rules := parseSave(buf.String())
+	prev := parseOwner(rules, string(ret.FWD.Chain))
+	generation, keep := claim(prev, ret.Owner, config.Adopt)
+	ret.Owner.Generation = generation
+	if keep && !hasPriorityJumps(rules, config, ret.FWD.Chain) {
+		// a new jump would be appended behind the final DROP
+		zlog.Warn().Msg("priorities changed, flushing instead of adopting")
+		keep = false
+	}
+	if keep {
+		ret.adopted = prev
+	}
+	if prev != nil && prev.Instance != ret.Owner.Instance {
+		zlog.Warn().Str("instance", prev.Instance).Msg("taking the chains of a stopped instance")
+	}
+	zlog.Info().Str("instance", ret.Owner.Instance).Int("generation", generation).Bool("adopted", keep).Msg("owning chains")
+}
+
+// hasPriorityJumps is true if chain jumps to the chains of all priorities
+func hasPriorityJumps(rules []savedRule, config *cli.Config, chain iptables.Chain) bool {
+	jumps := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Chain == string(chain) && len(rule.Args) == 2 && rule.Args[0] == "-j" {
+			jumps[rule.Args[1]] = true
+		}
+	}
+	for _, priority := range targetPriorities(config) {
+		if !jumps[string(priorityChainName(config, priority))] {
+			return false
+		}
+	}
+	return true
+}
+
+// RemoveStale removes the adopted rules of the previous generations, the
+// rules of the current one are installed in front of them
+func (ipt *IpTable) RemoveStale(zlog *zerolog.Logger) []error {
+	errs := []error{}
+	if ipt.adopted == nil {
+		return errs
+	}
+	chains := map[iptables.Table]map[string]bool{
+		ipt.FWD.Table: {string(ipt.FWD.Chain): true},
+		ipt.NAT.Table: {string(ipt.NAT.Chain): true},
+	}
+	for _, chain := range ipt.Priorities {
+		chains[chain.Table][string(chain.Chain)] = true
+	}
+	for table, tableChains := range chains {
+		buf := bytes.NewBuffer(nil)
+		err := ipt.IpTable.SaveInto(table, buf)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		stale := staleRules(parseSave(buf.String()), tableChains, ipt.Owner.Instance, ipt.Owner.Generation)
+		for _, rule := range stale {
+			err = ipt.IpTable.DeleteRule(table, iptables.Chain(rule.Chain), rule.Args...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		zlog.Info().Str("table", string(table)).Int("rules", len(stale)).Msg("removed stale rules")
+	}
+	return errs
 }
 
 type IpTables struct {
 	IpV4 *IpTable
 	IpV6 *IpTable
+	Log  cli.LogOptions
+	lock io.Closer // of the chains, held until the process ends
 }
 
 func initIPTable(zlog *zerolog.Logger, config *cli.Config, protocol iptables.Protocol) (*IpTable, error) {
 	ret := IpTable{
-		Execer:   exec.New(),
-		Protocol: protocol,
+		Execer:     exec.New(),
+		Protocol:   protocol,
+		Priorities: map[int]IpTableChain{},
 		FWD: IpTableChain{
 			Table:     iptables.TableFilter,
 			Chain:     iptables.Chain("FWD-" + config.ChainName),
@@ -46,6 +254,7 @@ func initIPTable(zlog *zerolog.Logger, config *cli.Config, protocol iptables.Pro
 	}
 	ret.IpTable = iptables.New(exec.New(), nil, protocol)
 	table := ret.IpTable
+	claimChains(zlog, config, &ret)
 
 	for _, tableChain := range []IpTableChain{ret.FWD, ret.NAT} {
 		chain := tableChain.Chain
@@ -55,17 +264,19 @@ func initIPTable(zlog *zerolog.Logger, config *cli.Config, protocol iptables.Pro
 			zlog.Error().Err(err).Msg("error ensuring chain")
 			return nil, err
 		}
-		err = table.DeleteRule(tableChain.Table, tableChain.BaseChain, "-j", chainStr)
-		if err != nil &&
-			!(strings.Contains(err.Error(), fmt.Sprintf("Chain '%s' does not exist", chainStr)) ||
-				strings.Contains(err.Error(), fmt.Sprintf("Couldn't load target `%s'", chainStr))) {
-			zlog.Error().Err(err).Msg("error deleting rule")
-			return nil, err
-		}
-		err = table.FlushChain(tableChain.Table, chain)
-		if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("error flushing chain \"%s\"", chainStr)) {
-			zlog.Error().Err(err).Msg("error flushing chain")
-			return nil, err
+		if ret.adopted == nil {
+			err = table.DeleteRule(tableChain.Table, tableChain.BaseChain, "-j", chainStr)
+			if err != nil &&
+				!(strings.Contains(err.Error(), fmt.Sprintf("Chain '%s' does not exist", chainStr)) ||
+					strings.Contains(err.Error(), fmt.Sprintf("Couldn't load target `%s'", chainStr))) {
+				zlog.Error().Err(err).Msg("error deleting rule")
+				return nil, err
+			}
+			err = table.FlushChain(tableChain.Table, chain)
+			if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("error flushing chain \"%s\"", chainStr)) {
+				zlog.Error().Err(err).Msg("error flushing chain")
+				return nil, err
+			}
 		}
 		_, err = table.EnsureChain(tableChain.Table, chain)
 		if err != nil {
@@ -81,7 +292,58 @@ func initIPTable(zlog *zerolog.Logger, config *cli.Config, protocol iptables.Pro
 			zlog.Error().Str("chain", chainStr).Str("table", string(tableChain.Table)).Err(err).Msg("jump error ensuring rule")
 			return nil, err
 		}
-		if !config.NoFinalDrop && tableChain.Table == iptables.TableFilter {
+		if tableChain.Table == iptables.TableFilter {
+			err = initPriorityChains(zlog, config, &ret)
+			if err != nil {
+				return nil, err
+			}
+			if queue := QueueDnsAnswers(config); queue != nil {
+				_, err = table.EnsureRule(iptables.Prepend, tableChain.Table, chain, queue...)
+				if err != nil {
+					zlog.Error().Str("chain", chainStr).Str("table", string(tableChain.Table)).Err(err).Msg("dns queue error ensuring rule")
+					return nil, err
+				}
+			}
+			if ret.adopted != nil {
+				_ = table.DeleteRule(tableChain.Table, chain, "-m", "comment", "--comment", ret.adopted.marker())
+			}
+			_, err = table.EnsureRule(iptables.Prepend, tableChain.Table, chain, "-m", "comment", "--comment", ret.Owner.marker())
+			if err != nil {
+				zlog.Error().Str("chain", chainStr).Str("table", string(tableChain.Table)).Err(err).Msg("owner error ensuring rule")
+				return nil, err
+			}
+			if LogDnsAnswers(config) {
+				// in front of the priority chains to see every forwarded answer
+				_, err = table.EnsureRule(iptables.Prepend, tableChain.Table, chain, LogDnsAnswersRule(config)...)
+				if err != nil {
+					zlog.Error().Str("chain", chainStr).Str("table", string(tableChain.Table)).Err(err).Msg("dns log error ensuring rule")
+					return nil, err
+				}
+			}
+		}
+		if config.Learn && tableChain.Table == iptables.TableFilter {
+			// every new connection is logged once and accepted
+			learnLog := []string{"-m", "conntrack", "--ctstate", "NEW", "-j", "NFLOG",
+				"--nflog-group", strconv.Itoa(config.Log.NflogGroup),
+				"--nflog-prefix", truncatePrefix(LearnLogPrefix(config), nflogPrefixMax)}
+			_, err = table.EnsureRule(iptables.Append, tableChain.Table, chain, learnLog...)
+			if err != nil {
+				zlog.Error().Str("chain", chainStr).Str("table", string(tableChain.Table)).Err(err).Msg("learn log error ensuring rule")
+				return nil, err
+			}
+			_, err = table.EnsureRule(iptables.Append, tableChain.Table, chain, "-j", "ACCEPT")
+			if err != nil {
+				zlog.Error().Str("chain", chainStr).Str("table", string(tableChain.Table)).Err(err).Msg("learn accept error ensuring rule")
+				return nil, err
+			}
+		} else if !config.NoFinalDrop && tableChain.Table == iptables.TableFilter {
+			if config.Log.Drops {
+				_, err = table.EnsureRule(iptables.Append, tableChain.Table, chain, DropLogJump(config)...)
+				if err != nil {
+					zlog.Error().Str("chain", chainStr).Str("table", string(tableChain.Table)).Err(err).Msg("log drop error ensuring rule")
+					return nil, err
+				}
+			}
 			_, err = table.EnsureRule(iptables.Append, tableChain.Table, chain, "-j", "DROP")
 			if err != nil {
 				zlog.Error().Str("chain", chainStr).Str("table", string(tableChain.Table)).Err(err).Msg("drop error ensuring rule")
@@ -98,27 +360,47 @@ func initIPTable(zlog *zerolog.Logger, config *cli.Config, protocol iptables.Pro
 	return &ret, nil
 }
 
+// RemoveStale removes the adopted rules of the previous generations
+func (ipts *IpTables) RemoveStale(zlog *zerolog.Logger) []error {
+	errs := []error{}
+	for _, ipt := range []*IpTable{ipts.IpV4, ipts.IpV6} {
+		if ipt != nil {
+			errs = append(errs, ipt.RemoveStale(zlog)...)
+		}
+	}
+	return errs
+}
+
+// InitIPTables locks the chains of --chain-name, a running instance in the
+// network namespace keeps its chains
 func InitIPTables(zlog *zerolog.Logger, config *cli.Config) (*IpTables, error) {
+	lock, err := lockChains(config.ChainName)
+	if err != nil {
+		zlog.Error().Str("chain-name", config.ChainName).Err(err).Msg("refusing to flush")
+		return nil, err
+	}
 	var ipv4 *IpTable
 	if !config.DisableIPv4 {
 		ipv4Log := zlog.With().Str("ipversion", "v4").Logger()
-		var err error
 		ipv4, err = initIPTable(&ipv4Log, config, iptables.ProtocolIpv4)
 		if err != nil {
+			lock.Close()
 			return nil, err
 		}
 	}
 	var ipv6 *IpTable
 	if !config.DisableIPv6 {
 		ipv6Log := zlog.With().Str("ipversion", "v6").Logger()
-		var err error
 		ipv6, err = initIPTable(&ipv6Log, config, iptables.ProtocolIpv6)
 		if err != nil {
+			lock.Close()
 			return nil, err
 		}
 	}
 	return &IpTables{
 		IpV4: ipv4,
 		IpV6: ipv6,
+		Log:  config.Log,
+		lock: lock,
 	}, nil
 }
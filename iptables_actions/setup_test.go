@@ -0,0 +1,29 @@
+package iptables_actions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mabels/steinstuecken/cmd/cli"
+)
+
+func TestUnusedPriorityChains(t *testing.T) {
+	rules := parseSave(`*filter
+:FWD-STEINSTUECKEN-100 - [0:0]
+:FWD-STEINSTUECKEN-200 - [0:0]
+:FWD-STEINSTUECKEN-1 - [0:0]
+:FWD-STEINSTUECKEN-1-100 - [0:0]
+-A FWD-STEINSTUECKEN-100 -m comment --comment priority:FWD-STEINSTUECKEN
+-A FWD-STEINSTUECKEN-200 -m comment --comment priority:FWD-STEINSTUECKEN
+-A FWD-STEINSTUECKEN-200 -d 192.0.2.1/32 -j ACCEPT
+-A FWD-STEINSTUECKEN-1 -j DROP
+-A FWD-STEINSTUECKEN-1-100 -m comment --comment priority:FWD-STEINSTUECKEN-1
+COMMIT
+`)
+	config := &cli.Config{ChainName: "STEINSTUECKEN"}
+	unused := unusedPriorityChains(rules, config, map[int]IpTableChain{100: {}})
+	// the chains of --chain-name STEINSTUECKEN-1 are not removed
+	if !reflect.DeepEqual(unused, []string{"FWD-STEINSTUECKEN-200"}) {
+		t.Errorf("unused: %v", unused)
+	}
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
-	// "context"
-	// "fmt"
-
+	"context"
 	"fmt"
-	"net"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/mabels/steinstuecken/admin"
 	"github.com/mabels/steinstuecken/cmd/cli"
 	dnsEvents "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/mabels/steinstuecken/dns_forwarder"
+	"github.com/mabels/steinstuecken/drop_reporter"
 	"github.com/mabels/steinstuecken/iptables_actions"
+	"github.com/mabels/steinstuecken/traffic"
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog"
 	// "sigs.k8s.io/external-dns/provider/google"
@@ -21,117 +24,55 @@ import (
 	// sigs.k8s.io/external-dns/provider/aws"
 )
 
-func cidrInTxt(txts []string) *string {
-	var ip *string = nil
-	for _, txt := range txts {
-		nip, _, err := net.ParseCIDR(txt)
-		if err != nil {
-			continue
-		}
-		if nip != nil {
-			ip = &txt
-			break
-		}
-	}
-	return ip
-}
-
-func getIPAddress(rr dns.RR) (string, bool, error) {
-	a, found := rr.(*dns.A)
-	if found {
-		ipA := a.A.String()
-		return ipA, false, nil
-	}
-	aaaa, found := rr.(*dns.AAAA)
-	if found {
-		ipA := aaaa.AAAA.String()
-		return ipA, false, nil
-	}
-	txt, found := rr.(*dns.TXT)
-	if found {
-		ip := cidrInTxt(txt.Txt)
-		if ip == nil {
-			return "", false, fmt.Errorf("found cidr in TXT record: %v", txt.Txt)
-		}
-		return *ip, false, nil
-	}
-	_, skip := rr.(*dns.CNAME)
-	return "", skip, fmt.Errorf("error casting to dns.A/TXT")
-}
-
-type actionFn func(action string, zlog *zerolog.Logger, ipA string, target *cli.Target) []error
-
-func selectIpTable(zlog *zerolog.Logger, ipts *iptables_actions.IpTables, target *cli.Target, subject dnsEvents.Subject, history []*dnsEvents.DnsResult) (actionFn, error) {
+func selectIpTable(zlog *zerolog.Logger, ipts *iptables_actions.IpTables, target *cli.Target, key string, family dnsEvents.Family) (actionFn, error) {
 	var iptable *iptables_actions.IpTable
-	switch subject.Key().Qtype {
-	case dns.TypeA:
+	switch family {
+	case dnsEvents.IPv4:
 		iptable = ipts.IpV4
-	case dns.TypeAAAA:
+	case dnsEvents.IPv6:
 		iptable = ipts.IpV6
-	case dns.TypeTXT:
-		dnsResult := dnsEvents.NewestValidHistory(history)
-		if len(dnsResult.Rrs) == 0 {
-			err := fmt.Errorf("no TXT records found")
-			zlog.Error().Err(err).Msg("LastValidHistor")
-			return nil, err
-		}
-		for _, _rr := range dnsResult.Rrs {
-			rr, found := _rr.(*dns.TXT)
-			if !found {
-				zlog.Warn().Str("_rr", _rr.String()).Msg("no dns.TXT")
-				continue
-			}
-			ipStr := cidrInTxt(rr.Txt)
-			if ipStr != nil {
-				ip, _, err := net.ParseCIDR(*ipStr)
-				if err != nil {
-					zlog.Error().Err(err).Str("ipStr", *ipStr).Msg("no ip")
-					continue
-				}
-				if ip == nil {
-					zlog.Error().Str("ipStr", *ipStr).Msg("no ip")
-					continue
-				}
-				if ip.To4() != nil {
-					iptable = ipts.IpV4
-				} else {
-					iptable = ipts.IpV6
-				}
-				break
-			} else {
-				zlog.Warn().Strs("txt", rr.Txt).Msg("no ip")
-			}
-			if iptable != nil {
-				break
-			}
-		}
-		if iptable == nil {
-			err := fmt.Errorf("no TXT records with valid IP found")
-			zlog.Error().Err(err).Msg("no iptable found")
-			return nil, err
-		}
 	default:
-		err := fmt.Errorf("unknown qtype %d", subject.Key().Qtype)
-		zlog.Error().Err(err).Uint16("qtype", subject.Key().Qtype).Msg("unknown qtype")
+		err := fmt.Errorf("unknown family %d", family)
+		zlog.Error().Err(err).Msg("unknown family")
 		return nil, err
 	}
 	if iptable == nil {
 		zlog.Debug().Msg("skipping iptable")
-		return func(add_remove string, alog *zerolog.Logger, ip string, target *cli.Target) []error {
+		return func(add_remove string, alog *zerolog.Logger, src string, dst string, target *cli.Target) []error {
 			return []error{}
 		}, nil
 	}
 	// var jump *iptables_actions.StringArrayBuilder
-	actionFunc := func(add_remove string, alog *zerolog.Logger, ip string, target *cli.Target) []error {
+	verdict := []string{"-j", "ACCEPT"}
+	switch target.Action {
+	case cli.ActionDrop:
+		verdict = []string{"-j", "DROP"}
+	case cli.ActionReject:
+		verdict = []string{"-j", "REJECT"}
+		if target.RejectWith != nil {
+			verdict = append(verdict, "--reject-with", cli.RejectWith(*target.RejectWith, iptable.IpTable.IsIpv6()))
+		}
+	}
+	fwd := iptable.PriorityChain(target.Priority)
+	comment := iptable.Owner.Comment(target.ID, key)
+	actionFunc := func(add_remove string, alog *zerolog.Logger, src string, dst string, target *cli.Target) []error {
 		jump := iptables_actions.NewStringArrayBuilder().
-			Add("-j", "ACCEPT").
-			Add("-m", "comment", "--comment", dnsEvents.KeySubject(subject.Key()))
-		return iptables_actions.Forward(add_remove, alog, iptable.FWD.Chain, iptable.FWD.Table, ip, target, iptable.IpTable, jump.Out)
+			Add(verdict...).
+			Add("-m", "comment", "--comment", comment)
+		ret := iptables_actions.Forward(add_remove, alog, fwd.Chain, fwd.Table, src, dst, target, iptable.IpTable, jump.Out)
+		if target.Log != nil {
+			// rules are prepended so the log rule ends up in front of the verdict
+			logJump := iptables_actions.NewStringArrayBuilder().
+				Add(iptables_actions.LogJump(&ipts.Log, *target.Log, key)...).
+				Add("-m", "comment", "--comment", comment)
+			ret = append(ret, iptables_actions.Forward(add_remove, alog, fwd.Chain, fwd.Table, src, dst, target, iptable.IpTable, logJump.Out)...)
+		}
+		return ret
 	}
 	forwardActionFunc := actionFunc
 	if target.Snat4 != nil || target.Snat6 != nil {
-		actionFunc = func(add_remove string, alog *zerolog.Logger, ip string, target *cli.Target) []error {
-			ret := forwardActionFunc(add_remove, alog, ip, target)
+		actionFunc = func(add_remove string, alog *zerolog.Logger, src string, dst string, target *cli.Target) []error {
+			ret := forwardActionFunc(add_remove, alog, src, dst, target)
 			var snat *string
 			if iptable.IpTable.IsIpv6() {
 				snat = target.Snat6
@@ -141,89 +82,102 @@ func selectIpTable(zlog *zerolog.Logger, ipts *iptables_actions.IpTables, target
 			if snat != nil {
 				jump := iptables_actions.NewStringArrayBuilder().
 					Add("-j", "SNAT", "--to-source", *snat).
-					Add("-m", "comment", "--comment", dnsEvents.KeySubject(subject.Key()))
-				ret = append(ret, iptables_actions.Forward(add_remove, alog, iptable.NAT.Chain, iptable.NAT.Table, ip, target, iptable.IpTable, jump.Out)...)
+					Add("-m", "comment", "--comment", comment)
+				ret = append(ret, iptables_actions.Forward(add_remove, alog, iptable.NAT.Chain, iptable.NAT.Table, src, dst, target, iptable.IpTable, jump.Out)...)
 			}
 			return ret
 		}
 	} else if target.Masq != nil {
-		actionFunc = func(add_remove string, alog *zerolog.Logger, ip string, target *cli.Target) []error {
-			ret := forwardActionFunc(add_remove, alog, ip, target)
+		actionFunc = func(add_remove string, alog *zerolog.Logger, src string, dst string, target *cli.Target) []error {
+			ret := forwardActionFunc(add_remove, alog, src, dst, target)
 			jump := iptables_actions.NewStringArrayBuilder().
 				Add("-j", "MASQUERADE").
-				Add("-m", "comment", "--comment", dnsEvents.KeySubject(subject.Key()))
-			ret = append(ret, iptables_actions.Forward(add_remove, alog, iptable.NAT.Chain, iptable.NAT.Table, ip, target, iptable.IpTable, jump.Out)...)
+				Add("-m", "comment", "--comment", comment)
+			ret = append(ret, iptables_actions.Forward(add_remove, alog, iptable.NAT.Chain, iptable.NAT.Table, src, dst, target, iptable.IpTable, jump.Out)...)
 			return ret
 		}
 	}
 	return actionFunc, nil
 }
 
-func bindFn(zlog *zerolog.Logger, target *cli.Target, subject dnsEvents.Subject, ipts *iptables_actions.IpTables) func(history []*dnsEvents.DnsResult) {
+func bindFn(zlog *zerolog.Logger, state *targetState, ipts *iptables_actions.IpTables) func(ev dnsEvents.AddressEvent) {
+	actionFns := map[dnsEvents.Family]actionFn{}
+	return func(ev dnsEvents.AddressEvent) {
+		if ev.Err != nil {
+			zlog.Error().Err(ev.Err).Msg("error resolving")
+			return
+		}
+		alog := zlog.With().Str("subject", ev.Key).Logger()
+		add, remove := splitChanges(ev, state.target)
+		dsts := map[string]actionFn{}
+		for _, addr := range add {
+			actionFunc, found := actionFns[addr.Family]
+			if !found {
+				var err error
+				actionFunc, err = selectIpTable(&alog, ipts, state.target, ev.Key, addr.Family)
+				if err != nil {
+					continue
+				}
+				actionFns[addr.Family] = actionFunc
+			}
+			dsts[addr.String()] = actionFunc
+		}
+		logErrs(&alog, state.UpdateDestinations(&alog, dsts, remove))
+	}
+}
+
+// onHistory adapts an address consumer to ActiveSubject.Bind
+func onHistory(subject dnsEvents.Subject, fn func(ev dnsEvents.AddressEvent)) func(history []*dnsEvents.DnsResult) {
 	return func(history []*dnsEvents.DnsResult) {
-		if history[0].Err != nil {
-			zlog.Error().Err(history[0].Err).Msg("error resolving")
-		} else {
-			actionFunc, err := selectIpTable(zlog, ipts, target, subject, history)
-			if err != nil {
-				return
+		ev := dnsEvents.NewEvent(subject.Key(), history)
+		fn(dnsEvents.AddressEvent{Key: ev.Key, Err: ev.Err, Changes: ev.Changes})
+	}
+}
+
+// sourceBindFn feeds the from= addresses into the target state
+func sourceBindFn(zlog *zerolog.Logger, state *targetState) func(ev dnsEvents.AddressEvent) {
+	return func(ev dnsEvents.AddressEvent) {
+		if ev.Err != nil {
+			zlog.Error().Err(ev.Err).Msg("error resolving source")
+			return
+		}
+		alog := zlog.With().Str("subject", ev.Key).Logger()
+		add, remove := splitChanges(ev, state.target)
+		srcs := make([]string, 0, len(add))
+		for _, addr := range add {
+			srcs = append(srcs, addr.String())
+		}
+		logErrs(&alog, state.UpdateSources(&alog, srcs, remove))
+	}
+}
+
+// splitChanges returns the added addresses of the families of the target
+// and the removed ones of an event, a change is both
+func splitChanges(ev dnsEvents.AddressEvent, target *cli.Target) ([]dnsEvents.Address, []string) {
+	add := []dnsEvents.Address{}
+	remove := []string{}
+	for _, change := range ev.Changes {
+		switch change.Action {
+		case dnsEvents.NewAdd:
+			if target.HasFamily(change.Current.Family) {
+				add = append(add, change.Current)
 			}
-			actions := dnsEvents.CurrentToActions(history)
-			for _, action := range actions {
-				errs := []error{}
-				alog := zlog.With().Int("histories", len(history)).Str("action", action.Action).Str("subject", dnsEvents.KeySubject(subject.Key())).Logger()
-				switch action.Action {
-				case "newAdd":
-					ipA, skip, err := getIPAddress(action.Current)
-					if skip {
-						continue
-					}
-					if err != nil {
-						zlog.Error().Err(err).Msg("newAdd error")
-						continue
-					}
-					errs = actionFunc("add", &alog, ipA, target)
-				case "change":
-					cipA, skip, err := getIPAddress(action.Current)
-					if skip {
-						continue
-					}
-					if err != nil {
-						zlog.Error().Err(err).Msg("current change error")
-						continue
-					}
-					pipA, skip, err := getIPAddress(action.Prev)
-					if skip {
-						continue
-					}
-					if err != nil {
-						zlog.Error().Err(err).Msg("prev change error")
-						continue
-					}
-					if cipA == pipA {
-						continue
-					}
-					errs = append(errs, actionFunc("remove", &alog, pipA, target)...)
-					errs = append(errs, actionFunc("add", &alog, cipA, target)...)
-				case "oldDel":
-					ipA, skip, err := getIPAddress(action.Prev)
-					if skip {
-						continue
-					}
-					if err != nil {
-						zlog.Error().Err(err).Msg("prev oldDel error")
-						continue
-					}
-					errs = actionFunc("remove", &alog, ipA, target)
-				default:
-					zlog.Fatal().Msg("unknown action")
-				}
-				if len(errs) > 0 {
-					zlog.Log().Errs("errors", errs).Msg("errors in iptables")
-				}
+		case dnsEvents.Change:
+			remove = append(remove, change.Prev.String())
+			if target.HasFamily(change.Current.Family) {
+				add = append(add, change.Current)
 			}
+		case dnsEvents.OldDel:
+			remove = append(remove, change.Prev.String())
 		}
 	}
+	return add, remove
+}
+
+func logErrs(zlog *zerolog.Logger, errs []error) {
+	if len(errs) > 0 {
+		zlog.Log().Errs("errors", errs).Msg("errors in iptables")
+	}
 }
 
 type dstSrc struct {
@@ -284,9 +238,209 @@ func selectIpTablesExecutable(zlog *zerolog.Logger, config *cli.Config) error {
 	return nil
 }
 
+func validate(out io.Writer, config *cli.Config, errs []error) int {
+	for _, err := range errs {
+		fmt.Fprintln(out, err.Error())
+	}
+	fmt.Fprintf(out, "%d valid targets, %d problems\n", len(config.Targets), len(errs))
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// forwardPolicy allows the names of the accepted targets and --dns-filter-allow
+func forwardPolicy(config *cli.Config) (*dns_forwarder.Policy, error) {
+	patterns := append([]string{}, config.DnsForward.Allow...)
+	for i := range config.Targets {
+		if config.Targets[i].Action != cli.ActionAccept {
+			continue
+		}
+		patterns = append(patterns, config.Targets[i].DnsNames()...)
+	}
+	return dns_forwarder.NewPolicy(patterns)
+}
+
+// answersMinTTL is the minimum time the addresses of the forwarded or
+// snooped answers are allowed, the longer one if both are enabled
+func answersMinTTL(config *cli.Config) time.Duration {
+	minTTL := time.Duration(0)
+	if config.DnsForward.Listen != "" {
+		minTTL = config.DnsForward.MinTTL
+	}
+	if config.DnsSnoop.Mode != "" && config.DnsSnoop.MinTTL > minTTL {
+		minTTL = config.DnsSnoop.MinTTL
+	}
+	return minTTL
+}
+
+// answerSubject binds the answers of the dns forwarder or the snooping to
+// the target state, the addresses are installed before Answer returns. A
+// single label is answered under the names of the search domains the
+// clients ask for.
+func answerSubject(zlog *zerolog.Logger, des *dnsEvents.DnsEventStream, answers *dns_forwarder.Answers,
+	state *targetState, source dnsEvents.AddressSource, ipts *iptables_actions.IpTables, minTTL time.Duration) {
+	subject, ok := cli.DnsSubject(source)
+	if !ok {
+		return
+	}
+	for _, name := range subject.Names() {
+		question := subject.Key()
+		question.Name = name
+		fs := &dnsEvents.ForwardedSubject{
+			Question: question,
+			MinTTL:   minTTL,
+		}
+		as, err := dnsEvents.NewActiveSubject(fs, des)
+		if err != nil {
+			zlog.Error().Err(err).Msg("error creating answered subject")
+			return
+		}
+		flog := zlog.With().Str("subject", dnsEvents.KeySubject(fs.Key())).Str("source", "answers").Logger()
+		as.Log = &flog
+		as.Bind(onHistory(fs, bindFn(as.Log, state, ipts)))
+		err = as.Activate()
+		if err != nil {
+			zlog.Error().Err(err).Msg("error activating answered subject")
+			return
+		}
+		answers.Register(fs)
+	}
+}
+
+// startSnoop authorizes the dns answers to the clients seen by nfqueue or
+// afpacket, nflog is read by startReporters
+func startSnoop(zlog *zerolog.Logger, config *cli.Config, answers *dns_forwarder.Answers) error {
+	slog := zlog.With().Str("component", "dns_snoop").Str("mode", config.DnsSnoop.Mode).Logger()
+	switch config.DnsSnoop.Mode {
+	case "nfqueue":
+		nq, err := traffic.ListenNfqueue(uint16(config.DnsSnoop.Queue))
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := traffic.SnoopNfqueue(nq, answers.Answer)
+			// the unbound queue is bypassed, the answers pass without snooping
+			slog.Error().Err(err).Msg("nfqueue reader stopped, answers bypass the queue")
+		}()
+	case "afpacket":
+		pc, err := traffic.CaptureDnsAnswers(config.DnsSnoop.Iface)
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := traffic.SnoopDnsAnswers(pc.Read, answers.Answer)
+			slog.Error().Err(err).Msg("packet capture stopped")
+		}()
+	default:
+		return nil
+	}
+	slog.Info().Msg("dns snooping started")
+	return nil
+}
+
+// startReporters reads the nflog group of the dns, drop and learn log rules,
+// the snooped dns answers feed the passive dns cache, the wildcard targets
+// and --dns-snoop=nflog
+func startReporters(zlog *zerolog.Logger, config *cli.Config, adm *admin.Admin, wcs *wildcards, answers *dns_forwarder.Answers) error {
+	listener, err := traffic.ListenNflog(uint16(config.Log.NflogGroup))
+	if err != nil {
+		return err
+	}
+	pdns := traffic.NewPassiveDNS(time.Hour)
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			pdns.Expire()
+		}
+	}()
+	dispatcher := traffic.NewDispatcher(zlog)
+	dispatcher.Handle(iptables_actions.DnsLogPrefix(config), func(pkt *traffic.Packet) {
+		msg, err := traffic.DnsAnswer(pkt)
+		if err != nil {
+			zlog.Debug().Err(err).Msg("error parsing dns answer")
+		}
+		if msg == nil {
+			return
+		}
+		pdns.Observe(msg)
+		if config.DnsSnoop.Mode == "nflog" {
+			// the answers observe the wildcards too
+			answers.Answer(msg)
+		} else if config.HasWildcards() {
+			wcs.ObserveMsg(msg)
+		}
+	})
+	if config.ReportDrops {
+		rlog := zlog.With().Str("component", "drop_reporter").Logger()
+		reporter := drop_reporter.NewDropReporter(&rlog, pdns)
+		dispatcher.Handle(iptables_actions.DropLogPrefix(config), reporter.Record)
+		if adm != nil {
+			adm.Handle("/drops", reporter)
+		}
+		if config.ReportInterval > 0 {
+			go func() {
+				for range time.Tick(config.ReportInterval) {
+					reporter.LogReport()
+				}
+			}()
+		}
+	}
+	if config.Learn {
+		llog := zlog.With().Str("component", "learn").Logger()
+		learner := drop_reporter.NewDropReporter(&llog, pdns)
+		dispatcher.Handle(iptables_actions.LearnLogPrefix(config), learner.Record)
+		if adm != nil {
+			adm.Handle("/learn", learner)
+		}
+		go func() {
+			for range time.Tick(config.LearnWindow) {
+				err := writeProposal(config.LearnOutput, learner.Entries())
+				if err != nil {
+					llog.Error().Err(err).Str("output", config.LearnOutput).Msg("error writing proposed targets")
+					continue
+				}
+				llog.Info().Str("output", config.LearnOutput).Msg("proposed targets written")
+			}
+		}()
+	}
+	go func() {
+		err := dispatcher.Run(listener)
+		zlog.Error().Err(err).Msg("nflog reader stopped")
+	}()
+	return nil
+}
+
+// writeProposal replaces output with the proposed targets
+func writeProposal(output string, entries []drop_reporter.DropEntry) error {
+	if output == "-" {
+		return drop_reporter.WriteProposal(os.Stdout, entries)
+	}
+	tmp := output + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = drop_reporter.WriteProposal(file, entries)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, output)
+}
+
 func main() {
 	zlog := zerolog.New(os.Stderr).With().Timestamp().Logger()
 	config, errs := cli.GetConfig(&zlog)
+	switch config.Command {
+	case "":
+	case "validate":
+		os.Exit(validate(os.Stdout, &config, errs))
+	default:
+		zlog.Fatal().Str("command", config.Command).Msg("unknown command, use validate")
+	}
 	if len(errs) > 0 {
 		zlog.Fatal().Errs("errors", errs).Msg("errors in config")
 	}
@@ -301,27 +455,85 @@ func main() {
 		zlog.Fatal().Err(err).Msg("error initializing iptables")
 	}
 
+	var adm *admin.Admin
+	if config.AdminListen != "" {
+		adm = admin.NewAdmin(&zlog)
+		err = adm.Start(config.AdminListen)
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("error starting admin server")
+		}
+		defer adm.Stop()
+	}
+	ctx := context.Background()
 	des := dnsEvents.NewDnsEventStream(&zlog)
-	defer des.Stop()
-	des.Start()
-	for _, _target := range config.Targets {
-		target := _target
-		for _, subject := range target.Subjects {
-
-			as, err := des.CreateSubject(subject)
+	defer des.Stop(ctx)
+	des.Start(ctx)
+	wlog := zlog.With().Str("component", "wildcards").Logger()
+	wcs := newWildcards(&wlog, des, ipts)
+	answers := dns_forwarder.NewAnswers()
+	if config.HasWildcards() {
+		answers.AddObserver(wcs)
+	}
+	answered := config.DnsForward.Listen != "" || config.DnsSnoop.Mode != ""
+	var forwarder *dns_forwarder.Forwarder
+	if config.DnsForward.Listen != "" {
+		flog := zlog.With().Str("component", "dns_forwarder").Logger()
+		forwarder = dns_forwarder.NewForwarder(&flog, config.DnsForward.Upstreams, answers)
+		if config.DnsForward.Filter != "" {
+			forwarder.Policy, err = forwardPolicy(&config)
 			if err != nil {
-				zlog.Error().Err(err).Msg("error creating subject")
-				continue
+				zlog.Fatal().Err(err).Msg("error creating dns filter")
 			}
-			as.Bind(bindFn(as.Log, &target, subject, ipts))
-			err = as.Activate()
-			if err != nil {
-				zlog.Error().Err(err).Msg("error activating subject")
-				continue
+			forwarder.RefuseRcode = dns.RcodeRefused
+			if config.DnsForward.Filter == "nxdomain" {
+				forwarder.RefuseRcode = dns.RcodeNameError
+			}
+		}
+	}
+	for _, _target := range config.Targets {
+		target := _target
+		state := newTargetState(&target)
+		if target.Wildcard != nil {
+			wcs.Add(&target, state)
+		}
+		for _, source := range target.From {
+			srclog := zlog.With().Str("source", source.Key()).Logger()
+			des.WatchSource(source, sourceBindFn(&srclog, state))
+		}
+		for _, source := range target.Sources {
+			tlog := zlog.With().Str("target", source.Key()).Logger()
+			des.WatchSource(source, bindFn(&tlog, state, ipts))
+			if answered {
+				answerSubject(&zlog, des, answers, state, source, ipts, answersMinTTL(&config))
 			}
-			as.Log.Info().Str("target", dnsEvents.KeySubject(as.Subject.Key())).Msg("activated")
 		}
 	}
+	if config.Adopt {
+		// the targets installed their rules in front of the adopted ones
+		time.AfterFunc(config.AdoptGrace, func() {
+			logErrs(&zlog, ipts.RemoveStale(&zlog))
+		})
+	}
+	if config.HasWildcards() {
+		go wcs.Run(10 * time.Second)
+	}
+	if iptables_actions.LogDnsAnswers(&config) {
+		err = startReporters(&zlog, &config, adm, wcs, answers)
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("error starting nflog reporters")
+		}
+	}
+	err = startSnoop(&zlog, &config, answers)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("error starting dns snooping")
+	}
+	if forwarder != nil {
+		err = forwarder.Start(config.DnsForward.Listen)
+		if err != nil {
+			zlog.Fatal().Err(err).Msg("error starting dns forwarder")
+		}
+		defer forwarder.Stop()
+	}
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	wg.Wait()
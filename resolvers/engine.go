@@ -0,0 +1,461 @@
+package resolvers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// muxConn sends the queries of all subjects over one connection and
+// dispatches the answers by their id
+type muxConn struct {
+	conn    *dns.Conn
+	stream  bool // tcp, a read error breaks the framing
+	lock    sync.Mutex
+	pending map[uint16]pendingQuery
+	sent    int
+	retired bool // no new queries, closed when the pending are answered
+	closed  bool
+	onClose func(*muxConn)
+}
+
+func dialMux(network, server string, timeout time.Duration, onClose func(*muxConn)) (*muxConn, error) {
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	mc := &muxConn{
+		conn:    &dns.Conn{Conn: conn},
+		stream:  network == "tcp",
+		pending: make(map[uint16]pendingQuery),
+		onClose: onClose,
+	}
+	go mc.readLoop()
+	return mc, nil
+}
+
+func (mc *muxConn) readLoop() {
+	for {
+		msg, err := mc.conn.ReadMsg()
+		if err != nil {
+			if _, ok := err.(net.Error); ok || mc.stream || mc.isClosed() {
+				mc.close()
+				return
+			}
+			// unparsable datagrams are dropped, the query times out
+			continue
+		}
+		mc.lock.Lock()
+		pq, found := mc.pending[msg.Id]
+		if found && len(msg.Question) == 1 && questionKey(msg.Question[0]) == questionKey(pq.question) {
+			delete(mc.pending, msg.Id)
+			pq.answer <- msg
+		}
+		done := mc.retired && len(mc.pending) == 0
+		mc.lock.Unlock()
+		if done {
+			mc.close()
+			return
+		}
+	}
+}
+
+func (mc *muxConn) isClosed() bool {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.closed
+}
+
+// close fails the pending queries
+func (mc *muxConn) close() {
+	mc.lock.Lock()
+	if mc.closed {
+		mc.lock.Unlock()
+		return
+	}
+	mc.closed = true
+	for id, pq := range mc.pending {
+		delete(mc.pending, id)
+		close(pq.answer)
+	}
+	mc.lock.Unlock()
+	mc.conn.Close()
+	mc.onClose(mc)
+}
+
+// send writes the query with a free id, the answer is sent to the channel
+// which is closed if the connection fails
+func (mc *muxConn) send(req *dns.Msg) (uint16, chan *dns.Msg, error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if mc.closed {
+		return 0, nil, fmt.Errorf("connection closed")
+	}
+	msg := req.Copy()
+	msg.Id = dns.Id()
+	for _, used := mc.pending[msg.Id]; used; _, used = mc.pending[msg.Id] {
+		msg.Id = dns.Id()
+	}
+	ch := make(chan *dns.Msg, 1)
+	mc.pending[msg.Id] = pendingQuery{question: msg.Question[0], answer: ch}
+	mc.sent++
+	err := mc.conn.WriteMsg(msg)
+	if err != nil {
+		delete(mc.pending, msg.Id)
+		return 0, nil, err
+	}
+	return msg.Id, ch, nil
+}
+
+func (mc *muxConn) cancel(id uint16) {
+	mc.lock.Lock()
+	delete(mc.pending, id)
+	done := mc.retired && len(mc.pending) == 0
+	mc.lock.Unlock()
+	if done {
+		mc.close()
+	}
+}
+
+type pendingQuery struct {
+	question dns.Question
+	answer   chan *dns.Msg
+}
+
+type flight struct {
+	done chan struct{}
+	res  *dns.Msg
+	err  error
+}
+
+type cacheEntry struct {
+	res        *dns.Msg
+	stored     time.Time
+	validUntil time.Time
+}
+
+// Engine is shared by the subjects, it multiplexes their queries over one
+// udp socket and one tcp connection per nameserver, sends identical
+// questions in flight once and asks A and AAAA together. The answers are
+// cached for their ttl, the watchers of a question are called if the
+// answer to the other address family changed.
+type Engine struct {
+	Timeout          time.Duration // default 2s
+	QueriesPerSocket int           // default 256, then a new udp socket with another source port is used
+	lock             sync.Mutex
+	conns            map[string]*muxConn // network/server
+	flights          map[string]*flight  // server/question
+	cache            map[string]cacheEntry
+	fingerprints     map[string]string // question → answer
+	watchers         map[string]map[uint64]func()
+	watchID          uint64
+	now              func() time.Time
+}
+
+func NewEngine() *Engine {
+	return &Engine{
+		conns:        make(map[string]*muxConn),
+		flights:      make(map[string]*flight),
+		cache:        make(map[string]cacheEntry),
+		fingerprints: make(map[string]string),
+		watchers:     make(map[string]map[uint64]func()),
+		now:          time.Now,
+	}
+}
+
+// DefaultEngine is used by the subjects without an own engine
+var DefaultEngine = NewEngine()
+
+func (e *Engine) timeout() time.Duration {
+	if e.Timeout == 0 {
+		return 2 * time.Second
+	}
+	return e.Timeout
+}
+
+func (e *Engine) queriesPerSocket() int {
+	if e.QueriesPerSocket == 0 {
+		return 256
+	}
+	return e.QueriesPerSocket
+}
+
+func questionKey(q dns.Question) string {
+	return fmt.Sprintf("%s/%d/%d", strings.ToLower(q.Name), q.Qtype, q.Qclass)
+}
+
+// Watch calls fn if an answer to q was received together with its sibling
+// and differs from the previous one
+func (e *Engine) Watch(q dns.Question, fn func()) func() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	key := questionKey(q)
+	if e.watchers[key] == nil {
+		e.watchers[key] = make(map[uint64]func())
+	}
+	e.watchID++
+	id := e.watchID
+	e.watchers[key][id] = fn
+	return func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		delete(e.watchers[key], id)
+		if len(e.watchers[key]) == 0 {
+			delete(e.watchers, key)
+		}
+	}
+}
+
+// sibling is the question of the other address family
+func sibling(q dns.Question) (dns.Question, bool) {
+	switch q.Qtype {
+	case dns.TypeA:
+		q.Qtype = dns.TypeAAAA
+	case dns.TypeAAAA:
+		q.Qtype = dns.TypeA
+	default:
+		return q, false
+	}
+	return q, true
+}
+
+func fingerprint(res *dns.Msg) string {
+	rrs := make([]string, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		// the ttl counts down
+		copied := dns.Copy(rr)
+		copied.Header().Ttl = 0
+		rrs = append(rrs, copied.String())
+	}
+	sort.Strings(rrs)
+	return fmt.Sprintf("%d:%s", res.Rcode, strings.Join(rrs, "|"))
+}
+
+// ttl is the minimum ttl of the answers, empty answers are cached for 1s
+func ttl(res *dns.Msg) time.Duration {
+	if len(res.Answer) == 0 {
+		return time.Second
+	}
+	min := res.Answer[0].Header().Ttl
+	for _, rr := range res.Answer[1:] {
+		if rr.Header().Ttl < min {
+			min = rr.Header().Ttl
+		}
+	}
+	return time.Duration(min) * time.Second
+}
+
+func (e *Engine) cached(key string) *dns.Msg {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	entry, found := e.cache[key]
+	if !found {
+		return nil
+	}
+	now := e.now()
+	if !now.Before(entry.validUntil) {
+		delete(e.cache, key)
+		return nil
+	}
+	// the ttl counts down, the refresh of a subject is not answered from
+	// the cache again
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	res := entry.res.Copy()
+	for _, rr := range res.Answer {
+		if rr.Header().Ttl > age {
+			rr.Header().Ttl -= age
+		} else {
+			rr.Header().Ttl = 0
+		}
+	}
+	return res
+}
+
+// Exchange asks server for q with recursion, answers from the cache or of
+// a query in flight are shared, timeout 0 is the Timeout of the engine. The
+// query is finished for the other subjects if ctx is done.
+func (e *Engine) Exchange(ctx context.Context, server string, q dns.Question, timeout time.Duration) (*dns.Msg, error) {
+	if timeout == 0 {
+		timeout = e.timeout()
+	}
+	if res := e.cached(server + "/" + questionKey(q)); res != nil {
+		return res, nil
+	}
+	f := e.fly(server, q, timeout, true)
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.res.Copy(), nil
+}
+
+// fly joins the query of q in flight or starts it
+func (e *Engine) fly(server string, q dns.Question, timeout time.Duration, pipeline bool) *flight {
+	key := server + "/" + questionKey(q)
+	f, leader := e.join(key)
+	if !leader {
+		return f
+	}
+	if sq, ok := sibling(q); pipeline && ok && e.cached(server+"/"+questionKey(sq)) == nil {
+		// the other family is asked at the same time and updates its watchers
+		e.fly(server, sq, timeout, false)
+	}
+	go func() {
+		f.res, f.err = e.query(server, q, timeout)
+		e.land(key, q, f, !pipeline)
+	}()
+	return f
+}
+
+func (e *Engine) join(key string) (*flight, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	f, found := e.flights[key]
+	if found {
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	e.flights[key] = f
+	return f, true
+}
+
+// land caches the answer and releases the waiting subjects, the watchers
+// of a sibling are called if its answer changed
+func (e *Engine) land(key string, q dns.Question, f *flight, isSibling bool) {
+	watchers := []func(){}
+	e.lock.Lock()
+	delete(e.flights, key)
+	if f.err == nil {
+		answerTTL := ttl(f.res)
+		now := e.now()
+		e.cache[key] = cacheEntry{res: f.res, stored: now, validUntil: now.Add(answerTTL)}
+		fp := fingerprint(f.res)
+		qkey := questionKey(q)
+		previous, seen := e.fingerprints[qkey]
+		// the watchers get the answer from the cache, it has to be valid
+		if isSibling && seen && previous != fp && answerTTL > 0 {
+			for _, fn := range e.watchers[qkey] {
+				watchers = append(watchers, fn)
+			}
+		}
+		e.fingerprints[qkey] = fp
+	}
+	e.lock.Unlock()
+	close(f.done)
+	for _, fn := range watchers {
+		fn()
+	}
+}
+
+func (e *Engine) query(server string, q dns.Question, timeout time.Duration) (*dns.Msg, error) {
+	req := dns.Msg{}
+	req.RecursionDesired = true
+	req.Question = []dns.Question{q}
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	res, err := e.exchangeOn("udp", server, &req, timeout)
+	if err == nil && res.Truncated {
+		res, err = e.exchangeOn("tcp", server, &req, timeout)
+	}
+	return res, err
+}
+
+// conn returns the pooled connection, udp sockets are replaced after
+// QueriesPerSocket queries
+func (e *Engine) conn(network, server string, timeout time.Duration) (*muxConn, error) {
+	key := network + "/" + server
+	e.lock.Lock()
+	mc, found := e.conns[key]
+	if found && network == "udp" {
+		mc.lock.Lock()
+		retire := mc.sent >= e.queriesPerSocket()
+		idle := len(mc.pending) == 0
+		mc.retired = retire
+		mc.lock.Unlock()
+		if retire {
+			delete(e.conns, key)
+			if idle {
+				go mc.close()
+			}
+			found = false
+		}
+	}
+	e.lock.Unlock()
+	if found {
+		return mc, nil
+	}
+	mc, err := dialMux(network, server, timeout, func(closed *muxConn) {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if e.conns[key] == closed {
+			delete(e.conns, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if other, found := e.conns[key]; found {
+		// dialed concurrently
+		go mc.close()
+		return other, nil
+	}
+	e.conns[key] = mc
+	return mc, nil
+}
+
+func (e *Engine) exchangeOn(network, server string, req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	// a pooled tcp connection may be closed by the server, it is retried once
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var mc *muxConn
+		mc, err = e.conn(network, server, timeout)
+		if err != nil {
+			return nil, err
+		}
+		var id uint16
+		var ch chan *dns.Msg
+		id, ch, err = mc.send(req)
+		if err != nil {
+			mc.close()
+			continue
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case res, ok := <-ch:
+			timer.Stop()
+			if !ok {
+				err = fmt.Errorf("%s %s: connection closed", network, server)
+				continue
+			}
+			return res, nil
+		case <-timer.C:
+			mc.cancel(id)
+			return nil, fmt.Errorf("%s %s: timeout after %s", network, server, timeout)
+		}
+	}
+	return nil, err
+}
+
+// Close closes the pooled connections
+func (e *Engine) Close() {
+	e.lock.Lock()
+	conns := make([]*muxConn, 0, len(e.conns))
+	for _, mc := range e.conns {
+		conns = append(conns, mc)
+	}
+	e.lock.Unlock()
+	for _, mc := range conns {
+		mc.close()
+	}
+}
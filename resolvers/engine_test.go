@@ -0,0 +1,333 @@
+package resolvers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func serve(t *testing.T, listen func() (*dns.Server, string, error), handler dns.Handler) (string, func()) {
+	server, addr, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server.Handler = handler
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	return addr, func() { server.Shutdown() }
+}
+
+func serveUDP(t *testing.T, handler dns.Handler) (string, func()) {
+	return serve(t, func() (*dns.Server, string, error) {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, "", err
+		}
+		return &dns.Server{PacketConn: pc}, pc.LocalAddr().String(), nil
+	}, handler)
+}
+
+type clock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *clock) Add(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// counting answers A and AAAA of every name, the AAAA address is read
+// from aaaa
+type counting struct {
+	queries sync.Map // qtype → *int32
+	aaaa    atomic.Value
+	gate    chan struct{}
+}
+
+func (c *counting) count(qtype uint16) int32 {
+	v, _ := c.queries.LoadOrStore(qtype, new(int32))
+	return atomic.LoadInt32(v.(*int32))
+}
+
+func (c *counting) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	v, _ := c.queries.LoadOrStore(q.Qtype, new(int32))
+	atomic.AddInt32(v.(*int32), 1)
+	if c.gate != nil && q.Qtype == dns.TypeA {
+		<-c.gate
+	}
+	res := dns.Msg{}
+	res.SetReply(req)
+	switch q.Qtype {
+	case dns.TypeA:
+		rr, _ := dns.NewRR(q.Name + " 60 IN A 192.0.2.1")
+		res.Answer = []dns.RR{rr}
+	case dns.TypeAAAA:
+		rr, _ := dns.NewRR(q.Name + " 60 IN AAAA " + c.aaaa.Load().(string))
+		res.Answer = []dns.RR{rr}
+	}
+	w.WriteMsg(&res)
+}
+
+func newCounting() *counting {
+	c := &counting{}
+	c.aaaa.Store("2001:db8::1")
+	return c
+}
+
+func TestEngineCoalesce(t *testing.T) {
+	handler := newCounting()
+	handler.gate = make(chan struct{})
+	addr, stop := serveUDP(t, handler)
+	defer stop()
+	e := NewEngine()
+	defer e.Close()
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := e.Exchange(context.Background(), addr, q, 0)
+			if err == nil && len(res.Answer) != 1 {
+				t.Errorf("answer: %v", res)
+			}
+			errs <- err
+		}()
+	}
+	for handler.count(dns.TypeA) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(handler.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if handler.count(dns.TypeA) != 1 {
+		t.Errorf("one A query expected: %d", handler.count(dns.TypeA))
+	}
+	if handler.count(dns.TypeAAAA) != 1 {
+		t.Errorf("AAAA should be pipelined: %d", handler.count(dns.TypeAAAA))
+	}
+	q.Qtype = dns.TypeAAAA
+	res, err := e.Exchange(context.Background(), addr, q, 0)
+	if err != nil || len(res.Answer) != 1 {
+		t.Errorf("AAAA: %v %v", res, err)
+	}
+	if handler.count(dns.TypeAAAA) != 1 || handler.count(dns.TypeA) != 1 {
+		t.Errorf("AAAA should be cached: %d", handler.count(dns.TypeAAAA))
+	}
+}
+
+func TestEngineWatch(t *testing.T) {
+	handler := newCounting()
+	addr, stop := serveUDP(t, handler)
+	defer stop()
+	now := &clock{now: time.Unix(1000, 0)}
+	e := NewEngine()
+	e.now = now.Now
+	defer e.Close()
+	qa := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	qaaaa := qa
+	qaaaa.Qtype = dns.TypeAAAA
+	changed := make(chan bool, 4)
+	e.Watch(qaaaa, func() { changed <- true })
+	e.Watch(qa, func() { t.Error("the asked question is not watched") })
+
+	// the first answer is no change, asking AAAA joins its pipelined flight
+	for round := int32(1); round <= 2; round++ {
+		if _, err := e.Exchange(context.Background(), addr, qa, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Exchange(context.Background(), addr, qaaaa, 0); err != nil {
+			t.Fatal(err)
+		}
+		if handler.count(dns.TypeAAAA) != round {
+			t.Errorf("pipelined AAAA queries: %d", handler.count(dns.TypeAAAA))
+		}
+		now.Add(61 * time.Second)
+	}
+
+	handler.aaaa.Store("2001:db8::2")
+	if _, err := e.Exchange(context.Background(), addr, qa, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the watcher of AAAA was not called")
+	}
+	select {
+	case <-changed:
+		t.Error("only one change expected")
+	case <-time.After(50 * time.Millisecond):
+	}
+	res, err := e.Exchange(context.Background(), addr, qaaaa, 0)
+	if err != nil || len(res.Answer) != 1 || res.Answer[0].(*dns.AAAA).AAAA.String() != "2001:db8::2" {
+		t.Errorf("cached AAAA: %v %v", res, err)
+	}
+}
+
+func TestEngineTruncated(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := dns.Msg{}
+		res.SetReply(req)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			res.Truncated = true
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN TXT big")
+			res.Answer = []dns.RR{rr}
+		}
+		w.WriteMsg(&res)
+	})
+	addr, stopUDP := serve(t, func() (*dns.Server, string, error) {
+		return &dns.Server{PacketConn: pc}, pc.LocalAddr().String(), nil
+	}, handler)
+	defer stopUDP()
+	_, stopTCP := serve(t, func() (*dns.Server, string, error) {
+		return &dns.Server{Listener: l}, l.Addr().String(), nil
+	}, handler)
+	defer stopTCP()
+
+	e := NewEngine()
+	defer e.Close()
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		res, err := e.Exchange(context.Background(), addr, dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassINET}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Truncated || len(res.Answer) != 1 {
+			t.Errorf("tcp answer expected: %v", res)
+		}
+	}
+}
+
+func TestEngineRetire(t *testing.T) {
+	lock := sync.Mutex{}
+	sources := map[string]bool{}
+	addr, stop := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		lock.Lock()
+		sources[w.RemoteAddr().String()] = true
+		lock.Unlock()
+		res := dns.Msg{}
+		res.SetReply(req)
+		w.WriteMsg(&res)
+	}))
+	defer stop()
+	e := NewEngine()
+	e.QueriesPerSocket = 2
+	defer e.Close()
+	for _, name := range []string{"a.", "b.", "c.", "d.", "e."} {
+		if _, err := e.Exchange(context.Background(), addr, dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassINET}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sources) != 3 {
+		t.Errorf("3 sockets expected: %v", sources)
+	}
+}
+
+func TestEngineTimeout(t *testing.T) {
+	addr, stop := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {}))
+	defer stop()
+	e := NewEngine()
+	defer e.Close()
+	start := time.Now()
+	_, err := e.Exchange(context.Background(), addr, dns.Question{Name: "a.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}, 100*time.Millisecond)
+	if err == nil {
+		t.Error("timeout expected")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("timeout too late: %s", time.Since(start))
+	}
+}
+
+func TestEngineContext(t *testing.T) {
+	addr, stop := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {}))
+	defer stop()
+	e := NewEngine()
+	defer e.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := e.Exchange(ctx, addr, dns.Question{Name: "a.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}, 5*time.Second)
+	if err != context.DeadlineExceeded {
+		t.Errorf("deadline expected: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("the deadline was not honoured: %s", time.Since(start))
+	}
+}
+
+func TestEngineCacheTTL(t *testing.T) {
+	handler := newCounting()
+	addr, stop := serveUDP(t, handler)
+	defer stop()
+	now := &clock{now: time.Unix(1000, 0)}
+	e := NewEngine()
+	e.now = now.Now
+	defer e.Close()
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, err := e.Exchange(context.Background(), addr, q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := res.Answer[0].Header().Ttl
+	now.Add(25 * time.Second)
+	res, err = e.Exchange(context.Background(), addr, q, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cached answer is refreshed when the entry expires
+	if handler.count(dns.TypeA) != 1 || res.Answer[0].Header().Ttl != first-25 {
+		t.Errorf("cached ttl %d of %d, queries %d", res.Answer[0].Header().Ttl, first, handler.count(dns.TypeA))
+	}
+}
+
+func TestEngineUnwatch(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	unwatch := e.Watch(q, func() {})
+	other := e.Watch(q, func() {})
+	unwatch()
+	if len(e.watchers[questionKey(q)]) != 1 {
+		t.Errorf("watchers: %d", len(e.watchers[questionKey(q)]))
+	}
+	other()
+	if len(e.watchers) != 0 {
+		t.Errorf("released watchers are kept")
+	}
+}
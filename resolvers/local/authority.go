@@ -0,0 +1,248 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RootHints are the ipv4 addresses of the root servers a to m
+var RootHints = []string{
+	"198.41.0.4", "199.9.14.201", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	maxReferrals = 16 // zone cuts followed for one name
+	maxDepth     = 8  // nested lookups of cnames and nameserver names
+)
+
+type nsEntry struct {
+	servers    []string
+	validUntil time.Time
+}
+
+// Authority resolves names with the authoritative nameservers of their
+// zone, which are found by following the referrals from the Hints. The
+// nameservers of the zones are cached for the ttl of their NS records.
+type Authority struct {
+	Hints   []string      // ip[:port], default RootHints
+	Port    string        // port of the referred nameservers, default 53
+	Timeout time.Duration // default 3s per server
+	lock    sync.Mutex
+	zones   map[string]nsEntry
+	now     func() time.Time
+}
+
+func (a *Authority) getNow() time.Time {
+	if a.now == nil {
+		return time.Now()
+	}
+	return a.now()
+}
+
+func (a *Authority) port() string {
+	if a.Port == "" {
+		return "53"
+	}
+	return a.Port
+}
+
+func (a *Authority) hints() []string {
+	hints := a.Hints
+	if len(hints) == 0 {
+		hints = RootHints
+	}
+	out := make([]string, 0, len(hints))
+	for _, hint := range hints {
+		out = append(out, append53(hint))
+	}
+	return out
+}
+
+// closest returns the cached zone nearest to name or the root with the hints
+func (a *Authority) closest(name string) (string, []string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := a.getNow()
+	labels := dns.SplitDomainName(name)
+	for i := range labels {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		entry, found := a.zones[zone]
+		if !found {
+			continue
+		}
+		if !now.Before(entry.validUntil) {
+			delete(a.zones, zone)
+			continue
+		}
+		return zone, entry.servers
+	}
+	return ".", a.hints()
+}
+
+func (a *Authority) cacheZone(zone string, servers []string, ttl time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.zones == nil {
+		a.zones = make(map[string]nsEntry)
+	}
+	a.zones[zone] = nsEntry{servers: servers, validUntil: a.getNow().Add(ttl)}
+}
+
+// referral returns the NS records of a delegation below zone towards name
+func referral(res *dns.Msg, zone, name string) (string, []*dns.NS) {
+	child := ""
+	nss := []*dns.NS{}
+	for _, rr := range res.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		child = owner
+		nss = append(nss, ns)
+	}
+	return child, nss
+}
+
+// ask sends the question without recursion to the servers in order until
+// one answers authoritative or refers to a zone below zone
+func (a *Authority) ask(ctx context.Context, servers []string, zone, name string, qtype uint16) (*dns.Msg, error) {
+	req := dns.Msg{}
+	req.SetQuestion(name, qtype)
+	req.RecursionDesired = false
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = 3 * time.Second
+	}
+	var lastErr error = fmt.Errorf("no nameserver for %s", zone)
+	for _, server := range servers {
+		client := dns.Client{Timeout: timeout}
+		res, _, err := client.ExchangeContext(ctx, &req, server)
+		if err == nil && res.Truncated {
+			client.Net = "tcp"
+			res, _, err = client.ExchangeContext(ctx, &req, server)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("%s: %w", server, err)
+			continue
+		}
+		if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s: %s", server, dns.RcodeToString[res.Rcode])
+			continue
+		}
+		if res.Authoritative {
+			return res, nil
+		}
+		if child, _ := referral(res, zone, name); child != "" {
+			return res, nil
+		}
+		lastErr = fmt.Errorf("%s: not authoritative for %s", server, name)
+	}
+	return nil, lastErr
+}
+
+// nameservers returns the addresses of the NS records, from the glue of
+// the referral or resolved with the authority
+func (a *Authority) nameservers(ctx context.Context, res *dns.Msg, nss []*dns.NS, depth int) []string {
+	servers := []string{}
+	for _, ns := range nss {
+		for _, rr := range res.Extra {
+			if !strings.EqualFold(rr.Header().Name, ns.Ns) {
+				continue
+			}
+			switch v := rr.(type) {
+			case *dns.A:
+				servers = append(servers, net.JoinHostPort(v.A.String(), a.port()))
+			case *dns.AAAA:
+				servers = append(servers, net.JoinHostPort(v.AAAA.String(), a.port()))
+			}
+		}
+	}
+	if len(servers) > 0 {
+		return servers
+	}
+	for _, ns := range nss {
+		glueless, err := a.resolve(ctx, strings.ToLower(ns.Ns), dns.TypeA, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range glueless.Answer {
+			if v, ok := rr.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(v.A.String(), a.port()))
+			}
+		}
+	}
+	return servers
+}
+
+// Exchange returns the authoritative answer of a question, cnames to other
+// zones are followed and their answers are appended
+func (a *Authority) Exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return a.resolve(ctx, dns.Fqdn(strings.ToLower(name)), qtype, 0)
+}
+
+func (a *Authority) resolve(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%s: too many nested lookups", name)
+	}
+	zone, servers := a.closest(name)
+	for i := 0; i < maxReferrals; i++ {
+		res, err := a.ask(ctx, servers, zone, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if res.Authoritative {
+			return a.followCname(ctx, res, name, qtype, depth)
+		}
+		child, nss := referral(res, zone, name)
+		servers = a.nameservers(ctx, res, nss, depth)
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("%s: no address of the nameservers of %s", name, child)
+		}
+		ttl := time.Duration(nss[0].Hdr.Ttl) * time.Second
+		a.cacheZone(child, servers, ttl)
+		zone = child
+	}
+	return nil, fmt.Errorf("%s: too many referrals", name)
+}
+
+// followCname resolves the target of a cname answer without records of qtype
+func (a *Authority) followCname(ctx context.Context, res *dns.Msg, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	target := ""
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype == qtype {
+			return res, nil
+		}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target = strings.ToLower(cname.Target)
+		}
+	}
+	if target == "" || qtype == dns.TypeCNAME {
+		return res, nil
+	}
+	chained, err := a.resolve(ctx, target, qtype, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	res.Answer = append(res.Answer, chained.Answer...)
+	res.Rcode = chained.Rcode
+	return res, nil
+}
@@ -0,0 +1,164 @@
+package local
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeHierarchy serves the root on 127.0.0.1, com. and org. on 127.0.0.2
+// and example.com. and other.org. on 127.0.0.3, all on the same port
+func fakeHierarchy(t *testing.T, queries map[string]int, lock *sync.Mutex) (string, func()) {
+	zones := map[string][]string{
+		"127.0.0.1": {
+			"com. 3600 IN NS ns.tld.",
+			"org. 3600 IN NS ns.tld.",
+			"ns.tld. 3600 IN A 127.0.0.2",
+		},
+		"127.0.0.2": {
+			"example.com. 60 IN NS ns.example.com.",
+			"ns.example.com. 60 IN A 127.0.0.3",
+			// glueless, ns.example.com has to be resolved
+			"other.org. 60 IN NS ns.example.com.",
+		},
+		"127.0.0.3": {
+			"www.example.com. 30 IN CNAME www.other.org.",
+			"ns.example.com. 60 IN A 127.0.0.3",
+			"www.other.org. 20 IN A 192.0.2.1",
+			"www.other.org. 20 IN AAAA 2001:db8::1",
+		},
+	}
+	port := "0"
+	stops := []func(){}
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+		ip := ip
+		records := []dns.RR{}
+		for _, line := range zones[ip] {
+			rr, err := dns.NewRR(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rr)
+		}
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("no loopback address %s: %v", ip, err)
+		}
+		_, port, _ = net.SplitHostPort(pc.LocalAddr().String())
+		started := make(chan bool)
+		server := &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) }}
+		server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			q := req.Question[0]
+			lock.Lock()
+			queries[ip]++
+			lock.Unlock()
+			if req.RecursionDesired {
+				t.Errorf("recursion desired")
+			}
+			res := dns.Msg{}
+			res.SetReply(req)
+			for _, rr := range records {
+				owner := rr.Header().Name
+				switch {
+				case rr.Header().Rrtype == dns.TypeNS && dns.IsSubDomain(owner, q.Name):
+					res.Ns = append(res.Ns, rr)
+				case owner == q.Name && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME):
+					res.Answer = append(res.Answer, rr)
+					res.Authoritative = true
+				}
+			}
+			if len(res.Ns) > 0 && len(res.Answer) == 0 {
+				for _, rr := range records {
+					for _, ns := range res.Ns {
+						if rr.Header().Name == ns.(*dns.NS).Ns {
+							res.Extra = append(res.Extra, rr)
+						}
+					}
+				}
+			} else {
+				res.Ns = nil
+				res.Authoritative = true
+			}
+			w.WriteMsg(&res)
+		})
+		go server.ActivateAndServe()
+		<-started
+		stops = append(stops, func() { server.Shutdown() })
+	}
+	return port, func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+func TestAuthority(t *testing.T) {
+	queries := map[string]int{}
+	lock := sync.Mutex{}
+	port, stop := fakeHierarchy(t, queries, &lock)
+	defer stop()
+	now := time.Unix(1000, 0)
+	a := &Authority{Hints: []string{"127.0.0.1:" + port}, Port: port, Timeout: time.Second}
+	a.now = func() time.Time { return now }
+
+	res, err := a.Exchange(context.Background(), "WWW.example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers := []string{}
+	for _, rr := range res.Answer {
+		answers = append(answers, strings.ReplaceAll(rr.String(), "\t", " "))
+	}
+	if len(answers) != 2 || answers[1] != "www.other.org. 20 IN A 192.0.2.1" {
+		t.Errorf("answers: %v", answers)
+	}
+	if !res.Authoritative {
+		t.Errorf("not authoritative")
+	}
+
+	lock.Lock()
+	root := queries["127.0.0.1"]
+	lock.Unlock()
+	// the zones are cached, the root is not asked again
+	_, err = a.Exchange(context.Background(), "www.other.org.", dns.TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	if queries["127.0.0.1"] != root {
+		t.Errorf("root asked again: %d %d", queries["127.0.0.1"], root)
+	}
+	lock.Unlock()
+	zone, servers := a.closest("www.other.org.")
+	if zone != "other.org." || len(servers) != 1 || servers[0] != "127.0.0.3:"+port {
+		t.Errorf("cached zone: %s %v", zone, servers)
+	}
+	now = now.Add(61 * time.Second)
+	zone, _ = a.closest("www.other.org.")
+	if zone != "org." {
+		t.Errorf("expired zone: %s", zone)
+	}
+}
+
+func TestResolverAuthority(t *testing.T) {
+	queries := map[string]int{}
+	lock := sync.Mutex{}
+	port, stop := fakeHierarchy(t, queries, &lock)
+	defer stop()
+	r := LocalResolver{
+		OnlyAuthoritative: true,
+		Authority:         &Authority{Hints: []string{"127.0.0.1:" + port}, Port: port},
+	}
+	result, err := r.Resolve("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Authoritative || len(result.A) != 1 || len(result.AAAA) != 1 || result.TTL != 20*time.Second {
+		t.Errorf("result: %+v", result)
+	}
+}
@@ -1,72 +1,242 @@
 package local
 
-// type DNSEntry struct {
-// 	ValidUntil time.Time
-// 	Entry      string
-// 	Results    []resolvers.DNSResult
-// 	Resolvers  []*net.Resolver
-// }
-
-// type DNSCache struct {
-// 	Entries map[string]DNSEntry
-// }
-
-// type LocalResolver struct {
-// 	OnlyAuthoritative bool
-// 	Timeout           time.Duration
-// 	SysResolver       bool
-// 	DNSServer         []string
-// 	resolvers         []*net.Resolver
-// 	cache             DNSCache
-// }
-
-// func append53(addr string) string {
-// 	host, port, err := net.SplitHostPort(addr)
-// 	if err != nil {
-// 		return addr
-// 	}
-// 	if port == "" {
-// 		port = "53"
-// 	}
-// 	return fmt.Sprintf("%s:%s", host, port)
-// }
-
-// func (r *LocalResolver) Resolve(name string) (resolvers.DNSResult, error) {
-// 	if len(r.resolvers) == 0 {
-// 		if r.SysResolver {
-// 			r.resolvers = []*net.Resolver{net.DefaultResolver}
-// 		} else {
-// 			for _, addr := range r.DNSServer {
-// 				r.resolvers = append(r.resolvers, &net.Resolver{
-// 					PreferGo: !r.SysResolver,
-// 					Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-// 						if r.Timeout == 0 {
-// 							r.Timeout = 3 * time.Second
-// 						}
-// 						d := net.Dialer{
-// 							Timeout: r.Timeout,
-// 						}
-// 						return d.DialContext(ctx, network, append53(addr))
-// 					},
-// 				})
-// 			}
-// 		}
-// 	}
-// 	for _, resolver := range r.resolvers {
-// 		if r.OnlyAuthoritative {
-// 			// test NS
-// 			result, err := r.cache.LookupNS(name)
-
-// 		}
-// 		r.cache.L
-// 		// test SRV
-// 		// test CNAME
-// 		// test A and AAAA
-// 		ips, err := resolver.LookupIPAddr(context.Background(), name)
-// 		if err == nil {
-// 			return ips, nil
-// 		}
-// 	}
-
-// 	return resolvers.DNSResult{}, nil
-// }
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mabels/steinstuecken/resolvers"
+	"github.com/miekg/dns"
+)
+
+type DNSEntry struct {
+	ValidUntil time.Time
+	Result     resolvers.DNSResult
+}
+
+// DNSCache keeps the results until their ttl expired
+type DNSCache struct {
+	lock    sync.Mutex
+	Entries map[string]DNSEntry
+}
+
+func (c *DNSCache) Get(name string, now time.Time) (resolvers.DNSResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, found := c.Entries[name]
+	if !found || !now.Before(entry.ValidUntil) {
+		return resolvers.DNSResult{}, false
+	}
+	return entry.Result, true
+}
+
+func (c *DNSCache) Put(result resolvers.DNSResult, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Entries == nil {
+		c.Entries = make(map[string]DNSEntry)
+	}
+	c.Entries[result.Name] = DNSEntry{
+		ValidUntil: now.Add(result.TTL),
+		Result:     result,
+	}
+}
+
+// Expire removes the entries which are no longer valid
+func (c *DNSCache) Expire(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, entry := range c.Entries {
+		if !now.Before(entry.ValidUntil) {
+			delete(c.Entries, name)
+		}
+	}
+}
+
+// LocalResolver resolves the A and AAAA records of a name with the
+// DNSServer or the nameservers of ResolvConf and caches them for their ttl.
+// With OnlyAuthoritative the authoritative nameservers are asked, they are
+// found from the DNSServer as hints or the root servers.
+type LocalResolver struct {
+	OnlyAuthoritative bool          // ask the authoritative nameservers without recursion
+	Authority         *Authority    // of OnlyAuthoritative, default with the DNSServer as hints
+	Timeout           time.Duration // default 3s per server
+	SysResolver       bool          // use the nameservers of ResolvConf
+	ResolvConf        string        // default /etc/resolv.conf
+	DNSServer         []string      // ip[:port]
+	MinTTL            time.Duration // default 5s, also the ttl of empty answers without SOA
+	cache             DNSCache
+	authorityOnce     sync.Once
+	now               func() time.Time
+}
+
+func append53(addr string) string {
+	host, port, err := resolvers.SplitNameserver(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (r *LocalResolver) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return 3 * time.Second
+	}
+	return r.Timeout
+}
+
+func (r *LocalResolver) minTTL() time.Duration {
+	if r.MinTTL == 0 {
+		return 5 * time.Second
+	}
+	return r.MinTTL
+}
+
+func (r *LocalResolver) getNow() time.Time {
+	if r.now == nil {
+		return time.Now()
+	}
+	return r.now()
+}
+
+func (r *LocalResolver) servers() ([]string, error) {
+	if len(r.DNSServer) > 0 && !r.SysResolver {
+		out := make([]string, 0, len(r.DNSServer))
+		for _, addr := range r.DNSServer {
+			out = append(out, append53(addr))
+		}
+		return out, nil
+	}
+	rc, err := resolvers.SharedResolvConf(r.ResolvConf).Get()
+	if err != nil {
+		return nil, err
+	}
+	return rc.Nameservers, nil
+}
+
+func (r *LocalResolver) authority() *Authority {
+	r.authorityOnce.Do(func() {
+		if r.Authority == nil {
+			r.Authority = &Authority{Hints: r.DNSServer, Timeout: r.Timeout}
+		}
+	})
+	return r.Authority
+}
+
+// exchange asks the servers in order until one answers, truncated
+// answers are repeated with tcp
+func (r *LocalResolver) exchange(servers []string, name string, qtype uint16) (*dns.Msg, error) {
+	if r.OnlyAuthoritative {
+		return r.authority().Exchange(context.Background(), name, qtype)
+	}
+	req := dns.Msg{}
+	req.SetQuestion(name, qtype)
+	var lastErr error = fmt.Errorf("no nameserver for %s", name)
+	for _, server := range servers {
+		client := dns.Client{Timeout: r.timeout()}
+		res, _, err := client.Exchange(&req, server)
+		if err == nil && res.Truncated {
+			client.Net = "tcp"
+			res, _, err = client.Exchange(&req, server)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", server, err)
+			continue
+		}
+		if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s: %s", server, dns.RcodeToString[res.Rcode])
+			continue
+		}
+		return res, nil
+	}
+	return nil, lastErr
+}
+
+// answerTTL is the minimum ttl of the answers or of the SOA of an empty
+// answer
+func answerTTL(res *dns.Msg) (time.Duration, bool) {
+	ttl := uint32(0)
+	found := false
+	for _, rr := range res.Answer {
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	if found {
+		return time.Duration(ttl) * time.Second, true
+	}
+	for _, rr := range res.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl = soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		return time.Duration(ttl) * time.Second, true
+	}
+	return 0, false
+}
+
+func sortAddrs(addrs []netip.Addr) {
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Less(addrs[j])
+	})
+}
+
+func (r *LocalResolver) Resolve(name string) (resolvers.DNSResult, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	now := r.getNow()
+	if result, found := r.cache.Get(name, now); found {
+		return result, nil
+	}
+	r.cache.Expire(now)
+	servers := []string{}
+	if !r.OnlyAuthoritative {
+		var err error
+		servers, err = r.servers()
+		if err != nil {
+			return resolvers.DNSResult{}, err
+		}
+	}
+	result := resolvers.DNSResult{Name: name, A: []netip.Addr{}, AAAA: []netip.Addr{}, Authoritative: true}
+	ttl := time.Duration(-1)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		res, err := r.exchange(servers, name, qtype)
+		if err != nil {
+			return resolvers.DNSResult{}, err
+		}
+		result.Authoritative = result.Authoritative && res.Authoritative
+		for _, rr := range res.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				if addr, ok := netip.AddrFromSlice(v.A.To4()); ok {
+					result.A = append(result.A, addr)
+				}
+			case *dns.AAAA:
+				if addr, ok := netip.AddrFromSlice(v.AAAA.To16()); ok {
+					result.AAAA = append(result.AAAA, addr)
+				}
+			}
+		}
+		if qttl, ok := answerTTL(res); ok && (ttl < 0 || qttl < ttl) {
+			ttl = qttl
+		}
+	}
+	if ttl < r.minTTL() {
+		ttl = r.minTTL()
+	}
+	result.TTL = ttl
+	sortAddrs(result.A)
+	sortAddrs(result.AAAA)
+	r.cache.Put(result, now)
+	return result, nil
+}
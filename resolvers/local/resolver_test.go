@@ -1,8 +1,130 @@
 package local
 
-// func TestResolver(t *testing.T) {
-// 	resolver := LocalResolver{
-// 		DNSServer: "1.1.1.1"
-// 	}
-// 	resolver.Resolve("www.adviser.com")
-// }
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func serveUDP(t *testing.T, handler dns.Handler) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func zone(queries *int32, authoritative bool) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		res := dns.Msg{}
+		res.SetReply(req)
+		res.Authoritative = authoritative
+		res.RecursionAvailable = req.RecursionDesired
+		q := req.Question[0]
+		switch {
+		case q.Name == "www.example.com." && q.Qtype == dns.TypeA:
+			cname, _ := dns.NewRR("www.example.com. 300 IN CNAME cdn.example.com.")
+			a2, _ := dns.NewRR("cdn.example.com. 60 IN A 192.0.2.2")
+			a1, _ := dns.NewRR("cdn.example.com. 60 IN A 192.0.2.1")
+			res.Answer = []dns.RR{cname, a2, a1}
+		case q.Name == "www.example.com." && q.Qtype == dns.TypeAAAA:
+			aaaa, _ := dns.NewRR("www.example.com. 120 IN AAAA 2001:db8::1")
+			res.Answer = []dns.RR{aaaa}
+		default:
+			soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 86400 10")
+			res.Ns = []dns.RR{soa}
+			res.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(&res)
+	})
+}
+
+func TestResolver(t *testing.T) {
+	var queries int32
+	addr, stop := serveUDP(t, zone(&queries, false))
+	defer stop()
+	now := time.Unix(1000, 0)
+	r := LocalResolver{DNSServer: []string{"127.0.0.1:1", addr}, Timeout: 200 * time.Millisecond}
+	r.now = func() time.Time { return now }
+
+	result, err := r.Resolve("WWW.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Name != "www.example.com." || result.TTL != 60*time.Second || result.Authoritative {
+		t.Errorf("result: %+v", result)
+	}
+	if len(result.A) != 2 || result.A[0] != netip.MustParseAddr("192.0.2.1") || len(result.AAAA) != 1 {
+		t.Errorf("addrs: %v %v", result.A, result.AAAA)
+	}
+	if atomic.LoadInt32(&queries) != 2 {
+		t.Errorf("A and AAAA queries expected: %d", queries)
+	}
+	now = now.Add(59 * time.Second)
+	_, err = r.Resolve("www.example.com.")
+	if err != nil || atomic.LoadInt32(&queries) != 2 {
+		t.Errorf("cached: %d %v", queries, err)
+	}
+	now = now.Add(time.Second)
+	_, err = r.Resolve("www.example.com.")
+	if err != nil || atomic.LoadInt32(&queries) != 4 {
+		t.Errorf("expired: %d %v", queries, err)
+	}
+
+	result, err = r.Resolve("missing.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.A) != 0 || len(result.AAAA) != 0 || result.TTL != 10*time.Second {
+		t.Errorf("negative result: %+v", result)
+	}
+}
+
+func TestResolverOnlyAuthoritative(t *testing.T) {
+	var queries int32
+	recursive, stop := serveUDP(t, zone(&queries, false))
+	defer stop()
+	r := LocalResolver{DNSServer: []string{recursive}, OnlyAuthoritative: true}
+	_, err := r.Resolve("www.example.com")
+	if err == nil {
+		t.Errorf("answer is not authoritative")
+	}
+	authoritative, stopAuth := serveUDP(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.RecursionDesired {
+			t.Errorf("recursion desired")
+		}
+		zone(&queries, true).ServeDNS(w, req)
+	}))
+	defer stopAuth()
+	r = LocalResolver{DNSServer: []string{recursive, authoritative}, OnlyAuthoritative: true}
+	result, err := r.Resolve("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Authoritative || len(result.A) != 2 {
+		t.Errorf("result: %+v", result)
+	}
+}
+
+func TestAppend53(t *testing.T) {
+	for in, out := range map[string]string{
+		"192.0.2.53":      "192.0.2.53:53",
+		"192.0.2.53:5353": "192.0.2.53:5353",
+		"[2001:db8::53]":  "[2001:db8::53]:53",
+		"2001:db8::53":    "[2001:db8::53]:53",
+		"[::1]:5353":      "[::1]:5353",
+	} {
+		if append53(in) != out {
+			t.Errorf("%s: %s", in, append53(in))
+		}
+	}
+}
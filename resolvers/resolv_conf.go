@@ -0,0 +1,216 @@
+package resolvers
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const DefaultResolvConf = "/etc/resolv.conf"
+
+// ResolvConf is the model of resolv.conf, see resolv.conf(5)
+type ResolvConf struct {
+	Nameservers []string // ip:port
+	Search      []string // fqdns
+	Ndots       int
+	Timeout     time.Duration
+	Attempts    int
+	Rotate      bool
+}
+
+// SplitNameserver returns the host and port of ip[:port], brackets of
+// ipv6 addresses without port are removed, the default port is 53
+func SplitNameserver(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		portStr = "53"
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+func boundedInt(s string, min, max int) (int, bool) {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	if v < min {
+		v = min
+	}
+	if v > max {
+		v = max
+	}
+	return v, true
+}
+
+// ParseResolvConf reads nameserver, search, domain and options, the
+// defaults are those of glibc
+func ParseResolvConf(r io.Reader) (*ResolvConf, error) {
+	rc := &ResolvConf{
+		Ndots:    1,
+		Timeout:  5 * time.Second,
+		Attempts: 2,
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 {
+				continue
+			}
+			host, port, err := SplitNameserver(fields[1])
+			if err != nil || net.ParseIP(host) == nil {
+				continue
+			}
+			rc.Nameservers = append(rc.Nameservers, net.JoinHostPort(host, strconv.Itoa(port)))
+		case "domain", "search":
+			// the last search or domain line wins
+			rc.Search = []string{}
+			for _, domain := range fields[1:] {
+				rc.Search = append(rc.Search, dns.Fqdn(strings.ToLower(domain)))
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				key, value, _ := strings.Cut(option, ":")
+				switch key {
+				case "ndots":
+					if v, ok := boundedInt(value, 0, 15); ok {
+						rc.Ndots = v
+					}
+				case "timeout":
+					if v, ok := boundedInt(value, 1, 30); ok {
+						rc.Timeout = time.Duration(v) * time.Second
+					}
+				case "attempts":
+					if v, ok := boundedInt(value, 1, 5); ok {
+						rc.Attempts = v
+					}
+				case "rotate":
+					rc.Rotate = true
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rc.Nameservers) == 0 {
+		rc.Nameservers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return rc, nil
+}
+
+// Names returns the names to query for name in order, names with a
+// trailing dot are absolute, names with at least ndots dots are tried
+// before the search domains and after them otherwise
+func (rc *ResolvConf) Names(name string) []string {
+	if dns.IsFqdn(name) {
+		return []string{name}
+	}
+	searched := make([]string, 0, len(rc.Search))
+	for _, domain := range rc.Search {
+		searched = append(searched, name+"."+domain)
+	}
+	if strings.Count(name, ".") >= rc.Ndots {
+		return append([]string{dns.Fqdn(name)}, searched...)
+	}
+	return append(searched, dns.Fqdn(name))
+}
+
+// ResolvConfFile reloads resolv.conf if its modification time or size
+// changed, the file is checked at most every CheckInterval
+type ResolvConfFile struct {
+	Path          string
+	CheckInterval time.Duration
+	lock          sync.Mutex
+	current       *ResolvConf
+	modTime       time.Time
+	size          int64
+	checked       time.Time
+	now           func() time.Time
+}
+
+func NewResolvConfFile(path string) *ResolvConfFile {
+	return &ResolvConfFile{
+		Path:          path,
+		CheckInterval: 5 * time.Second,
+		now:           time.Now,
+	}
+}
+
+// Get returns the current model, the last one which could be read if the
+// file is gone or broken
+func (f *ResolvConfFile) Get() (*ResolvConf, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := f.now()
+	if f.current != nil && now.Sub(f.checked) < f.CheckInterval {
+		return f.current, nil
+	}
+	f.checked = now
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		if f.current != nil {
+			return f.current, nil
+		}
+		return nil, err
+	}
+	if f.current != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.current, nil
+	}
+	file, err := os.Open(f.Path)
+	if err != nil {
+		if f.current != nil {
+			return f.current, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	rc, err := ParseResolvConf(file)
+	if err != nil {
+		if f.current != nil {
+			return f.current, nil
+		}
+		return nil, err
+	}
+	f.current = rc
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return rc, nil
+}
+
+var sharedResolvConfs = struct {
+	lock  sync.Mutex
+	files map[string]*ResolvConfFile
+}{files: make(map[string]*ResolvConfFile)}
+
+// SharedResolvConf returns the one ResolvConfFile of a path
+func SharedResolvConf(path string) *ResolvConfFile {
+	if path == "" {
+		path = DefaultResolvConf
+	}
+	sharedResolvConfs.lock.Lock()
+	defer sharedResolvConfs.lock.Unlock()
+	f, found := sharedResolvConfs.files[path]
+	if !found {
+		f = NewResolvConfFile(path)
+		sharedResolvConfs.files[path] = f
+	}
+	return f
+}
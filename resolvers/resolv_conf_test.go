@@ -0,0 +1,109 @@
+package resolvers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	rc, err := ParseResolvConf(strings.NewReader(`# comment
+nameserver 192.0.2.53
+nameserver 2001:db8::53
+nameserver [2001:db8::54]
+nameserver not-an-ip
+domain old.example.com
+search corp.example.com Example.NET.
+options ndots:2 timeout:1 attempts:9 rotate edns0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ResolvConf{
+		Nameservers: []string{"192.0.2.53:53", "[2001:db8::53]:53", "[2001:db8::54]:53"},
+		Search:      []string{"corp.example.com.", "example.net."},
+		Ndots:       2,
+		Timeout:     time.Second,
+		Attempts:    5,
+		Rotate:      true,
+	}
+	if !reflect.DeepEqual(rc, expected) {
+		t.Errorf("%+v != %+v", rc, expected)
+	}
+	rc, _ = ParseResolvConf(strings.NewReader(""))
+	if !reflect.DeepEqual(rc.Nameservers, []string{"127.0.0.1:53", "[::1]:53"}) || rc.Ndots != 1 || rc.Timeout != 5*time.Second || rc.Attempts != 2 {
+		t.Errorf("defaults: %+v", rc)
+	}
+}
+
+func TestResolvConfNames(t *testing.T) {
+	rc := &ResolvConf{Search: []string{"corp.example.com.", "example.net."}, Ndots: 1}
+	for name, expected := range map[string][]string{
+		"db":               {"db.corp.example.com.", "db.example.net.", "db."},
+		"www.example.com":  {"www.example.com.", "www.example.com.corp.example.com.", "www.example.com.example.net."},
+		"www.example.com.": {"www.example.com."},
+	} {
+		if names := rc.Names(name); !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s: %v", name, names)
+		}
+	}
+}
+
+func TestSplitNameserver(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"192.0.2.53":      "192.0.2.53 53",
+		"192.0.2.53:5353": "192.0.2.53 5353",
+		"[2001:db8::53]":  "2001:db8::53 53",
+		"2001:db8::53":    "2001:db8::53 53",
+		"[::1]:5353":      "::1 5353",
+	} {
+		host, port, err := SplitNameserver(addr)
+		if err != nil || fmt.Sprintf("%s %d", host, port) != expected {
+			t.Errorf("%s: %s %d %v", addr, host, port, err)
+		}
+	}
+	if _, _, err := SplitNameserver("192.0.2.53:dns"); err == nil {
+		t.Errorf("port is no number")
+	}
+}
+
+func TestResolvConfFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	err := os.WriteFile(path, []byte("nameserver 192.0.2.1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	f := NewResolvConfFile(path)
+	f.now = func() time.Time { return now }
+	rc, err := f.Get()
+	if err != nil || rc.Nameservers[0] != "192.0.2.1:53" {
+		t.Fatalf("%v %v", rc, err)
+	}
+	err = os.WriteFile(path, []byte("nameserver 192.0.2.22\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _ = f.Get()
+	if rc.Nameservers[0] != "192.0.2.1:53" {
+		t.Errorf("checked before the interval: %v", rc.Nameservers)
+	}
+	now = now.Add(f.CheckInterval)
+	rc, _ = f.Get()
+	if rc.Nameservers[0] != "192.0.2.22:53" {
+		t.Errorf("not reloaded: %v", rc.Nameservers)
+	}
+	os.Remove(path)
+	now = now.Add(f.CheckInterval)
+	rc, err = f.Get()
+	if err != nil || rc.Nameservers[0] != "192.0.2.22:53" {
+		t.Errorf("last model expected: %v %v", rc, err)
+	}
+	if SharedResolvConf(path) != SharedResolvConf(path) || SharedResolvConf("").Path != DefaultResolvConf {
+		t.Errorf("shared files")
+	}
+}
@@ -1,6 +1,29 @@
 package resolvers
 
+import (
+	"net/netip"
+	"time"
+)
+
+// DNSResult holds the addresses of a name, TTL is the minimum ttl of the
+// answers, the name is resolved again after it
 type DNSResult struct {
+	Name          string
+	A             []netip.Addr
+	AAAA          []netip.Addr
+	TTL           time.Duration
+	Authoritative bool
+}
+
+// Addrs returns the addresses of a record type
+func (r *DNSResult) Addrs(rtype ResultRecordType) []netip.Addr {
+	switch rtype {
+	case A:
+		return r.A
+	case AAAA:
+		return r.AAAA
+	}
+	return nil
 }
 
 type Resolver interface {
@@ -8,18 +31,53 @@ type Resolver interface {
 }
 
 type Action string
+
 const (
 	Update = Action("update")
 	Remove = Action("remove")
 )
 
 type ResultRecordType string
+
 const (
-	A = ResultRecordType("A")
+	A    = ResultRecordType("A")
 	AAAA = ResultRecordType("AAAA")
 )
 
+// Result is an address of a name which was added (Update) or is gone (Remove)
 type Result struct {
 	Action Action
+	Name   string
+	Type   ResultRecordType
+	Addr   netip.Addr
+}
+
+func containsAddr(addrs []netip.Addr, addr netip.Addr) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
 }
 
+// Diff returns the addresses of current which are not in previous as
+// Update and the addresses of previous which are gone as Remove
+func Diff(previous, current DNSResult) []Result {
+	out := []Result{}
+	for _, rtype := range []ResultRecordType{A, AAAA} {
+		prev := previous.Addrs(rtype)
+		cur := current.Addrs(rtype)
+		for _, addr := range cur {
+			if !containsAddr(prev, addr) {
+				out = append(out, Result{Action: Update, Name: current.Name, Type: rtype, Addr: addr})
+			}
+		}
+		for _, addr := range prev {
+			if !containsAddr(cur, addr) {
+				out = append(out, Result{Action: Remove, Name: previous.Name, Type: rtype, Addr: addr})
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,34 @@
+package resolvers
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	a1 := netip.MustParseAddr("192.0.2.1")
+	a2 := netip.MustParseAddr("192.0.2.2")
+	a6 := netip.MustParseAddr("2001:db8::1")
+	prev := DNSResult{Name: "www.example.com.", A: []netip.Addr{a1}}
+	cur := DNSResult{Name: "www.example.com.", A: []netip.Addr{a2}, AAAA: []netip.Addr{a6}}
+	out := Diff(prev, cur)
+	expected := []Result{
+		{Action: Update, Name: "www.example.com.", Type: A, Addr: a2},
+		{Action: Remove, Name: "www.example.com.", Type: A, Addr: a1},
+		{Action: Update, Name: "www.example.com.", Type: AAAA, Addr: a6},
+	}
+	if len(out) != len(expected) {
+		t.Fatalf("results: %v", out)
+	}
+	for i := range expected {
+		if out[i] != expected[i] {
+			t.Errorf("%d: %v != %v", i, out[i], expected[i])
+		}
+	}
+	if len(Diff(cur, cur)) != 0 {
+		t.Errorf("no change expected")
+	}
+	if len(Diff(cur, DNSResult{})) != 2 {
+		t.Errorf("everything is removed: %v", Diff(cur, DNSResult{}))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mabels/steinstuecken/cmd/cli"
+	dnsEvents "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/mabels/steinstuecken/dns_forwarder"
+	"github.com/mabels/steinstuecken/iptables_actions"
+	"github.com/mabels/steinstuecken/traffic"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+func TestSnoopedAnswers(t *testing.T) {
+	zlog := zerolog.Nop()
+	des := dnsEvents.NewDnsEventStream(&zlog)
+	answers := dns_forwarder.NewAnswers()
+	target := &cli.Target{}
+	state := newTargetState(target)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		subject := &dnsEvents.SysResolverSubject{
+			Question: dns.Question{Name: "www.example.com.", Qtype: qtype, Qclass: dns.ClassINET},
+		}
+		answerSubject(&zlog, des, answers, state, &dnsEvents.DnsSource{Subject: subject}, &iptables_actions.IpTables{}, time.Minute)
+	}
+
+	file, err := os.Open("traffic/testdata/dns_answers.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pr, err := traffic.NewPcapReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = traffic.SnoopDnsAnswers(pr.Next, answers.Answer)
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	dsts := state.sortedDsts()
+	if len(dsts) != 3 || dsts[0] != "192.0.2.10" || dsts[1] != "192.0.2.11" || dsts[2] != "2001:db8::10" {
+		t.Errorf("dsts: %v", dsts)
+	}
+}
+
+func TestAnswersMinTTL(t *testing.T) {
+	config := cli.Config{}
+	config.DnsForward = cli.DnsForwardOptions{Listen: ":53", MinTTL: 30 * time.Second}
+	config.DnsSnoop = cli.DnsSnoopOptions{MinTTL: time.Minute}
+	if answersMinTTL(&config) != 30*time.Second {
+		t.Errorf("snooping is disabled: %s", answersMinTTL(&config))
+	}
+	config.DnsSnoop.Mode = "nfqueue"
+	if answersMinTTL(&config) != time.Minute {
+		t.Errorf("longer snooping ttl: %s", answersMinTTL(&config))
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/mabels/steinstuecken/cmd/cli"
+	dnsEvents "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/rs/zerolog"
+)
+
+type actionFn func(action string, zlog *zerolog.Logger, src string, dst string, target *cli.Target) []error
+
+// targetState keeps the installed destinations and sources of a target.
+// Without from= every destination is installed with any source, with from=
+// the rules are the cross product of the sources and destinations of the
+// same address family. A destination can be added by several subjects,
+// like the resolver and the dns forwarder, it is removed with the last one,
+// the same holds for a source of several from= entries.
+// With aggregation the added addresses are installed as their covering
+// prefixes, every change installs the difference to the installed ones.
+type targetState struct {
+	lock      sync.Mutex
+	target    *cli.Target
+	added     map[string]actionFn // the added destinations
+	refs      map[string]int
+	srcs      map[string]bool // the added sources
+	srcRefs   map[string]int
+	dsts      map[string]actionFn // the installed destinations
+	installed map[string]bool     // the installed sources
+}
+
+func newTargetState(target *cli.Target) *targetState {
+	return &targetState{
+		target:    target,
+		added:     make(map[string]actionFn),
+		refs:      make(map[string]int),
+		srcs:      make(map[string]bool),
+		srcRefs:   make(map[string]int),
+		dsts:      make(map[string]actionFn),
+		installed: make(map[string]bool),
+	}
+}
+
+func isIPv6(ipOrCidr string) bool {
+	ip, _, err := net.ParseCIDR(ipOrCidr)
+	if err != nil {
+		ip = net.ParseIP(ipOrCidr)
+	}
+	return ip != nil && ip.To4() == nil
+}
+
+func dstKeys(dsts map[string]actionFn) []string {
+	keys := make([]string, 0, len(dsts))
+	for dst := range dsts {
+		keys = append(keys, dst)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func srcKeys(srcs map[string]bool) []string {
+	keys := make([]string, 0, len(srcs))
+	for src := range srcs {
+		keys = append(keys, src)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ts *targetState) sortedDsts() []string {
+	return dstKeys(ts.dsts)
+}
+
+// sourcesFor returns the sources of srcs with the family of dst
+func (ts *targetState) sourcesFor(srcs map[string]bool, dst string) []string {
+	if len(ts.target.From) == 0 {
+		return []string{""}
+	}
+	out := []string{}
+	for _, src := range srcKeys(srcs) {
+		if isIPv6(src) == isIPv6(dst) {
+			out = append(out, src)
+		}
+	}
+	return out
+}
+
+func toPrefix(ipOrCidr string) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(ipOrCidr)
+	if err == nil {
+		return prefix, true
+	}
+	addr, err := netip.ParseAddr(ipOrCidr)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+func prefixStr(prefix netip.Prefix) string {
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
+
+// aggregate returns the covering prefixes of keys, with the originals of
+// the keys which are not addresses
+func (ts *targetState) aggregate(keys []string) []string {
+	prefixes := make([]netip.Prefix, 0, len(keys))
+	out := []string{}
+	for _, key := range keys {
+		prefix, ok := toPrefix(key)
+		if !ok {
+			out = append(out, key)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	for _, prefix := range dnsEvents.AggregatePrefixes(prefixes, ts.target.MaxWiden, ts.target.MaxWiden6) {
+		out = append(out, prefixStr(prefix))
+	}
+	return out
+}
+
+// aggregated returns the difference of the covering prefixes of the added
+// destinations and sources to the installed ones
+func (ts *targetState) aggregated() (map[string]actionFn, []string, []string, []string) {
+	// the rules of a family are the same for all its addresses
+	fns := map[bool]actionFn{}
+	for _, dst := range dstKeys(ts.added) {
+		if _, found := fns[isIPv6(dst)]; !found {
+			fns[isIPv6(dst)] = ts.added[dst]
+		}
+	}
+	dsts := map[string]actionFn{}
+	for _, dst := range ts.aggregate(dstKeys(ts.added)) {
+		dsts[dst] = fns[isIPv6(dst)]
+	}
+	srcs := map[string]bool{}
+	for _, src := range ts.aggregate(srcKeys(ts.srcs)) {
+		srcs[src] = true
+	}
+	dstsIn := map[string]actionFn{}
+	for dst, fn := range dsts {
+		if _, found := ts.dsts[dst]; !found {
+			dstsIn[dst] = fn
+		}
+	}
+	dstsOut := []string{}
+	for dst := range ts.dsts {
+		if _, found := dsts[dst]; !found {
+			dstsOut = append(dstsOut, dst)
+		}
+	}
+	srcsIn, srcsOut := []string{}, []string{}
+	for src := range srcs {
+		if !ts.installed[src] {
+			srcsIn = append(srcsIn, src)
+		}
+	}
+	for src := range ts.installed {
+		if !srcs[src] {
+			srcsOut = append(srcsOut, src)
+		}
+	}
+	return dstsIn, dstsOut, srcsIn, srcsOut
+}
+
+// install adds the rules of the new destinations and sources before it
+// removes the ones of the gone, a changed aggregation does not interrupt
+// the traffic
+func (ts *targetState) install(zlog *zerolog.Logger, dstsIn map[string]actionFn, dstsOut []string, srcsIn []string, srcsOut []string) []error {
+	errs := []error{}
+	for _, src := range srcsIn {
+		ts.installed[src] = true
+	}
+	for _, dst := range dstKeys(dstsIn) {
+		for _, src := range ts.sourcesFor(ts.installed, dst) {
+			errs = append(errs, dstsIn[dst]("add", zlog, src, dst, ts.target)...)
+		}
+	}
+	if len(srcsIn) > 0 {
+		sort.Strings(srcsIn)
+		for _, dst := range dstKeys(ts.dsts) {
+			for _, src := range srcsIn {
+				if isIPv6(src) == isIPv6(dst) {
+					errs = append(errs, ts.dsts[dst]("add", zlog, src, dst, ts.target)...)
+				}
+			}
+		}
+	}
+	for dst, fn := range dstsIn {
+		ts.dsts[dst] = fn
+	}
+	for _, src := range srcsOut {
+		delete(ts.installed, src)
+	}
+	sort.Strings(dstsOut)
+	for _, dst := range dstsOut {
+		fn := ts.dsts[dst]
+		delete(ts.dsts, dst)
+		// with the gone sources
+		for _, src := range ts.sourcesFor(ts.installed, dst) {
+			errs = append(errs, fn("remove", zlog, src, dst, ts.target)...)
+		}
+		for _, src := range srcsOut {
+			if isIPv6(src) == isIPv6(dst) {
+				errs = append(errs, fn("remove", zlog, src, dst, ts.target)...)
+			}
+		}
+	}
+	if len(srcsOut) > 0 {
+		sort.Strings(srcsOut)
+		for _, dst := range dstKeys(ts.dsts) {
+			for _, src := range srcsOut {
+				if isIPv6(src) == isIPv6(dst) {
+					errs = append(errs, ts.dsts[dst]("remove", zlog, src, dst, ts.target)...)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// UpdateDestinations adds and removes the destinations of one change of a
+// subject and installs the difference
+func (ts *targetState) UpdateDestinations(zlog *zerolog.Logger, add map[string]actionFn, remove []string) []error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	dstsIn := map[string]actionFn{}
+	dstsOut := []string{}
+	for dst, fn := range add {
+		ts.refs[dst]++
+		if ts.refs[dst] == 1 {
+			ts.added[dst] = fn
+			dstsIn[dst] = fn
+		}
+	}
+	for _, dst := range remove {
+		if _, found := ts.added[dst]; !found {
+			continue
+		}
+		ts.refs[dst]--
+		if ts.refs[dst] > 0 {
+			continue
+		}
+		delete(ts.refs, dst)
+		delete(ts.added, dst)
+		if _, found := dstsIn[dst]; found {
+			delete(dstsIn, dst)
+		} else {
+			dstsOut = append(dstsOut, dst)
+		}
+	}
+	if len(dstsIn) == 0 && len(dstsOut) == 0 {
+		return []error{}
+	}
+	if ts.target.Aggregate {
+		dstsIn, dstsOut, srcsIn, srcsOut := ts.aggregated()
+		return ts.install(zlog, dstsIn, dstsOut, srcsIn, srcsOut)
+	}
+	return ts.install(zlog, dstsIn, dstsOut, nil, nil)
+}
+
+// UpdateSources adds and removes the sources of one change of a from=
+// subject and installs the difference
+func (ts *targetState) UpdateSources(zlog *zerolog.Logger, add []string, remove []string) []error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if len(ts.target.From) == 0 {
+		return []error{}
+	}
+	srcsIn, srcsOut := []string{}, []string{}
+	for _, src := range add {
+		ts.srcRefs[src]++
+		if ts.srcRefs[src] == 1 {
+			ts.srcs[src] = true
+			srcsIn = append(srcsIn, src)
+		}
+	}
+	for _, src := range remove {
+		if !ts.srcs[src] {
+			continue
+		}
+		ts.srcRefs[src]--
+		if ts.srcRefs[src] > 0 {
+			continue
+		}
+		delete(ts.srcRefs, src)
+		delete(ts.srcs, src)
+		if idx := indexOf(srcsIn, src); idx >= 0 {
+			srcsIn = append(srcsIn[:idx], srcsIn[idx+1:]...)
+		} else {
+			srcsOut = append(srcsOut, src)
+		}
+	}
+	if len(srcsIn) == 0 && len(srcsOut) == 0 {
+		return []error{}
+	}
+	if ts.target.Aggregate {
+		dstsIn, dstsOut, srcsIn, srcsOut := ts.aggregated()
+		return ts.install(zlog, dstsIn, dstsOut, srcsIn, srcsOut)
+	}
+	return ts.install(zlog, nil, nil, srcsIn, srcsOut)
+}
+
+func indexOf(strs []string, str string) int {
+	for i, s := range strs {
+		if s == str {
+			return i
+		}
+	}
+	return -1
+}
+
+func (ts *targetState) AddDestination(zlog *zerolog.Logger, dst string, fn actionFn) []error {
+	return ts.UpdateDestinations(zlog, map[string]actionFn{dst: fn}, nil)
+}
+
+func (ts *targetState) RemoveDestination(zlog *zerolog.Logger, dst string) []error {
+	return ts.UpdateDestinations(zlog, nil, []string{dst})
+}
+
+func (ts *targetState) AddSource(zlog *zerolog.Logger, src string) []error {
+	return ts.UpdateSources(zlog, []string{src}, nil)
+}
+
+func (ts *targetState) RemoveSource(zlog *zerolog.Logger, src string) []error {
+	return ts.UpdateSources(zlog, nil, []string{src})
+}
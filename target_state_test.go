@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mabels/steinstuecken/cmd/cli"
+	dnsEvents "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/rs/zerolog"
+)
+
+type recordedActions struct {
+	actions []string
+}
+
+func (ra *recordedActions) fn(name string) actionFn {
+	return func(action string, zlog *zerolog.Logger, src string, dst string, target *cli.Target) []error {
+		ra.actions = append(ra.actions, fmt.Sprintf("%s:%s:%s->%s", name, action, src, dst))
+		return []error{}
+	}
+}
+
+func TestTargetStateWithoutFrom(t *testing.T) {
+	zlog := zerolog.Nop()
+	ra := recordedActions{}
+	ts := newTargetState(&cli.Target{})
+	ts.AddDestination(&zlog, "1.1.1.1", ra.fn("a"))
+	ts.AddDestination(&zlog, "1.1.1.1", ra.fn("a"))
+	ts.AddSource(&zlog, "10.0.0.0/8")
+	ts.RemoveDestination(&zlog, "1.1.1.1")
+	// still added by the second subject
+	if len(ra.actions) != 1 {
+		t.Errorf("actions: %v", ra.actions)
+	}
+	ts.RemoveDestination(&zlog, "1.1.1.1")
+	ts.RemoveDestination(&zlog, "1.1.1.1")
+	if !reflect.DeepEqual(ra.actions, []string{
+		"a:add:->1.1.1.1",
+		"a:remove:->1.1.1.1",
+	}) {
+		t.Errorf("actions: %v", ra.actions)
+	}
+}
+
+func TestTargetStateFrom(t *testing.T) {
+	zlog := zerolog.Nop()
+	ra := recordedActions{}
+	ts := newTargetState(&cli.Target{
+		From: []dnsEvents.AddressSource{&dnsEvents.LiteralSource{}},
+	})
+	// no source yet, nothing is installed
+	ts.AddDestination(&zlog, "1.1.1.1", ra.fn("a"))
+	ts.AddDestination(&zlog, "2001:db8::1", ra.fn("aaaa"))
+	if len(ra.actions) != 0 {
+		t.Errorf("actions: %v", ra.actions)
+	}
+	ts.AddSource(&zlog, "10.0.0.0/8")
+	ts.AddSource(&zlog, "10.0.0.0/8")
+	ts.AddSource(&zlog, "fd00::/8")
+	ts.AddSource(&zlog, "192.168.1.1")
+	ts.AddDestination(&zlog, "2.2.2.2", ra.fn("a"))
+	// still added by the second from= entry
+	ts.RemoveSource(&zlog, "10.0.0.0/8")
+	if len(ra.actions) != 5 {
+		t.Errorf("actions: %v", ra.actions)
+	}
+	ts.RemoveDestination(&zlog, "1.1.1.1")
+	ts.RemoveSource(&zlog, "10.0.0.0/8")
+	ts.RemoveSource(&zlog, "10.0.0.0/8")
+	if !reflect.DeepEqual(ra.actions, []string{
+		"a:add:10.0.0.0/8->1.1.1.1",
+		"aaaa:add:fd00::/8->2001:db8::1",
+		"a:add:192.168.1.1->1.1.1.1",
+		"a:add:10.0.0.0/8->2.2.2.2",
+		"a:add:192.168.1.1->2.2.2.2",
+		"a:remove:10.0.0.0/8->1.1.1.1",
+		"a:remove:192.168.1.1->1.1.1.1",
+		"a:remove:10.0.0.0/8->2.2.2.2",
+	}) {
+		t.Errorf("actions: %v", ra.actions)
+	}
+}
+
+func TestTargetStateAggregate(t *testing.T) {
+	zlog := zerolog.Nop()
+	ra := recordedActions{}
+	ts := newTargetState(&cli.Target{
+		Aggregate: true,
+		MaxWiden:  24,
+		From:      []dnsEvents.AddressSource{&dnsEvents.LiteralSource{}},
+	})
+	ts.UpdateSources(&zlog, []string{"10.0.0.0/25", "10.0.0.128/25"}, nil)
+	ts.UpdateDestinations(&zlog, map[string]actionFn{
+		"192.0.2.1": ra.fn("a"),
+		"192.0.2.2": ra.fn("a"),
+	}, nil)
+	// a neighbour widens within /24, the old prefixes are removed after
+	ts.AddDestination(&zlog, "192.0.2.9", ra.fn("a"))
+	ts.AddDestination(&zlog, "198.51.100.1", ra.fn("a"))
+	ts.UpdateDestinations(&zlog, nil, []string{"192.0.2.1", "192.0.2.2"})
+	if !reflect.DeepEqual(ra.actions, []string{
+		"a:add:10.0.0.0/24->192.0.2.0/30",
+		"a:add:10.0.0.0/24->192.0.2.0/28",
+		"a:remove:10.0.0.0/24->192.0.2.0/30",
+		"a:add:10.0.0.0/24->198.51.100.1",
+		"a:add:10.0.0.0/24->192.0.2.9",
+		"a:remove:10.0.0.0/24->192.0.2.0/28",
+	}) {
+		t.Errorf("actions: %v", ra.actions)
+	}
+}
@@ -0,0 +1,98 @@
+//go:build linux
+
+package traffic
+
+import (
+	"fmt"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// the ancillary data of a packet socket filter, not in x/sys/unix
+const (
+	skfAdOff     = 0xfffff000
+	skfAdPkttype = 4
+)
+
+// dnsAnswerFilter accepts udp packets from port 53 which are sent to the
+// clients, the answers a client sends on the interface are forged. The
+// packets of a SOCK_DGRAM packet socket start with the ip header.
+var dnsAnswerFilter = []unix.SockFilter{
+	{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfAdOff + skfAdPkttype},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: unix.PACKET_OUTGOING, Jt: 0, Jf: 14},
+	{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 0},
+	{Code: unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K, K: 4},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 4, Jt: 0, Jf: 5},
+	{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 9},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: ProtoUDP, Jt: 0, Jf: 9},
+	{Code: unix.BPF_LDX | unix.BPF_B | unix.BPF_MSH, K: 0},
+	{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 0},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 53, Jt: 5, Jf: 6},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 6, Jt: 0, Jf: 5},
+	{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 6},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: ProtoUDP, Jt: 0, Jf: 3},
+	{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 40},
+	{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: 53, Jt: 0, Jf: 1},
+	{Code: unix.BPF_RET | unix.BPF_K, K: 0x40000},
+	{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+type PacketCapture struct {
+	sock socket
+}
+
+// CaptureDnsAnswers captures the dns answers sent to the clients on iface
+func CaptureDnsAnswers(iface string) (*PacketCapture, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	proto := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, fmt.Errorf("packet socket: %w", err)
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(dnsAnswerFilter)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&dnsAnswerFilter[0])),
+	}
+	err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("packet filter: %w", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("packet bind %s: %w", iface, err)
+	}
+	tv := unix.NsecToTimeval(time.Second.Nanoseconds())
+	err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("packet timeout: %w", err)
+	}
+	return &PacketCapture{sock: socket{fd: fd}}, nil
+}
+
+// Read returns the next ip packet
+func (pc *PacketCapture) Read() ([]byte, error) {
+	buf := make([]byte, 65536)
+	n, err := pc.sock.recv(buf)
+	if err != nil {
+		return nil, fmt.Errorf("packet capture: %w", err)
+	}
+	return buf[:n], nil
+}
+
+// Close waits for a blocked Read
+func (pc *PacketCapture) Close() error {
+	return pc.sock.close(nil)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package traffic
+
+import "fmt"
+
+type PacketCapture struct{}
+
+func CaptureDnsAnswers(iface string) (*PacketCapture, error) {
+	return nil, fmt.Errorf("packet capture is only supported on linux")
+}
+
+func (pc *PacketCapture) Read() ([]byte, error) {
+	return nil, fmt.Errorf("packet capture is only supported on linux")
+}
+
+func (pc *PacketCapture) Close() error {
+	return nil
+}
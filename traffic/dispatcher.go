@@ -0,0 +1,55 @@
+package traffic
+
+import (
+	"github.com/rs/zerolog"
+)
+
+// PacketSource is implemented by NflogListener
+type PacketSource interface {
+	Read() ([]LogPacket, error)
+}
+
+// Dispatcher routes the packets of a nflog group by their prefix
+type Dispatcher struct {
+	log      *zerolog.Logger
+	handlers map[string]func(pkt *Packet)
+}
+
+func NewDispatcher(zlog *zerolog.Logger) *Dispatcher {
+	return &Dispatcher{
+		log:      zlog,
+		handlers: make(map[string]func(pkt *Packet)),
+	}
+}
+
+// Handle registers fn for the packets logged with prefix, it has to be
+// called before Run
+func (d *Dispatcher) Handle(prefix string, fn func(pkt *Packet)) {
+	d.handlers[prefix] = fn
+}
+
+func (d *Dispatcher) Dispatch(lpkt *LogPacket) {
+	fn, found := d.handlers[lpkt.Prefix]
+	if !found {
+		return
+	}
+	pkt, err := ParsePacket(lpkt.Payload)
+	if err != nil {
+		d.log.Debug().Err(err).Str("prefix", lpkt.Prefix).Msg("error parsing packet")
+		return
+	}
+	fn(pkt)
+}
+
+// Run dispatches until src fails
+func (d *Dispatcher) Run(src PacketSource) error {
+	for {
+		pkts, err := src.Read()
+		if err != nil {
+			return err
+		}
+		for i := range pkts {
+			d.Dispatch(&pkts[i])
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package traffic
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+type fixSource struct {
+	reads [][]LogPacket
+}
+
+func (f *fixSource) Read() ([]LogPacket, error) {
+	if len(f.reads) == 0 {
+		return nil, fmt.Errorf("done")
+	}
+	pkts := f.reads[0]
+	f.reads = f.reads[1:]
+	return pkts, nil
+}
+
+func TestDispatcher(t *testing.T) {
+	zlog := zerolog.New(os.Stderr)
+	d := NewDispatcher(&zlog)
+	drops := []*Packet{}
+	d.Handle("FWD-X:drop", func(pkt *Packet) {
+		drops = append(drops, pkt)
+	})
+	icmp := ipv4Packet("10.0.0.2", "10.0.0.1", ProtoICMP, []byte{8, 0, 0, 0})
+	err := d.Run(&fixSource{reads: [][]LogPacket{
+		{{Prefix: "FWD-X:drop", Payload: icmp}, {Prefix: "other", Payload: icmp}},
+		{{Prefix: "FWD-X:drop", Payload: []byte{0x45}}},
+	}})
+	if err == nil || err.Error() != "done" {
+		t.Errorf("run should return the source error: %v", err)
+	}
+	if len(drops) != 1 || drops[0].Dst.String() != "10.0.0.1" {
+		t.Errorf("drops: %v", drops)
+	}
+}
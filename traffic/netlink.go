@@ -0,0 +1,112 @@
+package traffic
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// netlink constants, see linux/netlink.h and linux/netfilter/nfnetlink.h
+const (
+	nlmsgHdrLen = 16
+	nfgenmsgLen = 4
+	nlmsgError  = 2
+	nlmsgDone   = 3
+	nlmFRequest = 0x1
+	nlmFAck     = 0x4
+)
+
+func align4(l int) int {
+	return (l + 3) &^ 3
+}
+
+func nlAttr(typ uint16, data []byte) []byte {
+	attr := make([]byte, align4(4+len(data)))
+	binary.LittleEndian.PutUint16(attr[0:2], uint16(4+len(data)))
+	binary.LittleEndian.PutUint16(attr[2:4], typ)
+	copy(attr[4:], data)
+	return attr
+}
+
+// nfnlMsg builds a nfnetlink message of subsys, resID is the group or queue
+func nfnlMsg(subsys uint8, typ uint8, flags uint16, seq uint32, family uint8, resID uint16, attrs ...[]byte) []byte {
+	body := []byte{family, 0, 0, 0}
+	binary.BigEndian.PutUint16(body[2:4], resID)
+	for _, attr := range attrs {
+		body = append(body, attr...)
+	}
+	msg := make([]byte, nlmsgHdrLen, nlmsgHdrLen+len(body))
+	binary.LittleEndian.PutUint32(msg[0:4], uint32(nlmsgHdrLen+len(body)))
+	binary.LittleEndian.PutUint16(msg[4:6], uint16(subsys)<<8|uint16(typ))
+	binary.LittleEndian.PutUint16(msg[6:8], flags)
+	binary.LittleEndian.PutUint32(msg[8:12], seq)
+	return append(msg, body...)
+}
+
+// parseNetlinkAck returns the error of a NLMSG_ERROR message, nil for an ack
+func parseNetlinkAck(buf []byte) error {
+	for len(buf) >= nlmsgHdrLen {
+		msgLen := int(binary.LittleEndian.Uint32(buf[0:4]))
+		if msgLen < nlmsgHdrLen || msgLen > len(buf) {
+			return fmt.Errorf("invalid netlink message length: %d", msgLen)
+		}
+		typ := binary.LittleEndian.Uint16(buf[4:6])
+		if typ == nlmsgError && msgLen >= nlmsgHdrLen+4 {
+			errno := int32(binary.LittleEndian.Uint32(buf[nlmsgHdrLen : nlmsgHdrLen+4]))
+			if errno != 0 {
+				return fmt.Errorf("netlink error: %d", -errno)
+			}
+		}
+		buf = buf[align4(msgLen):]
+	}
+	return nil
+}
+
+// nfnlMessage is a parsed nfnetlink message with its attributes by type
+type nfnlMessage struct {
+	typ    uint16
+	family uint8
+	resID  uint16
+	attrs  map[uint16][]byte
+}
+
+// parseNfnlMessages parses the messages of a netlink datagram
+func parseNfnlMessages(buf []byte) ([]nfnlMessage, error) {
+	msgs := []nfnlMessage{}
+	for len(buf) >= nlmsgHdrLen {
+		msgLen := int(binary.LittleEndian.Uint32(buf[0:4]))
+		if msgLen < nlmsgHdrLen || msgLen > len(buf) {
+			return msgs, fmt.Errorf("invalid netlink message length: %d", msgLen)
+		}
+		typ := binary.LittleEndian.Uint16(buf[4:6])
+		body := buf[nlmsgHdrLen:msgLen]
+		buf = buf[minInt(align4(msgLen), len(buf)):]
+		if len(body) < nfgenmsgLen {
+			continue
+		}
+		msg := nfnlMessage{
+			typ:    typ,
+			family: body[0],
+			resID:  binary.BigEndian.Uint16(body[2:4]),
+			attrs:  map[uint16][]byte{},
+		}
+		attrs := body[nfgenmsgLen:]
+		for len(attrs) >= 4 {
+			attrLen := int(binary.LittleEndian.Uint16(attrs[0:2]))
+			attrType := binary.LittleEndian.Uint16(attrs[2:4]) & 0x3fff
+			if attrLen < 4 || attrLen > len(attrs) {
+				return msgs, fmt.Errorf("invalid netlink attribute length: %d", attrLen)
+			}
+			msg.attrs[attrType] = attrs[4:attrLen]
+			attrs = attrs[minInt(align4(attrLen), len(attrs)):]
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,71 @@
+package traffic
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// constants of nfnetlink_log, see linux/netfilter/nfnetlink_log.h
+const (
+	nfnlSubsysLog = 4
+
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaPacketHdr = 1
+	nfulaPayload   = 9
+	nfulaPrefix    = 10
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind   = 1
+	nfulnlCfgCmdUnbind = 2
+
+	nfulnlCopyPacket = 2
+)
+
+// LogPacket is a packet received from a NFLOG rule
+type LogPacket struct {
+	Family  uint8
+	Group   uint16
+	Prefix  string
+	Payload []byte
+}
+
+// nflogConfigMsg builds a NFULNL_MSG_CONFIG request for group
+func nflogConfigMsg(seq uint32, family uint8, group uint16, attrs ...[]byte) []byte {
+	return nfnlMsg(nfnlSubsysLog, nfulnlMsgConfig, nlmFRequest|nlmFAck, seq, family, group, attrs...)
+}
+
+func nflogCmdAttr(cmd uint8) []byte {
+	return nlAttr(nfulaCfgCmd, []byte{cmd})
+}
+
+func nflogModeAttr(copyRange uint32, mode uint8) []byte {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint32(data[0:4], copyRange)
+	data[4] = mode
+	return nlAttr(nfulaCfgMode, data)
+}
+
+// parseNflogMessages parses the NFULNL_MSG_PACKET messages of a netlink datagram
+func parseNflogMessages(buf []byte) ([]LogPacket, error) {
+	pkts := []LogPacket{}
+	msgs, err := parseNfnlMessages(buf)
+	for _, msg := range msgs {
+		if msg.typ != nfnlSubsysLog<<8|nfulnlMsgPacket {
+			continue
+		}
+		pkt := LogPacket{
+			Family: msg.family,
+			Group:  msg.resID,
+			Prefix: strings.TrimRight(string(msg.attrs[nfulaPrefix]), "\x00"),
+		}
+		if payload, found := msg.attrs[nfulaPayload]; found {
+			pkt.Payload = append([]byte{}, payload...)
+		}
+		pkts = append(pkts, pkt)
+	}
+	return pkts, err
+}
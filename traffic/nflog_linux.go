@@ -0,0 +1,62 @@
+//go:build linux
+
+package traffic
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+type NflogListener struct {
+	sock  socket
+	group uint16
+	seq   uint32
+}
+
+// ListenNflog binds to the NFLOG group and copies the whole packets
+func ListenNflog(group uint16) (*NflogListener, error) {
+	fd, err := nfnlSocket()
+	if err != nil {
+		return nil, fmt.Errorf("nflog %w", err)
+	}
+	nl := &NflogListener{sock: socket{fd: fd}, group: group}
+	err = nl.request(nflogCmdAttr(nfulnlCfgCmdBind))
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("nflog bind group %d: %w", group, err)
+	}
+	err = nl.request(nflogModeAttr(0xffff, nfulnlCopyPacket))
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("nflog copy mode group %d: %w", group, err)
+	}
+	return nl, nil
+}
+
+func (nl *NflogListener) request(attr []byte) error {
+	nl.seq++
+	msg := nflogConfigMsg(nl.seq, unix.AF_UNSPEC, nl.group, attr)
+	return nl.sock.use(func(fd int) error {
+		return nfnlRequest(fd, msg)
+	})
+}
+
+// Read blocks until packets are received or the listener is closed
+func (nl *NflogListener) Read() ([]LogPacket, error) {
+	buf := make([]byte, 256*1024)
+	n, err := nl.sock.recv(buf)
+	if err != nil {
+		return nil, fmt.Errorf("nflog listener: %w", err)
+	}
+	return parseNflogMessages(buf[:n])
+}
+
+// Close unbinds the group, it waits for a blocked Read
+func (nl *NflogListener) Close() error {
+	return nl.sock.close(func(fd int) {
+		nl.seq++
+		msg := nflogConfigMsg(nl.seq, unix.AF_UNSPEC, nl.group, nflogCmdAttr(nfulnlCfgCmdUnbind))
+		_ = unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	})
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package traffic
+
+import "fmt"
+
+type NflogListener struct{}
+
+func ListenNflog(group uint16) (*NflogListener, error) {
+	return nil, fmt.Errorf("nflog is only supported on linux")
+}
+
+func (nl *NflogListener) Read() ([]LogPacket, error) {
+	return nil, fmt.Errorf("nflog is only supported on linux")
+}
+
+func (nl *NflogListener) Close() error {
+	return nil
+}
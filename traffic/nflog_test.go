@@ -0,0 +1,87 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func nflogPacketMsg(group uint16, attrs ...[]byte) []byte {
+	body := []byte{2, 0, 0, 0}
+	binary.BigEndian.PutUint16(body[2:4], group)
+	for _, attr := range attrs {
+		body = append(body, attr...)
+	}
+	msg := make([]byte, nlmsgHdrLen)
+	binary.LittleEndian.PutUint32(msg[0:4], uint32(nlmsgHdrLen+len(body)))
+	binary.LittleEndian.PutUint16(msg[4:6], nfnlSubsysLog<<8|nfulnlMsgPacket)
+	return append(msg, body...)
+}
+
+func TestParseNflogMessages(t *testing.T) {
+	payload := ipv4Packet("10.0.0.2", "10.0.0.1", ProtoICMP, []byte{8, 0, 0, 0})
+	buf := append(
+		nflogPacketMsg(100, nlAttr(nfulaPacketHdr, []byte{0, 0x08, 0, 0}), nlAttr(nfulaPrefix, []byte("FWD-X:drop\x00")), nlAttr(nfulaPayload, payload)),
+		nflogPacketMsg(100, nlAttr(nfulaPrefix, []byte("FWD-X:dns\x00")))...)
+	pkts, err := parseNflogMessages(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 2 {
+		t.Fatalf("expected 2 packets: %v", pkts)
+	}
+	if pkts[0].Group != 100 || pkts[0].Family != 2 || pkts[0].Prefix != "FWD-X:drop" || len(pkts[0].Payload) != len(payload) {
+		t.Errorf("first packet: %+v", pkts[0])
+	}
+	if pkts[1].Prefix != "FWD-X:dns" || pkts[1].Payload != nil {
+		t.Errorf("second packet: %+v", pkts[1])
+	}
+	_, err = parseNflogMessages(buf[:nlmsgHdrLen+6])
+	if err == nil {
+		t.Errorf("expected error for truncated message")
+	}
+}
+
+func TestNflogConfigMsg(t *testing.T) {
+	msg := nflogConfigMsg(7, 0, 100, nflogCmdAttr(nfulnlCfgCmdBind))
+	if int(binary.LittleEndian.Uint32(msg[0:4])) != len(msg) || len(msg) != nlmsgHdrLen+nfgenmsgLen+8 {
+		t.Errorf("length: %d", len(msg))
+	}
+	if binary.LittleEndian.Uint16(msg[4:6]) != nfnlSubsysLog<<8|nfulnlMsgConfig {
+		t.Errorf("type: %x", msg[4:6])
+	}
+	if binary.BigEndian.Uint16(msg[nlmsgHdrLen+2:nlmsgHdrLen+4]) != 100 {
+		t.Errorf("group: %v", msg[nlmsgHdrLen:])
+	}
+	ack := make([]byte, nlmsgHdrLen+4)
+	binary.LittleEndian.PutUint32(ack[0:4], uint32(len(ack)))
+	binary.LittleEndian.PutUint16(ack[4:6], nlmsgError)
+	if err := parseNetlinkAck(ack); err != nil {
+		t.Errorf("ack: %v", err)
+	}
+	binary.LittleEndian.PutUint32(ack[nlmsgHdrLen:], uint32(0xffffffff)) // -1 EPERM
+	if err := parseNetlinkAck(ack); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestNfqueueMessages(t *testing.T) {
+	payload := ipv4Packet("10.0.0.1", "10.0.0.2", ProtoUDP, udpHeader(53, 1000, nil))
+	hdr := []byte{0, 0, 0, 42, 0x08, 0, 1}
+	msg := nfnlMsg(nfnlSubsysQueue, nfqnlMsgPacket, 0, 0, 2, 7, nlAttr(nfqaPacketHdr, hdr), nlAttr(nfqaPayload, payload))
+	pkts, err := parseNfqueueMessages(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].ID != 42 || pkts[0].Queue != 7 || !bytes.Equal(pkts[0].Payload, payload) {
+		t.Fatalf("packets: %+v", pkts)
+	}
+	verdict := nfqueueVerdictMsg(3, 7, 42, nfAccept)
+	if binary.LittleEndian.Uint16(verdict[4:6]) != nfnlSubsysQueue<<8|nfqnlMsgVerdict {
+		t.Errorf("type: %x", verdict[4:6])
+	}
+	attr := verdict[nlmsgHdrLen+nfgenmsgLen:]
+	if binary.BigEndian.Uint32(attr[4:8]) != nfAccept || binary.BigEndian.Uint32(attr[8:12]) != 42 {
+		t.Errorf("verdict: %v", attr)
+	}
+}
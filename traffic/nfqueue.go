@@ -0,0 +1,101 @@
+package traffic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// constants of nfnetlink_queue, see linux/netfilter/nfnetlink_queue.h
+const (
+	nfnlSubsysQueue = 3
+
+	nfqnlMsgPacket  = 0
+	nfqnlMsgVerdict = 1
+	nfqnlMsgConfig  = 2
+
+	nfqaPacketHdr  = 1
+	nfqaVerdictHdr = 2
+	nfqaPayload    = 10
+
+	nfqaCfgCmd    = 1
+	nfqaCfgParams = 2
+	nfqaCfgMask   = 4
+	nfqaCfgFlags  = 5
+
+	nfqnlCfgCmdBind   = 1
+	nfqnlCfgCmdUnbind = 2
+
+	nfqnlCopyPacket = 2
+
+	nfqaCfgFFailOpen = 1
+
+	nfAccept = 1
+)
+
+// ErrMalformed is a datagram which is parsed partly, the packets before
+// the broken message wait for their verdict too
+var ErrMalformed = errors.New("malformed netlink message")
+
+// QueuePacket is a packet received from a NFQUEUE rule, it waits for
+// the verdict in the kernel
+type QueuePacket struct {
+	ID      uint32
+	Queue   uint16
+	Payload []byte
+}
+
+func nfqueueConfigMsg(seq uint32, queue uint16, attrs ...[]byte) []byte {
+	return nfnlMsg(nfnlSubsysQueue, nfqnlMsgConfig, nlmFRequest|nlmFAck, seq, 0, queue, attrs...)
+}
+
+func nfqueueCmdAttr(cmd uint8) []byte {
+	return nlAttr(nfqaCfgCmd, []byte{cmd, 0, 0, 0})
+}
+
+func nfqueueParamsAttr(copyRange uint32, mode uint8) []byte {
+	data := make([]byte, 5)
+	binary.BigEndian.PutUint32(data[0:4], copyRange)
+	data[4] = mode
+	return nlAttr(nfqaCfgParams, data)
+}
+
+// nfqueueFailOpenAttrs accepts the packets instead of dropping them if the
+// queue of the socket is full
+func nfqueueFailOpenAttrs() [][]byte {
+	flags := make([]byte, 4)
+	binary.BigEndian.PutUint32(flags, nfqaCfgFFailOpen)
+	return [][]byte{nlAttr(nfqaCfgMask, flags), nlAttr(nfqaCfgFlags, flags)}
+}
+
+// nfqueueVerdictMsg builds the NFQNL_MSG_VERDICT of a packet
+func nfqueueVerdictMsg(seq uint32, queue uint16, id uint32, verdict uint32) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], verdict)
+	binary.BigEndian.PutUint32(data[4:8], id)
+	return nfnlMsg(nfnlSubsysQueue, nfqnlMsgVerdict, nlmFRequest, seq, 0, queue, nlAttr(nfqaVerdictHdr, data))
+}
+
+// parseNfqueueMessages parses the NFQNL_MSG_PACKET messages of a netlink datagram
+func parseNfqueueMessages(buf []byte) ([]QueuePacket, error) {
+	pkts := []QueuePacket{}
+	msgs, err := parseNfnlMessages(buf)
+	for _, msg := range msgs {
+		if msg.typ != nfnlSubsysQueue<<8|nfqnlMsgPacket {
+			continue
+		}
+		hdr := msg.attrs[nfqaPacketHdr]
+		if len(hdr) < 4 {
+			continue
+		}
+		pkts = append(pkts, QueuePacket{
+			ID:      binary.BigEndian.Uint32(hdr[0:4]),
+			Queue:   msg.resID,
+			Payload: append([]byte{}, msg.attrs[nfqaPayload]...),
+		})
+	}
+	if err != nil {
+		return pkts, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return pkts, nil
+}
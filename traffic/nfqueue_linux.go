@@ -0,0 +1,85 @@
+//go:build linux
+
+package traffic
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+type NfqueueListener struct {
+	sock  socket
+	queue uint16
+	lock  sync.Mutex // seq of the verdicts
+	seq   uint32
+}
+
+// ListenNfqueue binds to the NFQUEUE number and copies the whole packets,
+// every packet has to be accepted with Accept
+func ListenNfqueue(queue uint16) (*NfqueueListener, error) {
+	fd, err := nfnlSocket()
+	if err != nil {
+		return nil, fmt.Errorf("nfqueue %w", err)
+	}
+	nq := &NfqueueListener{sock: socket{fd: fd}, queue: queue}
+	err = nq.request(nfqueueCmdAttr(nfqnlCfgCmdBind))
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("nfqueue bind queue %d: %w", queue, err)
+	}
+	err = nq.request(nfqueueParamsAttr(0xffff, nfqnlCopyPacket))
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("nfqueue copy mode queue %d: %w", queue, err)
+	}
+	err = nq.request(nfqueueFailOpenAttrs()...)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("nfqueue fail open queue %d: %w", queue, err)
+	}
+	return nq, nil
+}
+
+// nextSeq numbers the messages, the socket is used without the lock
+func (nq *NfqueueListener) nextSeq() uint32 {
+	nq.lock.Lock()
+	defer nq.lock.Unlock()
+	nq.seq++
+	return nq.seq
+}
+
+func (nq *NfqueueListener) request(attrs ...[]byte) error {
+	msg := nfqueueConfigMsg(nq.nextSeq(), nq.queue, attrs...)
+	return nq.sock.use(func(fd int) error {
+		return nfnlRequest(fd, msg)
+	})
+}
+
+// Read blocks until packets are received or the listener is closed, with
+// ErrMalformed the returned packets have to be accepted too
+func (nq *NfqueueListener) Read() ([]QueuePacket, error) {
+	buf := make([]byte, 256*1024)
+	n, err := nq.sock.recv(buf)
+	if err != nil {
+		return nil, fmt.Errorf("nfqueue listener: %w", err)
+	}
+	return parseNfqueueMessages(buf[:n])
+}
+
+// Accept releases the packet
+func (nq *NfqueueListener) Accept(pkt *QueuePacket) error {
+	msg := nfqueueVerdictMsg(nq.nextSeq(), nq.queue, pkt.ID, nfAccept)
+	return nq.sock.use(func(fd int) error {
+		return unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	})
+}
+
+// Close unbinds the queue, it waits for a blocked Read
+func (nq *NfqueueListener) Close() error {
+	msg := nfqueueConfigMsg(nq.nextSeq(), nq.queue, nfqueueCmdAttr(nfqnlCfgCmdUnbind))
+	return nq.sock.close(func(fd int) {
+		_ = unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	})
+}
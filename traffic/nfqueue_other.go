@@ -0,0 +1,23 @@
+//go:build !linux
+
+package traffic
+
+import "fmt"
+
+type NfqueueListener struct{}
+
+func ListenNfqueue(queue uint16) (*NfqueueListener, error) {
+	return nil, fmt.Errorf("nfqueue is only supported on linux")
+}
+
+func (nq *NfqueueListener) Read() ([]QueuePacket, error) {
+	return nil, fmt.Errorf("nfqueue is only supported on linux")
+}
+
+func (nq *NfqueueListener) Accept(pkt *QueuePacket) error {
+	return fmt.Errorf("nfqueue is only supported on linux")
+}
+
+func (nq *NfqueueListener) Close() error {
+	return nil
+}
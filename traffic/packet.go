@@ -0,0 +1,116 @@
+package traffic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	ProtoICMP   = 1
+	ProtoTCP    = 6
+	ProtoUDP    = 17
+	ProtoICMPv6 = 58
+)
+
+var protoNames = map[uint8]string{
+	ProtoICMP:   "icmp",
+	ProtoTCP:    "tcp",
+	ProtoUDP:    "udp",
+	ProtoICMPv6: "icmpv6",
+	132:         "sctp",
+	136:         "udplite",
+	33:          "dccp",
+}
+
+// Packet is the parsed ip header with ports of tcp, udp and friends
+type Packet struct {
+	Src     netip.Addr
+	Dst     netip.Addr
+	Proto   uint8
+	SrcPort uint16
+	DstPort uint16
+	Payload []byte // transport payload, only set for udp
+}
+
+func (p *Packet) ProtoName() string {
+	name, found := protoNames[p.Proto]
+	if !found {
+		return fmt.Sprintf("%d", p.Proto)
+	}
+	return name
+}
+
+// HasPorts is true for protocols which are matched with ports
+func (p *Packet) HasPorts() bool {
+	switch p.Proto {
+	case ProtoICMP, ProtoICMPv6:
+		return false
+	}
+	_, found := protoNames[p.Proto]
+	return found
+}
+
+// ipv6 extension headers which are skipped to find the transport header
+var ipv6ExtHeaders = map[uint8]bool{
+	0:  true, // hop-by-hop
+	43: true, // routing
+	44: true, // fragment
+	60: true, // destination options
+}
+
+// ParsePacket parses a raw ipv4 or ipv6 packet
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty packet")
+	}
+	pkt := Packet{}
+	var transport []byte
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, fmt.Errorf("short ipv4 header: %d", len(data))
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl {
+			return nil, fmt.Errorf("invalid ipv4 header length: %d", ihl)
+		}
+		pkt.Proto = data[9]
+		pkt.Src = netip.AddrFrom4([4]byte(data[12:16]))
+		pkt.Dst = netip.AddrFrom4([4]byte(data[16:20]))
+		transport = data[ihl:]
+	case 6:
+		if len(data) < 40 {
+			return nil, fmt.Errorf("short ipv6 header: %d", len(data))
+		}
+		pkt.Src = netip.AddrFrom16([16]byte(data[8:24]))
+		pkt.Dst = netip.AddrFrom16([16]byte(data[24:40]))
+		next := data[6]
+		transport = data[40:]
+		for ipv6ExtHeaders[next] {
+			if len(transport) < 8 {
+				return nil, fmt.Errorf("short ipv6 extension header")
+			}
+			extLen := 8
+			if next != 44 {
+				extLen = (int(transport[1]) + 1) * 8
+			}
+			if len(transport) < extLen {
+				return nil, fmt.Errorf("short ipv6 extension header")
+			}
+			next = transport[0]
+			transport = transport[extLen:]
+		}
+		pkt.Proto = next
+	default:
+		return nil, fmt.Errorf("unknown ip version: %d", data[0]>>4)
+	}
+	if pkt.HasPorts() && len(transport) >= 4 {
+		pkt.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		pkt.DstPort = binary.BigEndian.Uint16(transport[2:4])
+	}
+	if pkt.Proto == ProtoUDP && len(transport) >= 8 {
+		pkt.Payload = transport[8:]
+	}
+	return &pkt, nil
+}
@@ -0,0 +1,100 @@
+package traffic
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func ipv4Packet(src, dst string, proto uint8, transport []byte) []byte {
+	pkt := make([]byte, 20)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(20+len(transport)))
+	pkt[8] = 64
+	pkt[9] = proto
+	s := netip.MustParseAddr(src).As4()
+	d := netip.MustParseAddr(dst).As4()
+	copy(pkt[12:16], s[:])
+	copy(pkt[16:20], d[:])
+	return append(pkt, transport...)
+}
+
+func ipv6Packet(src, dst string, next uint8, transport []byte) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(transport)))
+	pkt[6] = next
+	pkt[7] = 64
+	s := netip.MustParseAddr(src).As16()
+	d := netip.MustParseAddr(dst).As16()
+	copy(pkt[8:24], s[:])
+	copy(pkt[24:40], d[:])
+	return append(pkt, transport...)
+}
+
+func udpHeader(sport, dport uint16, payload []byte) []byte {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr[0:2], sport)
+	binary.BigEndian.PutUint16(hdr[2:4], dport)
+	binary.BigEndian.PutUint16(hdr[4:6], uint16(8+len(payload)))
+	return append(hdr, payload...)
+}
+
+func TestParsePacketIPv4(t *testing.T) {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 443)
+	pkt, err := ParsePacket(ipv4Packet("10.0.0.2", "93.184.216.34", ProtoTCP, tcp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Src.String() != "10.0.0.2" || pkt.Dst.String() != "93.184.216.34" {
+		t.Errorf("addresses: %v %v", pkt.Src, pkt.Dst)
+	}
+	if pkt.ProtoName() != "tcp" || pkt.SrcPort != 40000 || pkt.DstPort != 443 {
+		t.Errorf("transport: %v %d %d", pkt.ProtoName(), pkt.SrcPort, pkt.DstPort)
+	}
+	if pkt.Payload != nil {
+		t.Errorf("tcp has no payload: %v", pkt.Payload)
+	}
+}
+
+func TestParsePacketIPv6(t *testing.T) {
+	// hop-by-hop extension header in front of udp
+	ext := []byte{ProtoUDP, 0, 0, 0, 0, 0, 0, 0}
+	data := ipv6Packet("fd00::2", "2001:db8::1", 0, append(ext, udpHeader(53, 5353, []byte("dns"))...))
+	pkt, err := ParsePacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Dst.String() != "2001:db8::1" || pkt.ProtoName() != "udp" || pkt.SrcPort != 53 || pkt.DstPort != 5353 {
+		t.Errorf("packet: %+v", pkt)
+	}
+	if string(pkt.Payload) != "dns" {
+		t.Errorf("payload: %q", pkt.Payload)
+	}
+}
+
+func TestParsePacketICMP(t *testing.T) {
+	pkt, err := ParsePacket(ipv4Packet("10.0.0.2", "10.0.0.1", ProtoICMP, []byte{8, 0, 0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.HasPorts() || pkt.DstPort != 0 {
+		t.Errorf("icmp has no ports: %+v", pkt)
+	}
+}
+
+func TestParsePacketErrors(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		{0x45, 0},
+		{0x75, 0, 0, 0},
+		ipv6Packet("fd00::2", "2001:db8::1", 0, []byte{ProtoUDP, 0}),
+	} {
+		_, err := ParsePacket(data)
+		if err == nil {
+			t.Errorf("expected error for %v", data)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package traffic
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PassiveDNS remembers which names resolved to an address in
+// observed dns answers
+type PassiveDNS struct {
+	lock      sync.Mutex
+	entries   map[netip.Addr]map[string]time.Time // name -> expires
+	retention time.Duration
+	MaxAddrs  int // the addresses which expire first are dropped beyond
+	now       func() time.Time
+}
+
+// NewPassiveDNS keeps answers at least retention or their ttl if longer
+func NewPassiveDNS(retention time.Duration) *PassiveDNS {
+	return &PassiveDNS{
+		entries:   make(map[netip.Addr]map[string]time.Time),
+		retention: retention,
+		MaxAddrs:  1 << 16,
+		now:       time.Now,
+	}
+}
+
+func cleanName(s string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimRight(s, ".")))
+}
+
+func (p *PassiveDNS) Add(name string, addr netip.Addr, ttl time.Duration) {
+	if ttl < p.retention {
+		ttl = p.retention
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	names, found := p.entries[addr.Unmap()]
+	if !found {
+		if p.MaxAddrs > 0 && len(p.entries) >= p.MaxAddrs {
+			p.evict()
+		}
+		names = make(map[string]time.Time)
+		p.entries[addr.Unmap()] = names
+	}
+	names[cleanName(name)] = p.now().Add(ttl)
+}
+
+// Observe adds the A and AAAA answers of a response under the question
+// name and the owner name of the record
+func (p *PassiveDNS) Observe(msg *dns.Msg) int {
+	if !msg.Response || msg.Rcode != dns.RcodeSuccess {
+		return 0
+	}
+	added := 0
+	for _, rr := range msg.Answer {
+		var addr netip.Addr
+		var ok bool
+		switch v := rr.(type) {
+		case *dns.A:
+			addr, ok = netip.AddrFromSlice(v.A.To4())
+		case *dns.AAAA:
+			addr, ok = netip.AddrFromSlice(v.AAAA.To16())
+		}
+		if !ok {
+			continue
+		}
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		p.Add(rr.Header().Name, addr, ttl)
+		for _, q := range msg.Question {
+			if cleanName(q.Name) != cleanName(rr.Header().Name) {
+				p.Add(q.Name, addr, ttl)
+			}
+		}
+		added++
+	}
+	return added
+}
+
+// DnsAnswer parses udp packets from port 53 as dns message, it returns
+// nil for other packets
+func DnsAnswer(pkt *Packet) (*dns.Msg, error) {
+	if pkt.Proto != ProtoUDP || pkt.SrcPort != 53 || len(pkt.Payload) == 0 {
+		return nil, nil
+	}
+	msg := dns.Msg{}
+	err := msg.Unpack(pkt.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ObservePacket observes the packet if it is a dns answer
+func (p *PassiveDNS) ObservePacket(pkt *Packet) (int, error) {
+	msg, err := DnsAnswer(pkt)
+	if msg == nil {
+		return 0, err
+	}
+	return p.Observe(msg), nil
+}
+
+// Lookup returns the names of an address which are not expired
+func (p *PassiveDNS) Lookup(addr netip.Addr) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+	out := []string{}
+	names := p.entries[addr.Unmap()]
+	for name, expires := range names {
+		if now.After(expires) {
+			delete(names, name)
+			continue
+		}
+		out = append(out, name)
+	}
+	if len(names) == 0 {
+		delete(p.entries, addr.Unmap())
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Expire removes all expired entries
+func (p *PassiveDNS) Expire() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.expire()
+}
+
+// evict expires and drops the address which expires first if still full
+func (p *PassiveDNS) evict() {
+	p.expire()
+	if len(p.entries) < p.MaxAddrs {
+		return
+	}
+	var first netip.Addr
+	var firstExpires time.Time
+	for addr, names := range p.entries {
+		expires := time.Time{}
+		for _, e := range names {
+			if e.After(expires) {
+				expires = e
+			}
+		}
+		if !first.IsValid() || expires.Before(firstExpires) {
+			first, firstExpires = addr, expires
+		}
+	}
+	delete(p.entries, first)
+}
+
+func (p *PassiveDNS) expire() {
+	now := p.now()
+	for addr, names := range p.entries {
+		for name, expires := range names {
+			if now.After(expires) {
+				delete(names, name)
+			}
+		}
+		if len(names) == 0 {
+			delete(p.entries, addr)
+		}
+	}
+}
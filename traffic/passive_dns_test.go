@@ -0,0 +1,63 @@
+package traffic
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPassiveDNS(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := NewPassiveDNS(time.Minute)
+	p.now = func() time.Time { return now }
+	msg := dns.Msg{}
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.Response = true
+	cname, _ := dns.NewRR("www.example.com. 300 IN CNAME edge.cdn.net.")
+	a, _ := dns.NewRR("edge.cdn.net. 300 IN A 192.0.2.10")
+	msg.Answer = []dns.RR{cname, a}
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := p.ObservePacket(&Packet{Proto: ProtoUDP, SrcPort: 53, Payload: data})
+	if err != nil || added != 1 {
+		t.Errorf("observe: %d %v", added, err)
+	}
+	names := p.Lookup(netip.MustParseAddr("192.0.2.10"))
+	if !reflect.DeepEqual(names, []string{"edge.cdn.net", "www.example.com"}) {
+		t.Errorf("names: %v", names)
+	}
+	if len(p.Lookup(netip.MustParseAddr("::ffff:192.0.2.10"))) != 2 {
+		t.Errorf("mapped address should match")
+	}
+	now = now.Add(301 * time.Second)
+	if len(p.Lookup(netip.MustParseAddr("192.0.2.10"))) != 0 {
+		t.Errorf("names should be expired")
+	}
+	msg.Rcode = dns.RcodeNameError
+	if p.Observe(&msg) != 0 {
+		t.Errorf("nxdomain should not be observed")
+	}
+}
+
+func TestPassiveDNSMaxAddrs(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := NewPassiveDNS(time.Minute)
+	p.now = func() time.Time { return now }
+	p.MaxAddrs = 2
+	p.Add("a.example.com", netip.MustParseAddr("192.0.2.1"), 10*time.Minute)
+	p.Add("b.example.com", netip.MustParseAddr("192.0.2.2"), 5*time.Minute)
+	p.Add("c.example.com", netip.MustParseAddr("192.0.2.3"), 5*time.Minute)
+	if len(p.entries) != 2 || len(p.Lookup(netip.MustParseAddr("192.0.2.2"))) != 0 {
+		t.Errorf("the first expiring address should be dropped: %v", p.entries)
+	}
+	now = now.Add(6 * time.Minute)
+	p.Expire()
+	if len(p.entries) != 1 || len(p.Lookup(netip.MustParseAddr("192.0.2.1"))) != 1 {
+		t.Errorf("expire: %v", p.entries)
+	}
+}
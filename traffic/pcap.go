@@ -0,0 +1,107 @@
+package traffic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// link types of the pcap format
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+)
+
+// PcapReader reads the ip packets of a pcap file, like written by tcpdump -w
+type PcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	linkType uint32
+}
+
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	hdr := make([]byte, 24)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("pcap header: %w", err)
+	}
+	pr := &PcapReader{r: r}
+	switch binary.LittleEndian.Uint32(hdr[0:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		pr.order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		pr.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a pcap file, pcapng is not supported")
+	}
+	pr.linkType = pr.order.Uint32(hdr[20:24])
+	switch pr.linkType {
+	case linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", pr.linkType)
+	}
+	return pr, nil
+}
+
+// Next returns the ip packet of the next record, io.EOF at the end,
+// records which do not contain an ip packet are skipped
+func (pr *PcapReader) Next() ([]byte, error) {
+	for {
+		hdr := make([]byte, 16)
+		_, err := io.ReadFull(pr.r, hdr)
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("truncated pcap record header")
+			}
+			return nil, err
+		}
+		inclLen := pr.order.Uint32(hdr[8:12])
+		if inclLen > 256*1024 {
+			return nil, fmt.Errorf("pcap record too large: %d", inclLen)
+		}
+		data := make([]byte, inclLen)
+		_, err = io.ReadFull(pr.r, data)
+		if err != nil {
+			return nil, fmt.Errorf("truncated pcap record: %w", err)
+		}
+		ip := pr.ipPayload(data)
+		if ip != nil {
+			return ip, nil
+		}
+	}
+}
+
+func (pr *PcapReader) ipPayload(data []byte) []byte {
+	var etherType uint16
+	switch pr.linkType {
+	case linkTypeRaw:
+		return data
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		if etherType == etherTypeVLAN && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	}
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil
+	}
+	return data
+}
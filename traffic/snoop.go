@@ -0,0 +1,73 @@
+package traffic
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// SnoopDnsAnswers reads ip packets from next until it fails and passes
+// the dns answers to fn, next is the Read of a PacketCapture or the Next
+// of a PcapReader
+func SnoopDnsAnswers(next func() ([]byte, error), fn func(*dns.Msg)) error {
+	for {
+		data, err := next()
+		if err != nil {
+			return err
+		}
+		msg := parseDnsAnswer(data)
+		if msg != nil {
+			fn(msg)
+		}
+	}
+}
+
+// queueReader is the NfqueueListener
+type queueReader interface {
+	Read() ([]QueuePacket, error)
+	Accept(pkt *QueuePacket) error
+	Close() error
+}
+
+// SnoopNfqueue passes the dns answers of the queued packets to fn and
+// accepts the packets after fn returned. It closes the listener if it
+// fails, without a bound reader --queue-bypass passes the answers.
+func SnoopNfqueue(nq *NfqueueListener, fn func(*dns.Msg)) error {
+	return snoopQueue(nq, fn)
+}
+
+func snoopQueue(nq queueReader, fn func(*dns.Msg)) error {
+	defer nq.Close()
+	for {
+		pkts, err := nq.Read()
+		// every read packet waits for its verdict
+		var acceptErr error
+		for i := range pkts {
+			msg := parseDnsAnswer(pkts[i].Payload)
+			if msg != nil {
+				fn(msg)
+			}
+			if aerr := nq.Accept(&pkts[i]); aerr != nil && acceptErr == nil {
+				acceptErr = aerr
+			}
+		}
+		if err != nil && !errors.Is(err, ErrMalformed) {
+			return err
+		}
+		if acceptErr != nil {
+			return acceptErr
+		}
+	}
+}
+
+func parseDnsAnswer(data []byte) *dns.Msg {
+	pkt, err := ParsePacket(data)
+	if err != nil {
+		return nil
+	}
+	msg, err := DnsAnswer(pkt)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
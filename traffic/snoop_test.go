@@ -0,0 +1,119 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSnoopPcap(t *testing.T) {
+	file, err := os.Open("testdata/dns_answers.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pr, err := NewPcapReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []*dns.Msg{}
+	err = SnoopDnsAnswers(pr.Next, func(msg *dns.Msg) {
+		msgs = append(msgs, msg)
+	})
+	if err != io.EOF {
+		t.Fatalf("expected EOF: %v", err)
+	}
+	// the query, arp and tcp records are skipped
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 answers: %v", msgs)
+	}
+	if msgs[0].Question[0].Name != "www.example.com." || msgs[0].Question[0].Qtype != dns.TypeA || len(msgs[0].Answer) != 3 {
+		t.Errorf("A answer: %v", msgs[0])
+	}
+	if msgs[1].Question[0].Qtype != dns.TypeAAAA || len(msgs[1].Answer) != 1 {
+		t.Errorf("AAAA answer: %v", msgs[1])
+	}
+
+	pdns := NewPassiveDNS(0)
+	for _, msg := range msgs {
+		pdns.Observe(msg)
+	}
+	names := pdns.Lookup(netip.MustParseAddr("192.0.2.11"))
+	if len(names) != 2 || names[0] != "cdn.example.net" || names[1] != "www.example.com" {
+		t.Errorf("names: %v", names)
+	}
+}
+
+func TestPcapReader(t *testing.T) {
+	payload := ipv4Packet("10.0.0.1", "10.0.0.2", ProtoUDP, udpHeader(53, 1000, nil))
+	buf := make([]byte, 24)
+	binary.BigEndian.PutUint32(buf[0:4], 0xa1b2c3d4)
+	binary.BigEndian.PutUint32(buf[20:24], linkTypeRaw)
+	rec := make([]byte, 16)
+	binary.BigEndian.PutUint32(rec[8:12], uint32(len(payload)))
+	buf = append(append(buf, rec...), payload...)
+	pr, err := NewPcapReader(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := pr.Next()
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Errorf("big endian raw record: %v %v", data, err)
+	}
+	if _, err = pr.Next(); err != io.EOF {
+		t.Errorf("expected EOF: %v", err)
+	}
+	_, err = pr.Next()
+	if err != io.EOF {
+		t.Errorf("expected EOF again: %v", err)
+	}
+	_, err = NewPcapReader(bytes.NewReader(append([]byte{0x0a, 0x0d, 0x0d, 0x0a}, buf[4:]...)))
+	if err == nil {
+		t.Errorf("pcapng is not supported")
+	}
+	pr, _ = NewPcapReader(bytes.NewReader(buf[:len(buf)-4]))
+	if _, err = pr.Next(); err == nil || err == io.EOF {
+		t.Errorf("expected truncated record: %v", err)
+	}
+}
+
+type fakeQueue struct {
+	reads    [][]QueuePacket
+	errs     []error
+	accepted []uint32
+	closed   bool
+}
+
+func (f *fakeQueue) Read() ([]QueuePacket, error) {
+	pkts, err := f.reads[0], f.errs[0]
+	f.reads, f.errs = f.reads[1:], f.errs[1:]
+	return pkts, err
+}
+
+func (f *fakeQueue) Accept(pkt *QueuePacket) error {
+	f.accepted = append(f.accepted, pkt.ID)
+	return nil
+}
+
+func (f *fakeQueue) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestSnoopQueue(t *testing.T) {
+	fq := &fakeQueue{
+		reads: [][]QueuePacket{{{ID: 1}, {ID: 2}}, {{ID: 3}}},
+		errs:  []error{fmt.Errorf("%w: truncated", ErrMalformed), fmt.Errorf("recvfrom: bad file descriptor")},
+	}
+	err := snoopQueue(fq, func(*dns.Msg) {})
+	// a malformed datagram continues, a failed receive unbinds the queue
+	if err == nil || len(fq.accepted) != 3 || !fq.closed {
+		t.Errorf("snoop: %v %v %v", err, fq.accepted, fq.closed)
+	}
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package traffic
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var errSocketClosed = errors.New("closed")
+
+// socket guards the fd of a listener against Close, the fd is closed while
+// no syscall uses it, so a blocked receive never sees a reused fd number.
+// A receive returns after the SO_RCVTIMEO of the socket.
+type socket struct {
+	lock   sync.RWMutex
+	fd     int
+	closed bool
+}
+
+func (s *socket) use(fn func(fd int) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return errSocketClosed
+	}
+	return fn(s.fd)
+}
+
+// close passes the fd to last before it is closed, a closed socket is
+// not closed again
+func (s *socket) close(last func(fd int)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if last != nil {
+		last(s.fd)
+	}
+	return unix.Close(s.fd)
+}
+
+// recv blocks until a datagram is received or the socket is closed, the
+// messages lost with ENOBUFS are skipped
+func (s *socket) recv(buf []byte) (int, error) {
+	for {
+		n := 0
+		err := s.use(func(fd int) error {
+			var err error
+			n, _, err = unix.Recvfrom(fd, buf, 0)
+			return err
+		})
+		if err == unix.EAGAIN || err == unix.EINTR || err == unix.ENOBUFS {
+			continue
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package traffic
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketClose(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	tv := unix.NsecToTimeval((50 * time.Millisecond).Nanoseconds())
+	if err := unix.SetsockoptTimeval(fds[0], unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatal(err)
+	}
+	s := &socket{fd: fds[0]}
+	if _, err := unix.Write(fds[1], []byte("dns")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := s.recv(buf); err != nil || string(buf[:n]) != "dns" {
+		t.Fatalf("recv: %q %v", buf[:n], err)
+	}
+	received := make(chan error)
+	go func() {
+		_, err := s.recv(buf)
+		received <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// the blocked receive is finished before the fd is closed
+	last := -1
+	if err := s.close(func(fd int) { last = fd }); err != nil {
+		t.Error(err)
+	}
+	if last != fds[0] {
+		t.Errorf("last got fd %d", last)
+	}
+	select {
+	case err := <-received:
+		if !errors.Is(err, errSocketClosed) {
+			t.Errorf("closed expected: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the receive was not finished")
+	}
+	if err := s.close(nil); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mabels/steinstuecken/cmd/cli"
+	dnsEvents "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/mabels/steinstuecken/iptables_actions"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+type wildcardSubject struct {
+	as       *dnsEvents.ActiveSubject
+	fs       *dnsEvents.ForwardedSubject
+	lastSeen time.Time
+}
+
+type wildcardTarget struct {
+	target   *cli.Target
+	state    *targetState
+	subjects map[string]*wildcardSubject
+}
+
+// wildcards instantiates a subject per observed name of the wildcard
+// targets, the subjects are removed with their rules after the idle time
+type wildcards struct {
+	lock    sync.Mutex
+	log     *zerolog.Logger
+	des     *dnsEvents.DnsEventStream
+	ipts    *iptables_actions.IpTables
+	targets []*wildcardTarget
+	now     func() time.Time
+}
+
+func newWildcards(zlog *zerolog.Logger, des *dnsEvents.DnsEventStream, ipts *iptables_actions.IpTables) *wildcards {
+	return &wildcards{
+		log:  zlog,
+		des:  des,
+		ipts: ipts,
+		now:  time.Now,
+	}
+}
+
+func (w *wildcards) Add(target *cli.Target, state *targetState) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.targets = append(w.targets, &wildcardTarget{
+		target:   target,
+		state:    state,
+		subjects: make(map[string]*wildcardSubject),
+	})
+}
+
+// subjectsFor returns the subjects of the matching targets, missing
+// subjects are created and activated
+func (w *wildcards) subjectsFor(q dns.Question) []*wildcardSubject {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	question := dns.Question{
+		Name:   dns.Fqdn(strings.ToLower(q.Name)),
+		Qtype:  q.Qtype,
+		Qclass: dns.ClassINET,
+	}
+	key := dnsEvents.KeySubject(question)
+	out := []*wildcardSubject{}
+	for _, wt := range w.targets {
+		if !wt.target.Wildcard.Matches(q.Name) || !wt.target.Wildcard.HasType(q.Qtype) {
+			continue
+		}
+		ws, found := wt.subjects[key]
+		if !found {
+			fs := &dnsEvents.ForwardedSubject{
+				Question: question,
+				MinTTL:   wt.target.Wildcard.Idle,
+			}
+			as, err := dnsEvents.NewActiveSubject(fs, w.des)
+			if err != nil {
+				w.log.Error().Err(err).Str("subject", key).Msg("error creating wildcard subject")
+				continue
+			}
+			alog := w.log.With().Str("subject", key).Str("wildcard", wt.target.Wildcard.Pattern).Logger()
+			as.Log = &alog
+			as.Bind(onHistory(fs, bindFn(as.Log, wt.state, w.ipts)))
+			err = as.Activate()
+			if err != nil {
+				w.log.Error().Err(err).Str("subject", key).Msg("error activating wildcard subject")
+				continue
+			}
+			as.Log.Info().Msg("wildcard activated")
+			ws = &wildcardSubject{as: as, fs: fs}
+			wt.subjects[key] = ws
+		}
+		ws.lastSeen = w.now()
+		out = append(out, ws)
+	}
+	return out
+}
+
+// Observe installs the addresses of an answer for the matching wildcard
+// targets before it returns
+func (w *wildcards) Observe(q dns.Question, rrs []dns.RR) {
+	for _, ws := range w.subjectsFor(q) {
+		ws.fs.Authorize(rrs)
+	}
+}
+
+// ObserveMsg observes the questions of a snooped dns answer
+func (w *wildcards) ObserveMsg(msg *dns.Msg) {
+	if !msg.Response || msg.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, q := range msg.Question {
+		w.Observe(q, msg.Answer)
+	}
+}
+
+// Expire removes the subjects which are idle and their rules
+func (w *wildcards) Expire() {
+	w.lock.Lock()
+	now := w.now()
+	expired := []*wildcardSubject{}
+	for _, wt := range w.targets {
+		for key, ws := range wt.subjects {
+			if now.Sub(ws.lastSeen) > wt.target.Wildcard.Idle {
+				delete(wt.subjects, key)
+				expired = append(expired, ws)
+			}
+		}
+	}
+	w.lock.Unlock()
+	for _, ws := range expired {
+		ws.fs.Clear()
+		ws.as.Refresh()
+		err := ws.as.Deactivate()
+		if err != nil {
+			w.log.Warn().Err(err).Msg("error deactivating wildcard subject")
+		}
+	}
+}
+
+func (w *wildcards) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		w.Expire()
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mabels/steinstuecken/cmd/cli"
+	dnsEvents "github.com/mabels/steinstuecken/dns_event_stream"
+	"github.com/mabels/steinstuecken/iptables_actions"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+func TestWildcards(t *testing.T) {
+	zlog := zerolog.Nop()
+	des := dnsEvents.NewDnsEventStream(&zlog)
+	now := time.Unix(1000, 0)
+	wcs := newWildcards(&zlog, des, &iptables_actions.IpTables{})
+	wcs.now = func() time.Time { return now }
+	target := &cli.Target{Wildcard: &cli.Wildcard{Pattern: "*.github.com", Types: []uint16{dns.TypeA}, Idle: time.Minute}}
+	state := newTargetState(target)
+	wcs.Add(target, state)
+
+	a, _ := dns.NewRR("raw.github.com. 60 IN A 192.0.2.1")
+	wcs.Observe(dns.Question{Name: "RAW.github.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, []dns.RR{a})
+	other, _ := dns.NewRR("github.com. 60 IN A 192.0.2.2")
+	wcs.Observe(dns.Question{Name: "github.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, []dns.RR{other})
+	aaaa, _ := dns.NewRR("raw.github.com. 60 IN AAAA 2001:db8::1")
+	wcs.Observe(dns.Question{Name: "raw.github.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, []dns.RR{aaaa})
+	if len(state.dsts) != 1 || state.dsts["192.0.2.1"] == nil {
+		t.Fatalf("dsts: %v", state.sortedDsts())
+	}
+	now = now.Add(30 * time.Second)
+	wcs.Expire()
+	if len(state.dsts) != 1 {
+		t.Errorf("not idle yet: %v", state.sortedDsts())
+	}
+	now = now.Add(61 * time.Second)
+	wcs.Expire()
+	if len(state.dsts) != 0 || len(wcs.targets[0].subjects) != 0 {
+		t.Errorf("idle subject should be removed: %v", state.sortedDsts())
+	}
+}